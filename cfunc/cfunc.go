@@ -2,9 +2,11 @@ package cfunc
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"text/template"
 
 	"sigs.k8s.io/kustomize/kyaml/kio"
@@ -87,6 +89,12 @@ func FixStyles(in ...*yaml.RNode) error {
 	return nil
 }
 
+// templateFuncs are the functions available to templates parsed by
+// ParseTemplate.
+var templateFuncs = template.FuncMap{
+	"quote": Quote,
+}
+
 func ParseTemplates(tmpls map[string]string, data interface{}) ([]*yaml.RNode, error) {
 	templateRs := []*yaml.RNode{}
 	for name, tmpl := range tmpls {
@@ -102,7 +110,7 @@ func ParseTemplates(tmpls map[string]string, data interface{}) ([]*yaml.RNode, e
 
 func ParseTemplate(name, tmpl string, data interface{}) (*yaml.RNode, error) {
 	buff := &bytes.Buffer{}
-	t := template.Must(template.New(name).Parse(tmpl))
+	t := template.Must(template.New(name).Funcs(templateFuncs).Parse(tmpl))
 	if err := t.Execute(buff, data); err != nil {
 		return nil, err
 	}
@@ -182,3 +190,36 @@ func GetReplicas(r *yaml.RNode) (int, error) {
 
 	return replicas, nil
 }
+
+// Indent prefixes each line of text with indent. A trailing newline is kept,
+// and empty text is returned as is.
+func Indent(text, indent string) string {
+	if text == "" {
+		return ""
+	}
+
+	trailing := strings.HasSuffix(text, "\n")
+	lines := strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = indent + line
+	}
+
+	result := strings.Join(lines, "\n")
+	if trailing {
+		result += "\n"
+	}
+	return result
+}
+
+// Quote returns s as a double-quoted YAML scalar on a single line. It is used
+// in templates for values with arbitrary content, such as user provided HCL.
+func Quote(s string) string {
+	buff := &bytes.Buffer{}
+	enc := json.NewEncoder(buff)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(s); err != nil {
+		// Encoding a string does not fail.
+		panic(err)
+	}
+	return strings.TrimSuffix(buff.String(), "\n")
+}
@@ -0,0 +1,46 @@
+package cfunc
+
+import (
+	"testing"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+func TestIndent(t *testing.T) {
+	tests := []struct {
+		text, want string
+	}{
+		{"", ""},
+		{"a", "  a"},
+		{"a\nb\n", "  a\n  b\n"},
+	}
+	for _, tt := range tests {
+		if got := Indent(tt.text, "  "); got != tt.want {
+			t.Errorf("Indent(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestQuote(t *testing.T) {
+	tests := []string{
+		"",
+		"plain",
+		"limits {\n  http_max_conns_per_client = 400\n}\n",
+		`foo = "a\tb" # <&> é`,
+		"tab\tcontrol\x01 line sep",
+		": {} [] # '",
+	}
+	for _, s := range tests {
+		r, err := ParseTemplate("quote", "value: {{ quote . }}\n", s)
+		if err != nil {
+			t.Fatalf("Quote(%q): %v", s, err)
+		}
+		got, err := r.Pipe(yaml.Lookup("value"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.YNode().Value != s {
+			t.Errorf("Quote(%q) parsed as %q", s, got.YNode().Value)
+		}
+	}
+}
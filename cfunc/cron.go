@@ -0,0 +1,123 @@
+package cfunc
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronField describes the allowed values of a field in a Cron schedule.
+type cronField struct {
+	name     string
+	min, max int
+	names    map[string]int
+}
+
+var cronFields = []cronField{
+	{name: "minute", min: 0, max: 59},
+	{name: "hour", min: 0, max: 23},
+	{name: "day of month", min: 1, max: 31},
+	{name: "month", min: 1, max: 12, names: map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}},
+	{name: "day of week", min: 0, max: 6, names: map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}},
+}
+
+var cronDescriptors = map[string]bool{
+	"@yearly":   true,
+	"@annually": true,
+	"@monthly":  true,
+	"@weekly":   true,
+	"@daily":    true,
+	"@midnight": true,
+	"@hourly":   true,
+}
+
+// ValidateCronSchedule returns an error if schedule is not a Cron expression
+// accepted by Kubernetes CronJobs. Besides five field expressions, this
+// includes descriptors such as `@hourly` and `@every <duration>` intervals.
+//
+// https://kubernetes.io/docs/concepts/workloads/controllers/cron-jobs/#cron-schedule-syntax
+func ValidateCronSchedule(schedule string) error {
+	schedule = strings.TrimSpace(schedule)
+	if strings.HasPrefix(schedule, "@every ") {
+		interval := strings.TrimSpace(strings.TrimPrefix(schedule, "@every "))
+		d, err := time.ParseDuration(interval)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("invalid cron interval %q, must be a positive duration such as 90m", interval)
+		}
+		return nil
+	}
+	if strings.HasPrefix(schedule, "@") {
+		if cronDescriptors[schedule] {
+			return nil
+		}
+		return fmt.Errorf("unknown cron descriptor %q", schedule)
+	}
+
+	fields := strings.Fields(schedule)
+	if len(fields) != len(cronFields) {
+		return fmt.Errorf("cron schedule %q must have %v fields, found %v", schedule, len(cronFields), len(fields))
+	}
+
+	for i, field := range fields {
+		if err := cronFields[i].validate(field); err != nil {
+			return fmt.Errorf("cron schedule %q: %v", schedule, err)
+		}
+	}
+
+	return nil
+}
+
+// validate checks a comma separated list of values, ranges and steps.
+func (c cronField) validate(field string) error {
+	for _, expr := range strings.Split(field, ",") {
+		rangeExpr, step := expr, ""
+		if i := strings.Index(expr, "/"); i >= 0 {
+			rangeExpr, step = expr[:i], expr[i+1:]
+			if n, err := strconv.Atoi(step); err != nil || n < 1 {
+				return fmt.Errorf("invalid %v step %q", c.name, step)
+			}
+		}
+
+		if rangeExpr == "*" || rangeExpr == "?" {
+			continue
+		}
+
+		bounds := strings.Split(rangeExpr, "-")
+		if len(bounds) > 2 {
+			return fmt.Errorf("invalid %v range %q", c.name, rangeExpr)
+		}
+		values := []int{}
+		for _, b := range bounds {
+			v, err := c.value(b)
+			if err != nil {
+				return err
+			}
+			values = append(values, v)
+		}
+		if len(values) == 2 && values[0] > values[1] {
+			return fmt.Errorf("invalid %v range %q", c.name, rangeExpr)
+		}
+	}
+
+	return nil
+}
+
+// value converts a number or name into a value within the field's bounds.
+func (c cronField) value(s string) (int, error) {
+	if v, ok := c.names[strings.ToLower(s)]; ok {
+		return v, nil
+	}
+
+	v, err := strconv.Atoi(s)
+	if err != nil || v < c.min || v > c.max {
+		return 0, fmt.Errorf("invalid %v value %q, must be between %v and %v", c.name, s, c.min, c.max)
+	}
+
+	return v, nil
+}
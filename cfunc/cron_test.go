@@ -0,0 +1,45 @@
+package cfunc
+
+import "testing"
+
+func TestValidateCronSchedule(t *testing.T) {
+	tests := []struct {
+		schedule string
+		wantErr  bool
+	}{
+		{"0 */1 * * *", false},
+		{" 0 0 * * * ", false},
+		{"*/15 9-17 * * mon-fri", false},
+		{"0,30 0 1,15 jan-jun,DEC 0", false},
+		{"? ? ? ? ?", false},
+		{"@hourly", false},
+		{"@midnight", false},
+		{"@every 90m", false},
+		{"@every 1h30m", false},
+		{"", true},
+		{"0 * * *", true},
+		{"0 * * * * *", true},
+		{"60 * * * *", true},
+		{"0 24 * * *", true},
+		{"0 0 0 * *", true},
+		{"0 0 32 * *", true},
+		{"0 0 * 13 *", true},
+		{"0 0 * * 7", true},
+		{"0 0 * foo *", true},
+		{"5-1 * * * *", true},
+		{"1-2-3 * * * *", true},
+		{"*/0 * * * *", true},
+		{"*/x * * * *", true},
+		{"@fortnightly", true},
+		{"@every", true},
+		{"@every 90", true},
+		{"@every 0s", true},
+		{"@every -5m", true},
+	}
+	for _, tt := range tests {
+		err := ValidateCronSchedule(tt.schedule)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ValidateCronSchedule(%q) = %v, want error %v", tt.schedule, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package consul
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// aclTokenConfig holds information used to generate a workload's ACL token
+// Resources.
+type aclTokenConfig struct {
+	// Rules is the workload's ACL policy, including node write access for
+	// the sidecar agent.
+	Rules string
+
+	// Hash identifies the policy. It is part of the Job name so policy
+	// changes result in a new Job.
+	Hash string
+
+	// casiConfig contains the workload and Consul instance information.
+	*casiConfig
+}
+
+// aclToken validates a workload's ACL token options and returns the
+// configuration for its token Resources.
+func (f *ConfigFunction) aclToken(patchCfg *casiConfig) (*aclTokenConfig, error) {
+	switch {
+	case !f.Data.ACLBootstrapJobEnabled:
+		return nil, fmt.Errorf("acl_token_rules requires acl_bootstrap_job_enabled.")
+	case patchCfg.Sidecar.AgentTokenSecretName == "":
+		return nil, fmt.Errorf("acl_token_rules requires agent_token_secret_name.")
+	case patchCfg.PatchTarget.Namespace != f.Namespace:
+		return nil, fmt.Errorf("acl_token_rules requires %v %v to be in the %v namespace.",
+			patchCfg.PatchTarget.Kind, patchCfg.PatchTarget.Name, f.Namespace)
+	}
+
+	// The sidecar agent registers a node named after its Pod.
+	rules := fmt.Sprintf("node_prefix %q {\n  policy = \"write\"\n}\n%v",
+		patchCfg.PatchTarget.Name+"-", patchCfg.Sidecar.ACLTokenRules)
+
+	sum := sha256.Sum256([]byte(rules + patchCfg.Sidecar.AgentTokenSecretName))
+	return &aclTokenConfig{
+		Rules:      rules,
+		Hash:       fmt.Sprintf("%x", sum)[:10],
+		casiConfig: patchCfg,
+	}, nil
+}
+
+// removeStaleACLTokenJobs filters out ACL token Jobs which are not part of the
+// generated Resources.
+func (f *ConfigFunction) removeStaleACLTokenJobs(in, generated []*yaml.RNode) ([]*yaml.RNode, error) {
+	prefix := f.Name + "-acl-token-"
+
+	current := map[string]bool{}
+	for _, r := range generated {
+		rMeta, err := r.GetMeta()
+		if err != nil {
+			return nil, err
+		}
+		if rMeta.Kind == "Job" {
+			current[rMeta.Name] = true
+		}
+	}
+
+	out := []*yaml.RNode{}
+	for _, r := range in {
+		rMeta, err := r.GetMeta()
+		if err != nil {
+			return nil, err
+		}
+
+		if rMeta.Kind == "Job" &&
+			rMeta.Namespace == f.Namespace &&
+			strings.HasPrefix(rMeta.Name, prefix) &&
+			!current[rMeta.Name] {
+			continue
+		}
+		out = append(out, r)
+	}
+
+	return out, nil
+}
+
+func aclTokenTemplates() map[string]string {
+	return map[string]string{
+		"acl-token-job":         aclTokenJobTemplate,
+		"acl-token-sa":          aclTokenSATemplate,
+		"acl-token-role":        aclTokenRoleTemplate,
+		"acl-token-rolebinding": aclTokenRoleBindingTemplate,
+	}
+}
+
+var aclTokenJobTemplate = `apiVersion: batch/v1
+kind: Job
+metadata:
+  name: {{ .Name }}-acl-token-{{ .PatchTarget.Name }}-{{ .Hash }}
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+spec:
+  template:
+    spec:
+      serviceAccountName: {{ .Name }}-acl-token-{{ .PatchTarget.Name }}
+      restartPolicy: OnFailure
+      initContainers:
+        - name: secret-check
+          image: k8s.gcr.io/hyperkube:v1.17.4
+          command:
+            - /bin/sh
+            - -ec
+            - |-
+              if kubectl get secret "${SECRET_NAME}" >/dev/null 2>&1; then
+                echo "[INFO] Secret ${SECRET_NAME} exists, the token is kept."
+                touch /consul/acl-token/exists
+              fi
+          env:
+            - name: SECRET_NAME
+              value: {{ .Sidecar.AgentTokenSecretName }}
+          volumeMounts:
+            - name: acl-token
+              mountPath: /consul/acl-token
+        - name: consul-acl-token
+          image: docker.io/library/consul:1.7.2
+          command:
+            - /bin/sh
+            - -ec
+            - |-
+              token_dir="/consul/acl-token"
+              printf '%s\n' "${ACL_TOKEN_RULES}" > /tmp/rules.hcl
+
+              if consul acl policy read -name "${POLICY_NAME}" >/dev/null 2>&1; then
+                echo "[INFO] Updating ACL policy ${POLICY_NAME}."
+                consul acl policy update -name "${POLICY_NAME}" -rules @/tmp/rules.hcl
+              else
+                echo "[INFO] Creating ACL policy ${POLICY_NAME}."
+                consul acl policy create -name "${POLICY_NAME}" -rules @/tmp/rules.hcl
+              fi
+
+              if [ -f "${token_dir}/exists" ]; then
+                exit 0
+              fi
+
+              echo "[INFO] Creating ACL token for ${POLICY_NAME}."
+              output="$(consul acl token create -policy-name "${POLICY_NAME}" \
+                -description "{{ .PatchTarget.Kind }} {{ .PatchTarget.Name }}")"
+              echo "${output}"|grep AccessorID|awk '{print $2}'|tr -d '\n' >\
+                "${token_dir}/accessor_id.txt"
+              echo "${output}"|grep SecretID|awk '{print $2}'|tr -d '\n' >\
+                "${token_dir}/secret_id.txt"
+          env:
+            - name: POLICY_NAME
+              value: {{ .Sidecar.AgentTokenSecretName }}
+            - name: ACL_TOKEN_RULES
+              value: {{ quote .Rules }}
+            - name: CONSUL_HTTP_TOKEN
+              valueFrom:
+                secretKeyRef:
+                  name: {{ .Data.ACLBootstrapSecretName }}
+                  key: secret_id.txt
+{{- if .Data.TLSGeneratorJobEnabled }}
+            - name: CONSUL_HTTP_ADDR
+              value: https://{{ .Name }}-server.{{ .Namespace }}.svc:8500
+            - name: CONSUL_CACERT
+              value: /consul/tls/consul-agent-ca.pem
+            - name: CONSUL_CLIENT_CERT
+              value: /consul/tls/dc1-cli-consul-0.pem
+            - name: CONSUL_CLIENT_KEY
+              value: /consul/tls/dc1-cli-consul-0-key.pem
+{{- else }}
+            - name: CONSUL_HTTP_ADDR
+              value: http://{{ .Name }}-server.{{ .Namespace }}.svc:8500
+{{- end }}
+          volumeMounts:
+            - name: acl-token
+              mountPath: /consul/acl-token
+{{- if .Data.TLSGeneratorJobEnabled }}
+            - name: consul-tls-secret
+              mountPath: /consul/tls
+{{- end }}
+      containers:
+        - name: secret-create
+          image: k8s.gcr.io/hyperkube:v1.17.4
+          command:
+            - /bin/sh
+            - -ec
+            - |-
+              token_dir="/consul/acl-token"
+              if [ -f "${token_dir}/exists" ]; then
+                exit 0
+              fi
+
+              echo "[INFO] Creating Secret ${SECRET_NAME}."
+              kubectl create secret generic "${SECRET_NAME}" \
+                "--from-file=${token_dir}/accessor_id.txt" \
+                "--from-file=${token_dir}/secret_id.txt"
+          env:
+            - name: SECRET_NAME
+              value: {{ .Sidecar.AgentTokenSecretName }}
+          volumeMounts:
+            - name: acl-token
+              mountPath: /consul/acl-token
+      volumes:
+        - name: acl-token
+          emptyDir: {}
+{{- if .Data.TLSGeneratorJobEnabled }}
+        - name: consul-tls-secret
+          projected:
+            sources:
+              - secret:
+                  name: {{ .Data.TLSCASecretName }}
+              - secret:
+                  name: {{ .Data.TLSCLISecretName }}
+{{- end }}
+`
+
+var aclTokenSATemplate = `apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: {{ .Name }}-acl-token-{{ .PatchTarget.Name }}
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+`
+
+var aclTokenRoleTemplate = `apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: {{ .Name }}-acl-token-{{ .PatchTarget.Name }}
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+rules:
+  - apiGroups:
+      - ""
+    resources:
+      - secrets
+    verbs:
+      - create
+  - apiGroups:
+      - ""
+    resources:
+      - secrets
+    verbs:
+      - get
+    resourceNames:
+      - {{ .Sidecar.AgentTokenSecretName }}
+`
+
+var aclTokenRoleBindingTemplate = `apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: {{ .Name }}-acl-token-{{ .PatchTarget.Name }}
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: Role
+  name: {{ .Name }}-acl-token-{{ .PatchTarget.Name }}
+subjects:
+  - kind: ServiceAccount
+    name: {{ .Name }}-acl-token-{{ .PatchTarget.Name }}
+`
@@ -2,15 +2,10 @@ package consul
 
 func backupCronJobTemplates() map[string]string {
 	return map[string]string{
-		"backup-cronjob":              backupCronJobTemplate,
-		"backup-sa":                   backupSATemplate,
-		"backup-role":                 backupRoleTemplate,
-		"backup-rolebinding":          backupRoleBindingTemplate,
-		"restore-secrets-cronjob":     restoreSecretsCronJobTemplate,
-		"restore-secrets-sa":          restoreSecretsSATemplate,
-		"restore-secrets-role":        restoreSecretsRoleTemplate,
-		"restore-secrets-rolebinding": restoreSecretsRoleBindingTemplate,
-		"restore-snapshot-cronjob":    restoreSnapshotCronJobTemplate,
+		"backup-cronjob":     backupCronJobTemplate,
+		"backup-sa":          backupSATemplate,
+		"backup-role":        backupRoleTemplate,
+		"backup-rolebinding": backupRoleBindingTemplate,
 	}
 }
 
@@ -23,7 +18,13 @@ metadata:
     app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
     app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
 spec:
-  schedule: 0 */1 * * *
+  schedule: "{{ .Data.BackupSchedule }}"
+  successfulJobsHistoryLimit: {{ .Data.BackupSuccessfulJobsHistoryLimit }}
+  failedJobsHistoryLimit: {{ .Data.BackupFailedJobsHistoryLimit }}
+  concurrencyPolicy: {{ .Data.BackupConcurrencyPolicy }}
+{{- if .Data.BackupStartingDeadlineSeconds }}
+  startingDeadlineSeconds: {{ .Data.BackupStartingDeadlineSeconds }}
+{{- end }}
   jobTemplate:
     metadata:
       labels:
@@ -74,45 +75,137 @@ spec:
                 - name: consul-tls-secret
                   mountPath: /consul/tls
 {{- end }}
+{{- if and .Data.BackupS3Endpoint .Data.BackupS3Bucket }}
+            - name: consul-backup-bundle
+{{- else }}
           containers:
             - name: consul-backup-ship
+{{- end }}
               image: k8s.gcr.io/hyperkube:v1.17.4
               command:
                 - /bin/sh
                 - -ec
                 - |-
-                  mkdir /k8s-backup
+{{- if and .Data.BackupS3Endpoint .Data.BackupS3Bucket }}
+                  # Bundle Secrets alongside the snapshot for upload.
+                  k8s_backup_dir=/consulbackup
+{{- else }}
+                  k8s_backup_dir=/k8s-backup
+                  mkdir "${k8s_backup_dir}"
+{{- end }}
+
                   if [ "${acl_bootstrap_job_enabled}" = "true" ]; then
                     kubectl get secret "${acl_bootstrap_secret_name}" -o yaml |\
                       grep -Ev 'creationTimestamp|resourceVersion|selfLink|uid' \
-                      > "/k8s-backup/${acl_bootstrap_secret_name}.yaml"
+                      > "${k8s_backup_dir}/${acl_bootstrap_secret_name}.yaml"
                   fi
 
                   if [ "${tls_generator_job_enabled}" = "true" ]; then
                     for secret in "${tls_server_secret_name}" "${tls_ca_secret_name}" "${tls_cli_secret_name}" "${tls_client_secret_name}"; do
                       kubectl get secret "${secret}" -o yaml |\
                         grep -Ev 'creationTimestamp|resourceVersion|selfLink|uid' \
-                        > "/k8s-backup/${secret}.yaml"
+                        > "${k8s_backup_dir}/${secret}.yaml"
                       done
                   fi
 
                   if [ "${gossip_key_generator_job_enabled}" = "true" ]; then
                     kubectl get secret "${gossip_secret_name}" -o yaml |\
                       grep -Ev 'creationTimestamp|resourceVersion|selfLink|uid' \
-                      > "/k8s-backup/${gossip_secret_name}.yaml"
+                      > "${k8s_backup_dir}/${gossip_secret_name}.yaml"
                   fi
 
+{{- if not (and .Data.BackupS3Endpoint .Data.BackupS3Bucket) }}
+
                   kubectl create secret generic "${backup_secret_name}" \
-                    --from-file=/k8s-backup \
+                    --from-file="${k8s_backup_dir}" \
                     --from-file=/consulbackup
+{{- end }}
               envFrom:
                 - configMapRef:
                     name: {{ .Name }}
               volumeMounts:
                 - name: consul-backup
                   mountPath: /consulbackup
+{{- if and .Data.BackupS3Endpoint .Data.BackupS3Bucket }}
+            - name: consul-backup-upload
+              image: docker.io/minio/mc:RELEASE.2020-04-04T05-28-55Z
+              command:
+                - /bin/sh
+                - -ec
+                - |-
+                  endpoint="${backup_s3_endpoint}"
+                  export MC_HOST_backup="${endpoint%%://*}://${AWS_ACCESS_KEY_ID}:${AWS_SECRET_ACCESS_KEY}@${endpoint#*://}"
+
+                  bundle="{{ .Name }}-{{ .Namespace }}-$(date -u +%Y%m%dT%H%M%SZ).tar.gz"
+                  tar -C /consulbackup -czf "/tmp/${bundle}" .
+
+                  echo "[INFO] Uploading ${bundle}."
+                  mc cp "/tmp/${bundle}" \
+                    "backup/${backup_s3_bucket}/{{ .Name }}-{{ .Namespace }}/${bundle}"
+              envFrom:
+                - configMapRef:
+                    name: {{ .Name }}
+                - secretRef:
+                    name: {{ .Data.BackupS3SecretName }}
+{{- if .Data.BackupS3CASecretName }}
+              env:
+                - name: SSL_CERT_FILE
+                  value: /backup-s3-ca/ca.crt
+{{- end }}
+              volumeMounts:
+                - name: consul-backup
+                  mountPath: /consulbackup
+{{- if .Data.BackupS3CASecretName }}
+                - name: backup-s3-ca
+                  mountPath: /backup-s3-ca
+                  readOnly: true
+{{- end }}
+          containers:
+            - name: consul-backup-prune
+              image: docker.io/minio/mc:RELEASE.2020-04-04T05-28-55Z
+              command:
+                - /bin/sh
+                - -ec
+                - |-
+                  retention="${backup_retention_count}"
+                  if [ "${retention}" -lt 1 ]; then
+                    echo "[INFO] Keeping all backups."
+                    exit 0
+                  fi
+
+                  endpoint="${backup_s3_endpoint}"
+                  export MC_HOST_backup="${endpoint%%://*}://${AWS_ACCESS_KEY_ID}:${AWS_SECRET_ACCESS_KEY}@${endpoint#*://}"
+                  prefix="backup/${backup_s3_bucket}/{{ .Name }}-{{ .Namespace }}/"
+
+                  # Bundle names sort by their timestamp, newest first.
+                  mc ls "${prefix}" | awk '{print $NF}' | sort -r |\
+                    tail -n "+$((retention + 1))" |\
+                    while read -r bundle; do
+                      echo "[INFO] Pruning ${bundle}."
+                      mc rm "${prefix}${bundle}"
+                    done
+              envFrom:
+                - configMapRef:
+                    name: {{ .Name }}
+                - secretRef:
+                    name: {{ .Data.BackupS3SecretName }}
+{{- if .Data.BackupS3CASecretName }}
+              env:
+                - name: SSL_CERT_FILE
+                  value: /backup-s3-ca/ca.crt
+              volumeMounts:
+                - name: backup-s3-ca
+                  mountPath: /backup-s3-ca
+                  readOnly: true
+{{- end }}
+{{- end }}
           volumes:
             - name: consul-backup
+{{- if and .Data.BackupS3Endpoint .Data.BackupS3Bucket .Data.BackupS3CASecretName }}
+            - name: backup-s3-ca
+              secret:
+                secretName: {{ .Data.BackupS3CASecretName }}
+{{- end }}
 {{- if .Data.TLSGeneratorJobEnabled }}
             - name: consul-tls-secret
               projected:
@@ -145,12 +238,14 @@ metadata:
     app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
     app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
 rules:
+{{- if not (and .Data.BackupS3Endpoint .Data.BackupS3Bucket) }}
   - apiGroups:
       - ""
     resources:
       - secrets
     verbs:
       - create
+{{- end }}
   - apiGroups:
       - ""
     resources:
@@ -183,212 +278,3 @@ subjects:
   - kind: ServiceAccount
     name: {{ .Name }}-backup
 `
-
-// Restore Secrets Resources
-var restoreSecretsCronJobTemplate = `apiVersion: batch/v1beta1
-kind: CronJob
-metadata:
-  name: {{ .Name }}-restore-secrets
-  namespace: "{{ .Namespace }}"
-  labels:
-    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
-    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
-spec:
-  schedule: 0 */1 * * *
-  suspend: true
-  jobTemplate:
-    metadata:
-      labels:
-        app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
-        app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
-    spec:
-      template:
-        metadata:
-          name: consul-restore-secrets
-          labels:
-            app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
-            app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
-        spec:
-          serviceAccountName: {{ .Name }}-restore-secrets
-          restartPolicy: OnFailure
-          containers:
-            - name: consul-restore-secrets
-              image: k8s.gcr.io/hyperkube:v1.17.4
-              command:
-                - /bin/sh
-                - -ec
-                - |-
-                  for secret_yaml in /consul/restore/*.yaml; do
-                    kubectl create -f "${secret_yaml}"
-                  done
-              volumeMounts:
-                - name: restore-secret
-                  mountPath: /consul/restore
-          volumes:
-            - name: restore-secret
-              projected:
-                sources:
-                  - secret:
-                      name: {{ .Data.RestoreSecretName }}
-`
-
-var restoreSecretsSATemplate = `apiVersion: v1
-kind: ServiceAccount
-metadata:
-  name: {{ .Name }}-restore-secrets
-  namespace: "{{ .Namespace }}"
-  labels:
-    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
-    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
-`
-
-var restoreSecretsRoleTemplate = `apiVersion: rbac.authorization.k8s.io/v1
-kind: Role
-metadata:
-  name: {{ .Name }}-restore-secrets
-  namespace: "{{ .Namespace }}"
-  labels:
-    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
-    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
-rules:
-  - apiGroups:
-      - ""
-    resources:
-      - secrets
-    verbs:
-      - create
-`
-
-var restoreSecretsRoleBindingTemplate = `apiVersion: rbac.authorization.k8s.io/v1
-kind: RoleBinding
-metadata:
-  name: {{ .Name }}-restore-secrets
-  namespace: "{{ .Namespace }}"
-  labels:
-    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
-    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
-roleRef:
-  apiGroup: rbac.authorization.k8s.io
-  kind: Role
-  name: {{ .Name }}-restore-secrets
-subjects:
-  - kind: ServiceAccount
-    name: {{ .Name }}-restore-secrets
-`
-
-// Restore Snapshot Resources
-var restoreSnapshotCronJobTemplate = `apiVersion: batch/v1beta1
-kind: CronJob
-metadata:
-  name: {{ .Name }}-restore-snapshot
-  namespace: "{{ .Namespace }}"
-  labels:
-    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
-    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
-spec:
-  schedule: 0 */1 * * *
-  suspend: true
-  jobTemplate:
-    metadata:
-      labels:
-        app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
-        app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
-    spec:
-      template:
-        metadata:
-          name: consul-restore-snapshot
-          labels:
-            app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
-            app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
-        spec:
-          restartPolicy: OnFailure
-          initContainers:
-            - name: consul-acl-bootstrap
-              image: docker.io/library/consul:1.7.2
-              command:
-                - /bin/sh
-                - -ec
-                - |-
-                  secret_dir="/consul/acl"
-
-                  output="$(consul acl bootstrap)"
-
-                  if [ "${output}" = "" ]; then
-                    echo "[ERROR] No consul acl bootstrap output. Is consul up and running?"
-                    exit 1
-                  fi
-
-                  echo "${output}"|grep SecretID|awk '{print $2}'|tr -d '\n' \
-                    > "${secret_dir}/secret_id.txt"
-              env:
-{{- if .Data.TLSGeneratorJobEnabled }}
-                - name: CONSUL_HTTP_ADDR
-                  value: https://{{ .Name }}-server.{{ .Namespace }}.svc:8500
-                - name: CONSUL_CACERT
-                  value: /consul/tls/consul-agent-ca.pem
-                - name: CONSUL_CLIENT_CERT
-                  value: /consul/tls/dc1-cli-consul-0.pem
-                - name: CONSUL_CLIENT_KEY
-                  value: /consul/tls/dc1-cli-consul-0-key.pem
-{{- else }}
-                - name: CONSUL_HTTP_ADDR
-                  value: http://{{ .Name }}-server.{{ .Namespace }}.svc:8500
-{{- end }}
-              volumeMounts:
-                - name: consul-acl-token
-                  mountPath: /consul/acl
-{{- if .Data.TLSGeneratorJobEnabled }}
-                - name: consul-tls-secret
-                  mountPath: /consul/tls
-{{- end }}
-          containers:
-            - name: consul-restore-snapshot
-              image: docker.io/library/consul:1.7.2
-              command:
-                - consul
-                - snapshot
-                - restore
-                - -token-file=/consul/acl/secret_id.txt
-                - /consul/restore/backup.snap
-              env:
-{{- if .Data.TLSGeneratorJobEnabled }}
-                - name: CONSUL_HTTP_ADDR
-                  value: https://{{ .Name }}-server.{{ .Namespace }}.svc:8500
-                - name: CONSUL_CACERT
-                  value: /consul/tls/consul-agent-ca.pem
-                - name: CONSUL_CLIENT_CERT
-                  value: /consul/tls/dc1-cli-consul-0.pem
-                - name: CONSUL_CLIENT_KEY
-                  value: /consul/tls/dc1-cli-consul-0-key.pem
-{{- else }}
-                - name: CONSUL_HTTP_ADDR
-                  value: http://{{ .Name }}-server.{{ .Namespace }}.svc:8500
-{{- end }}
-              volumeMounts:
-                - name: consul-acl-token
-                  mountPath: /consul/acl
-{{- if .Data.TLSGeneratorJobEnabled }}
-                - name: consul-tls-secret
-                  mountPath: /consul/tls
-{{- end }}
-                - name: restore-secret
-                  mountPath: /consul/restore
-          volumes:
-            - name: consul-acl-token
-            - name: restore-secret
-              projected:
-                sources:
-                  - secret:
-                      name: {{ .Data.RestoreSecretName }}
-{{- if .Data.TLSGeneratorJobEnabled }}
-            - name: consul-tls-secret
-              projected:
-                sources:
-                  - secret:
-                      name: {{ .Data.TLSCASecretName }}
-                  - secret:
-                      name: {{ .Data.TLSCLISecretName }}
-                  - secret:
-                      name: {{ .Data.TLSClientSecretName }}
-{{- end }}
-`
@@ -0,0 +1,266 @@
+package consul
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// containerNames returns the names of the containers in the list at path in
+// r.
+func containerNames(t *testing.T, r *yaml.RNode, path ...string) []string {
+	t.Helper()
+	names := []string{}
+	list := lookup(t, r, path...)
+	if list == nil {
+		return names
+	}
+	for _, c := range list.Content() {
+		names = append(names, value(t, yaml.NewRNode(c), "name"))
+	}
+	return names
+}
+
+func TestBackupCronJob(t *testing.T) {
+	tests := []struct {
+		name           string
+		data           map[string]string
+		initContainers []string
+		containers     []string
+		createSecrets  bool
+	}{
+		{
+			"secret",
+			map[string]string{},
+			[]string{"consul-snapshot-save"},
+			[]string{"consul-backup-ship"},
+			true,
+		},
+		{
+			"object storage",
+			map[string]string{
+				"backup_s3_endpoint": "http://minio.example.svc:9000",
+				"backup_s3_bucket":   "consul-backups",
+			},
+			[]string{"consul-snapshot-save", "consul-backup-bundle", "consul-backup-upload"},
+			[]string{"consul-backup-prune"},
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.data["backup_cron_job_enabled"] = "true"
+			out := runFilter(t, tt.data)
+
+			podSpec := lookup(t, findResource(t, out, "CronJob", "my-consul-backup"),
+				"spec", "jobTemplate", "spec", "template", "spec")
+			if got := containerNames(t, podSpec, "initContainers"); strings.Join(got, ",") != strings.Join(tt.initContainers, ",") {
+				t.Errorf("init containers %v, want %v", got, tt.initContainers)
+			}
+			if got := containerNames(t, podSpec, "containers"); strings.Join(got, ",") != strings.Join(tt.containers, ",") {
+				t.Errorf("containers %v, want %v", got, tt.containers)
+			}
+
+			role := findResource(t, out, "Role", "my-consul-backup")
+			if got := strings.Contains(role.MustString(), "- create"); got != tt.createSecrets {
+				t.Errorf("Role allows creating Secrets %v, want %v", got, tt.createSecrets)
+			}
+		})
+	}
+}
+
+func TestBackupOptionErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data map[string]string
+		want string
+	}{
+		{
+			"endpoint only",
+			map[string]string{"backup_s3_endpoint": "http://minio.example.svc:9000"},
+			"backup_s3_endpoint and backup_s3_bucket must be set together.",
+		},
+		{
+			"bucket only",
+			map[string]string{"backup_s3_bucket": "consul-backups"},
+			"backup_s3_endpoint and backup_s3_bucket must be set together.",
+		},
+		{
+			"negative retention",
+			map[string]string{"backup_retention_count": "-1"},
+			"invalid backup_retention_count -1, must not be negative.",
+		},
+		{
+			"negative successful history",
+			map[string]string{"backup_successful_jobs_history_limit": "-1"},
+			"invalid backup_successful_jobs_history_limit -1, must not be negative.",
+		},
+		{
+			"negative failed history",
+			map[string]string{"backup_failed_jobs_history_limit": "-2"},
+			"invalid backup_failed_jobs_history_limit -2, must not be negative.",
+		},
+		{
+			"negative starting deadline",
+			map[string]string{"backup_starting_deadline_seconds": "-30"},
+			"invalid backup_starting_deadline_seconds -30, must not be negative.",
+		},
+		{
+			"invalid schedule",
+			map[string]string{"backup_schedule": "@every 0s"},
+			`invalid backup_schedule: invalid cron interval "0s", must be a positive duration such as 90m`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.data["backup_cron_job_enabled"] = "true"
+			_, err := newFunction(t, tt.data).Filter(nil)
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("got error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestScheduleValidationDisabled(t *testing.T) {
+	data := map[string]string{
+		"backup_schedule":       "not a schedule",
+		"tls_rotation_schedule": "not a schedule",
+	}
+	if _, err := newFunction(t, data).Filter(nil); err != nil {
+		t.Errorf("schedules of disabled CronJobs were validated: %v", err)
+	}
+
+	data["tls_generator_job_enabled"] = "true"
+	data["tls_rotation_cron_job_enabled"] = "true"
+	if _, err := newFunction(t, data).Filter(nil); err == nil {
+		t.Error("invalid tls_rotation_schedule accepted")
+	}
+}
+
+func TestBackupS3CA(t *testing.T) {
+	tests := []struct {
+		name string
+		ca   string
+	}{
+		{"public", ""},
+		{"private", "minio-ca"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := map[string]string{
+				"backup_cron_job_enabled":  "true",
+				"backup_s3_endpoint":       "https://minio.example.svc:9000",
+				"backup_s3_bucket":         "consul-backups",
+				"backup_s3_ca_secret_name": tt.ca,
+			}
+			podSpec := lookup(t, findResource(t, runFilter(t, data), "CronJob", "my-consul-backup"),
+				"spec", "jobTemplate", "spec", "template", "spec")
+
+			if got := value(t, podSpec, "volumes", "[name=backup-s3-ca]", "secret", "secretName"); got != tt.ca {
+				t.Errorf("backup-s3-ca volume Secret %q, want %q", got, tt.ca)
+			}
+			for _, c := range []string{"initContainers/consul-backup-upload", "containers/consul-backup-prune"} {
+				parts := strings.Split(c, "/")
+				container := lookup(t, podSpec, parts[0], "[name="+parts[1]+"]")
+				certFile := value(t, container, "env", "[name=SSL_CERT_FILE]", "value")
+				mount := value(t, container, "volumeMounts", "[name=backup-s3-ca]", "mountPath")
+				if tt.ca == "" && (certFile != "" || mount != "") {
+					t.Errorf("%v trusts a custom CA without backup_s3_ca_secret_name", parts[1])
+				}
+				if tt.ca != "" && (certFile != "/backup-s3-ca/ca.crt" || mount != "/backup-s3-ca") {
+					t.Errorf("%v SSL_CERT_FILE %q mounted at %q, want /backup-s3-ca/ca.crt", parts[1], certFile, mount)
+				}
+			}
+		})
+	}
+}
+
+// fakeMC is an `mc` stand-in which lists the bundles in $MC_LS and records
+// removed objects in $MC_RM.
+const fakeMC = `#!/bin/sh
+case "$1" in
+  ls) printf '%s\n' $MC_LS | sed 's/^/[2020-04-04 05:28:55 UTC] 1.2KiB /' ;;
+  rm) echo "$2" >> "$MC_RM" ;;
+esac
+`
+
+func TestBackupPrune(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not available")
+	}
+
+	data := map[string]string{
+		"backup_cron_job_enabled": "true",
+		"backup_s3_endpoint":      "http://minio.example.svc:9000",
+		"backup_s3_bucket":        "consul-backups",
+	}
+	out := runFilter(t, data)
+	command := lookup(t, findResource(t, out, "CronJob", "my-consul-backup"),
+		"spec", "jobTemplate", "spec", "template", "spec",
+		"containers", "[name=consul-backup-prune]", "command")
+	if command == nil {
+		t.Fatal("consul-backup-prune has no command")
+	}
+	script := command.Content()[len(command.Content())-1].Value
+
+	bundles := []string{
+		"my-consul-example-20200401T000000Z.tar.gz",
+		"my-consul-example-20200403T000000Z.tar.gz",
+		"my-consul-example-20200402T000000Z.tar.gz",
+		"my-consul-example-20200404T000000Z.tar.gz",
+	}
+	tests := []struct {
+		retention string
+		pruned    []string
+	}{
+		{"0", nil},
+		{"2", []string{bundles[2], bundles[0]}},
+		{"4", nil},
+	}
+	for _, tt := range tests {
+		t.Run("retention "+tt.retention, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "backup-prune")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			if err := ioutil.WriteFile(filepath.Join(dir, "mc"), []byte(fakeMC), 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			rmLog := filepath.Join(dir, "rm.log")
+			cmd := exec.Command("sh", "-ec", script)
+			cmd.Env = append(os.Environ(),
+				"PATH="+dir+string(os.PathListSeparator)+os.Getenv("PATH"),
+				"MC_LS="+strings.Join(bundles, " "),
+				"MC_RM="+rmLog,
+				"AWS_ACCESS_KEY_ID=minio",
+				"AWS_SECRET_ACCESS_KEY=minio123",
+				"backup_s3_endpoint=http://minio.example.svc:9000",
+				"backup_s3_bucket=consul-backups",
+				"backup_retention_count="+tt.retention,
+			)
+			if output, err := cmd.CombinedOutput(); err != nil {
+				t.Fatalf("prune script failed: %v\n%s", err, output)
+			}
+
+			removed, err := ioutil.ReadFile(rmLog)
+			if err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+			want := ""
+			for _, b := range tt.pruned {
+				want += "backup/consul-backups/my-consul-example/" + b + "\n"
+			}
+			if string(removed) != want {
+				t.Errorf("pruned:\n%v\nwant:\n%v", string(removed), want)
+			}
+		})
+	}
+}
@@ -0,0 +1,230 @@
+package consul
+
+import (
+	"fmt"
+
+	"github.com/bzub/config-functions/cfunc"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// clientACLToken generates Resources which create the client agent
+// DaemonSet's ACL agent token.
+func (f *ConfigFunction) clientACLToken() ([]*yaml.RNode, error) {
+	if f.Data.ClientACLTokenSecretName == "" {
+		return nil, fmt.Errorf("client_acl_token_secret_name is required when acl_bootstrap_job_enabled and client_daemonset_enabled are true.")
+	}
+
+	// Agents in the host network namespace register a node named after
+	// the host, rather than the Pod.
+	rules := "service_prefix \"\" {\n  policy = \"read\"\n}\n"
+	if f.Data.ClientHostNetwork {
+		rules = "node_prefix \"\" {\n  policy = \"write\"\n}\n" + rules
+	}
+
+	tokenCfg, err := f.aclToken(&casiConfig{
+		PatchTarget: yaml.ResourceMeta{
+			Kind: "DaemonSet",
+			ObjectMeta: yaml.ObjectMeta{
+				Name:      f.Name + "-client",
+				Namespace: f.Namespace,
+			},
+		},
+		Sidecar: AgentSidecarOptions{
+			AgentTokenSecretName: f.Data.ClientACLTokenSecretName,
+			ACLTokenRules:        rules,
+		},
+		ConfigFunction: f,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return cfunc.ParseTemplates(aclTokenTemplates(), tokenCfg)
+}
+
+func clientTemplates() map[string]string {
+	return map[string]string{
+		"client-cm": clientCMTemplate,
+		"client-ds": clientDSTemplate,
+	}
+}
+
+var clientCMTemplate = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .Name }}-{{ .Namespace }}-client
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+data:
+  00-client-defaults.hcl: |-
+    ports = {
+      grpc = 8502
+    }
+{{- if .Data.TLSGeneratorJobEnabled }}
+    cert_file = "/consul/tls/dc1-client-consul-0.pem"
+    key_file = "/consul/tls/dc1-client-consul-0-key.pem"
+{{- end }}
+`
+
+var clientDSTemplate = `apiVersion: apps/v1
+kind: DaemonSet
+metadata:
+  name: {{ .Name }}-client
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+spec:
+  updateStrategy:
+    type: RollingUpdate
+  selector:
+    matchLabels:
+      app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+      app.kubernetes.io/component: client
+  template:
+    metadata:
+      # Server Services select the app.kubernetes.io/name label, so it is
+      # left off of client Pods.
+      labels:
+        app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+        app.kubernetes.io/component: client
+    spec:
+      securityContext:
+        fsGroup: 1000
+{{- if .Data.ClientHostNetwork }}
+      hostNetwork: true
+      dnsPolicy: ClusterFirstWithHostNet
+{{- end }}
+      containers:
+        - name: consul
+          image: docker.io/library/consul:1.7.2
+          command:
+            - consul
+            - agent
+            - -advertise=$(POD_IP)
+            - -bind=0.0.0.0
+{{- if .Data.ClientHostNetwork }}
+            # Only listen on the node's cluster IP, rather than every host
+            # interface.
+            - -client=127.0.0.1 $(HOST_IP)
+{{- else }}
+            - -client=0.0.0.0
+{{- end }}
+            - -config-dir=/consul/config
+            - -retry-join={{ .Name }}-server.$(NAMESPACE).svc.cluster.local
+{{- if .Data.ACLBootstrapJobEnabled }}
+            - '-hcl=acl { tokens { agent = "$(CONSUL_HTTP_TOKEN)" } }'
+{{- end }}
+          env:
+            - name: HOST_IP
+              valueFrom:
+                fieldRef:
+                  fieldPath: status.hostIP
+            - name: POD_IP
+              valueFrom:
+                fieldRef:
+                  fieldPath: status.podIP
+            - name: NAMESPACE
+              valueFrom:
+                fieldRef:
+                  fieldPath: metadata.namespace
+{{- if .Data.ACLBootstrapJobEnabled }}
+            - name: CONSUL_HTTP_TOKEN
+              valueFrom:
+                secretKeyRef:
+                  name: {{ .Data.ClientACLTokenSecretName }}
+                  key: secret_id.txt
+{{- end }}
+{{- if .Data.TLSGeneratorJobEnabled }}
+            - name: CONSUL_HTTP_ADDR
+              value: https://127.0.0.1:8500
+            - name: CONSUL_CACERT
+              value: /consul/tls/consul-agent-ca.pem
+            - name: CONSUL_CLIENT_CERT
+              value: /consul/tls/dc1-cli-consul-0.pem
+            - name: CONSUL_CLIENT_KEY
+              value: /consul/tls/dc1-cli-consul-0-key.pem
+{{- else }}
+            - name: CONSUL_HTTP_ADDR
+              value: http://127.0.0.1:8500
+{{- end }}
+          volumeMounts:
+            - name: consul-data
+              mountPath: /consul/data
+            - name: consul-configs
+              mountPath: /consul/config
+{{- if .Data.TLSGeneratorJobEnabled }}
+            - name: consul-tls-secret
+              mountPath: /consul/tls
+{{- end }}
+          lifecycle:
+            preStop:
+              exec:
+                command:
+                - /bin/sh
+                - -c
+                - consul leave
+          ports:
+            - containerPort: 8500
+{{- if .Data.ClientHostPortEnabled }}
+              hostPort: 8500
+{{- end }}
+{{- if .Data.TLSGeneratorJobEnabled }}
+              name: https
+{{- else }}
+              name: http
+{{- end }}
+              protocol: "TCP"
+            - containerPort: 8502
+{{- if .Data.ClientHostPortEnabled }}
+              hostPort: 8502
+{{- end }}
+              name: grpc
+              protocol: "TCP"
+            - containerPort: 8301
+              name: serflan-tcp
+              protocol: "TCP"
+            - containerPort: 8301
+              name: serflan-udp
+              protocol: "UDP"
+          readinessProbe:
+            exec:
+              command:
+                - /bin/sh
+                - -ec
+                - |
+                  curl \
+{{- if .Data.TLSGeneratorJobEnabled }}
+                    --cacert $(CONSUL_CACERT) \
+                    --cert $(CONSUL_CLIENT_CERT) \
+                    --key $(CONSUL_CLIENT_KEY) \
+{{- end }}
+                    $(CONSUL_HTTP_ADDR)/v1/status/leader 2>/dev/null |\
+                  grep -E '".+"'
+      volumes:
+        - name: consul-data
+          emptyDir: {}
+        - name: consul-configs
+          projected:
+            sources:
+              - configMap:
+                  name: {{ .Name }}-{{ .Namespace }}-agent
+              - configMap:
+                  name: {{ .Name }}-{{ .Namespace }}-client
+{{- if .Data.GossipKeyGeneratorJobEnabled }}
+              - secret:
+                  name: {{ .Data.GossipSecretName }}
+{{- end }}
+{{- if .Data.TLSGeneratorJobEnabled }}
+        - name: consul-tls-secret
+          projected:
+            sources:
+              - secret:
+                  name: {{ .Data.TLSCASecretName }}
+              - secret:
+                  name: {{ .Data.TLSCLISecretName }}
+              - secret:
+                  name: {{ .Data.TLSClientSecretName }}
+{{- end }}
+`
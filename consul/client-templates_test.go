@@ -0,0 +1,225 @@
+package consul
+
+import (
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+func TestClientACLToken(t *testing.T) {
+	tests := []struct {
+		name        string
+		acl         bool
+		hostNetwork bool
+		client      string
+		nodeRule    string
+	}{
+		{"no acl", false, false, "-client=0.0.0.0", ""},
+		{"acl", true, false, "-client=0.0.0.0", `node_prefix "my-consul-client-"`},
+		{"acl host network", true, true, "-client=127.0.0.1 $(HOST_IP)", `node_prefix ""`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := map[string]string{"client_daemonset_enabled": "true"}
+			if tt.acl {
+				data["acl_bootstrap_job_enabled"] = "true"
+			}
+			if tt.hostNetwork {
+				data["client_host_network"] = "true"
+			}
+			out := runFilter(t, data)
+
+			container := lookup(t, findResource(t, out, "DaemonSet", "my-consul-client"),
+				"spec", "template", "spec", "containers", "[name=consul]")
+			args := []string{}
+			for _, arg := range lookup(t, container, "command").Content() {
+				args = append(args, arg.Value)
+			}
+			if !strings.Contains(strings.Join(args, "\n"), "\n"+tt.client+"\n") {
+				t.Errorf("agent args missing %v:\n%v", tt.client, strings.Join(args, "\n"))
+			}
+
+			tokenArg := strings.Contains(strings.Join(args, "\n"), `-hcl=acl { tokens { agent = "$(CONSUL_HTTP_TOKEN)" } }`)
+			if tokenArg != tt.acl {
+				t.Errorf("agent token arg set %v, want %v", tokenArg, tt.acl)
+			}
+			tokenSecret := value(t, container, "env", "[name=CONSUL_HTTP_TOKEN]", "valueFrom", "secretKeyRef", "name")
+			if !tt.acl {
+				if tokenSecret != "" {
+					t.Error("CONSUL_HTTP_TOKEN set without ACLs")
+				}
+				if lookupResource(t, out, "Role", "my-consul-acl-token-my-consul-client") != nil {
+					t.Error("client ACL token Resources generated without ACLs")
+				}
+				return
+			}
+			if tokenSecret != "my-consul-example-client-acl-token" {
+				t.Errorf("CONSUL_HTTP_TOKEN read from %v, want my-consul-example-client-acl-token", tokenSecret)
+			}
+
+			var job *yaml.RNode
+			for _, r := range out {
+				rMeta, err := r.GetMeta()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if rMeta.Kind == "Job" && strings.HasPrefix(rMeta.Name, "my-consul-acl-token-my-consul-client-") {
+					job = r
+				}
+			}
+			if job == nil {
+				t.Fatal("no client ACL token Job")
+			}
+			podSpec := lookup(t, job, "spec", "template", "spec")
+			policy := value(t, podSpec, "initContainers", "[name=consul-acl-token]", "env", "[name=ACL_TOKEN_RULES]", "value")
+			for _, want := range []string{tt.nodeRule, `service_prefix ""`} {
+				if !strings.Contains(policy, want) {
+					t.Errorf("ACL_TOKEN_RULES missing %v:\n%v", want, policy)
+				}
+			}
+			if got := value(t, podSpec, "containers", "[name=secret-create]", "env", "[name=SECRET_NAME]", "value"); got != "my-consul-example-client-acl-token" {
+				t.Errorf("Job creates Secret %v, want my-consul-example-client-acl-token", got)
+			}
+		})
+	}
+}
+
+func TestClientACLTokenSecretNameRequired(t *testing.T) {
+	data := map[string]string{
+		"client_daemonset_enabled":     "true",
+		"acl_bootstrap_job_enabled":    "true",
+		"client_acl_token_secret_name": "",
+	}
+	if _, err := newFunction(t, data).Filter(nil); err == nil {
+		t.Error("Filter succeeded without client_acl_token_secret_name, want an error")
+	}
+}
+
+func TestNodeLocalAgentPatch(t *testing.T) {
+	workload := func(ns, data string) string {
+		return `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: my-app
+  namespace: ` + ns + `
+  annotations:
+    config.bzub.dev/consul-agent-sidecar-injector: |-
+      metadata:
+        name: my-consul
+        namespace: example
+      data:
+        node_local_agent: "true"
+` + data + `
+spec:
+  template:
+    spec:
+      containers:
+        - name: my-app
+          image: my-app
+        - name: my-proxy
+          image: my-proxy
+`
+	}
+	base := map[string]string{
+		"agent_sidecar_injector_enabled": "true",
+		"client_daemonset_enabled":       "true",
+		"client_host_port_enabled":       "true",
+	}
+	tests := []struct {
+		name      string
+		tls       bool
+		ns        string
+		data      string
+		patched   []string
+		unpatched []string
+		wantErr   string
+	}{
+		{
+			name:    "all containers",
+			ns:      "other",
+			patched: []string{"my-app", "my-proxy"},
+		},
+		{
+			name:      "listed containers",
+			ns:        "other",
+			data:      `        containers: my-app`,
+			patched:   []string{"my-app"},
+			unpatched: []string{"my-proxy"},
+		},
+		{
+			name:      "tls",
+			tls:       true,
+			ns:        "example",
+			data:      `        containers: my-app`,
+			patched:   []string{"my-app"},
+			unpatched: []string{"my-proxy"},
+		},
+		{
+			name:    "tls without containers",
+			tls:     true,
+			ns:      "example",
+			wantErr: "node_local_agent with tls_generator_job_enabled requires containers to be set for Deployment my-app.",
+		},
+		{
+			name:    "tls in other namespace",
+			tls:     true,
+			ns:      "other",
+			data:    `        containers: my-app`,
+			wantErr: "node_local_agent with tls_generator_job_enabled requires Deployment my-app to be in the example namespace.",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := map[string]string{}
+			for k, v := range base {
+				data[k] = v
+			}
+			if tt.tls {
+				data["tls_generator_job_enabled"] = "true"
+			}
+
+			if tt.wantErr != "" {
+				in, err := yaml.Parse(workload(tt.ns, tt.data))
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = newFunction(t, data).Filter([]*yaml.RNode{in})
+				if err == nil || err.Error() != tt.wantErr {
+					t.Errorf("got error %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+
+			var deployment *yaml.RNode
+			for _, r := range runFilter(t, data, workload(tt.ns, tt.data)) {
+				rMeta, err := r.GetMeta()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if rMeta.Kind == "Deployment" && rMeta.Name == "my-app" && rMeta.Namespace == tt.ns {
+					deployment = r
+				}
+			}
+			if deployment == nil {
+				t.Fatal("Deployment my-app not found")
+			}
+			podSpec := lookup(t, deployment, "spec", "template", "spec")
+			for _, name := range tt.patched {
+				c := lookup(t, podSpec, "containers", "[name="+name+"]")
+				if value(t, c, "env", "[name=CONSUL_HTTP_ADDR]", "value") == "" {
+					t.Errorf("%v is not pointed at the node-local agent", name)
+				}
+				if got := lookup(t, c, "volumeMounts", "[name=consul-tls-secret]") != nil; got != tt.tls {
+					t.Errorf("%v mounts the CLI certificates %v, want %v", name, got, tt.tls)
+				}
+			}
+			for _, name := range tt.unpatched {
+				c := lookup(t, podSpec, "containers", "[name="+name+"]")
+				if lookup(t, c, "env") != nil || lookup(t, c, "volumeMounts") != nil {
+					t.Errorf("%v was patched:\n%v", name, c.MustString())
+				}
+			}
+		})
+	}
+}
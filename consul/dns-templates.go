@@ -0,0 +1,146 @@
+package consul
+
+import (
+	"fmt"
+	"strings"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// corednsStubDomain adds a server block forwarding the consul domain to the
+// server DNS Service to the Corefile of the CoreDNS ConfigMap in the input.
+// Only the server block is managed, the rest of the Corefile is left as is.
+// When CoreDNSStubDomainEnabled is unset, a server block from a previous run
+// is removed.
+func (f *ConfigFunction) corednsStubDomain(in []*yaml.RNode) error {
+	clusterIP := ""
+	if f.Data.CoreDNSStubDomainEnabled {
+		var err error
+		clusterIP, err = f.dnsClusterIP(in)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, r := range in {
+		rMeta, err := r.GetMeta()
+		if err != nil {
+			return err
+		}
+
+		if rMeta.Kind != "ConfigMap" ||
+			rMeta.Name != f.Data.CoreDNSConfigMapName ||
+			rMeta.Namespace != f.Data.CoreDNSConfigMapNamespace {
+			continue
+		}
+
+		corefile, err := r.Pipe(yaml.Lookup("data", "Corefile"))
+		if err != nil {
+			return err
+		}
+		if corefile == nil {
+			if !f.Data.CoreDNSStubDomainEnabled {
+				return nil
+			}
+			return fmt.Errorf("ConfigMap %v/%v is missing data.Corefile.", rMeta.Namespace, rMeta.Name)
+		}
+
+		// Update the Corefile of the existing ConfigMap.
+		value, err := f.corefileWithStubDomain(corefile.Document().Value, clusterIP)
+		if err != nil {
+			return fmt.Errorf("ConfigMap %v/%v: %v", rMeta.Namespace, rMeta.Name, err)
+		}
+		if value == corefile.Document().Value {
+			return nil
+		}
+		node := yaml.NewScalarRNode(value)
+		node.YNode().Style = yaml.LiteralStyle
+		return r.PipeE(yaml.Lookup("data"), yaml.SetField("Corefile", node))
+	}
+
+	if !f.Data.CoreDNSStubDomainEnabled {
+		return nil
+	}
+
+	// The cluster Corefile is not known, so it is never generated.
+	return fmt.Errorf("coredns_stub_domain_enabled requires ConfigMap %v/%v in the input.", f.Data.CoreDNSConfigMapNamespace, f.Data.CoreDNSConfigMapName)
+}
+
+// dnsClusterIP returns DNSClusterIP, or the ClusterIP of the server DNS
+// Service in the input.
+func (f *ConfigFunction) dnsClusterIP(in []*yaml.RNode) (string, error) {
+	if f.Data.DNSClusterIP != "" {
+		return f.Data.DNSClusterIP, nil
+	}
+
+	for _, r := range in {
+		rMeta, err := r.GetMeta()
+		if err != nil {
+			return "", err
+		}
+
+		if rMeta.Kind != "Service" ||
+			rMeta.Name != f.Name+"-server-dns" ||
+			rMeta.Namespace != f.Namespace {
+			continue
+		}
+
+		clusterIP, err := r.Pipe(yaml.Lookup("spec", "clusterIP"))
+		if err != nil {
+			return "", err
+		}
+		if clusterIP != nil && clusterIP.Document().Value != "" {
+			return clusterIP.Document().Value, nil
+		}
+	}
+
+	return "", fmt.Errorf("coredns_stub_domain_enabled requires dns_cluster_ip, or the ClusterIP of Service %v/%v-server-dns in the input.", f.Namespace, f.Name)
+}
+
+// corefileWithStubDomain replaces or appends the server block for this Consul
+// instance in a Corefile. An empty clusterIP removes the server block.
+func (f *ConfigFunction) corefileWithStubDomain(corefile, clusterIP string) (string, error) {
+	begin := fmt.Sprintf("# BEGIN consul %v/%v", f.Namespace, f.Name)
+	end := fmt.Sprintf("# END consul %v/%v", f.Namespace, f.Name)
+
+	// Remove the server block from a previous run. Markers are matched by
+	// whole lines, so other instances' blocks are left alone.
+	lines := []string{}
+	inBlock, found := false, false
+	for _, line := range strings.Split(strings.TrimRight(corefile, "\n"), "\n") {
+		switch {
+		case line == begin && !inBlock:
+			inBlock, found = true, true
+		case line == begin, line == end && !inBlock:
+			return "", fmt.Errorf("Corefile has an unmatched %q line.", line)
+		case line == end:
+			inBlock = false
+		case !inBlock:
+			lines = append(lines, line)
+		}
+	}
+	if inBlock {
+		return "", fmt.Errorf("Corefile has %q without a matching %q line.", begin, end)
+	}
+
+	if clusterIP == "" && !found {
+		return corefile, nil
+	}
+	if clusterIP != "" {
+		lines = append(lines,
+			begin,
+			"consul:53 {",
+			"    errors",
+			"    cache 30",
+			"    forward . "+clusterIP,
+			"}",
+			end,
+		)
+	}
+
+	out := strings.Join(lines, "\n") + "\n"
+	if strings.TrimSpace(out) == "" {
+		return "", nil
+	}
+	return out, nil
+}
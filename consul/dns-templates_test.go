@@ -0,0 +1,131 @@
+package consul
+
+import (
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const corednsConfigMap = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: coredns
+  namespace: kube-system
+data:
+  Corefile: |
+    .:53 {
+        errors
+        forward . /etc/resolv.conf
+    }
+`
+
+// corefile returns the Corefile of the CoreDNS ConfigMap in rs.
+func corefile(t *testing.T, rs []*yaml.RNode) string {
+	t.Helper()
+	for _, r := range rs {
+		rMeta, err := r.GetMeta()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rMeta.Kind == "ConfigMap" && rMeta.Name == "coredns" && rMeta.Namespace == "kube-system" {
+			return value(t, r, "data", "Corefile")
+		}
+	}
+	t.Fatal("CoreDNS ConfigMap not found")
+	return ""
+}
+
+func TestCoreDNSStubDomain(t *testing.T) {
+	original := value(t, yaml.MustParse(corednsConfigMap), "data", "Corefile")
+	stub := func(ip string) string {
+		return "# BEGIN consul example/my-consul\nconsul:53 {\n    errors\n    cache 30\n    forward . " + ip + "\n}\n# END consul example/my-consul\n"
+	}
+	enabled := func(ip string) map[string]string {
+		return map[string]string{
+			"coredns_stub_domain_enabled": "true",
+			"dns_cluster_ip":              ip,
+		}
+	}
+
+	// Re-runs keep a single server block.
+	in := corednsConfigMap
+	for i := 1; i <= 2; i++ {
+		got := corefile(t, runFilter(t, enabled("10.96.0.53"), in))
+		if want := original + stub("10.96.0.53"); got != want {
+			t.Fatalf("run %v: Corefile:\n%v\nwant:\n%v", i, got, want)
+		}
+		in = "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: coredns\n  namespace: kube-system\ndata:\n  Corefile: |\n" + indent(got)
+	}
+
+	// A new ClusterIP replaces the server block.
+	if got, want := corefile(t, runFilter(t, enabled("10.96.0.54"), in)), original+stub("10.96.0.54"); got != want {
+		t.Errorf("Corefile after changing the ClusterIP:\n%v\nwant:\n%v", got, want)
+	}
+
+	// Disabling the option removes the server block.
+	if got := corefile(t, runFilter(t, map[string]string{}, in)); got != original {
+		t.Errorf("Corefile after disabling:\n%v\nwant:\n%v", got, original)
+	}
+
+	// A Corefile without a server block is left as is when disabled.
+	if got := corefile(t, runFilter(t, map[string]string{}, corednsConfigMap)); got != original {
+		t.Errorf("Corefile changed while disabled:\n%v", got)
+	}
+}
+
+func TestCoreDNSStubDomainBlocks(t *testing.T) {
+	other := "# BEGIN consul example/my-consul-2\nconsul:53 {\n    forward . 10.96.0.99\n}\n# END consul example/my-consul-2\n"
+	tests := []struct {
+		name     string
+		corefile string
+		ip       string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "other instance kept",
+			corefile: ".:53 {\n}\n" + other,
+			ip:       "",
+			want:     ".:53 {\n}\n" + other,
+		},
+		{
+			name:     "other instance kept on removal",
+			corefile: ".:53 {\n}\n# BEGIN consul example/my-consul\nconsul:53 {\n}\n# END consul example/my-consul\n" + other,
+			ip:       "",
+			want:     ".:53 {\n}\n" + other,
+		},
+		{
+			name:     "missing end",
+			corefile: ".:53 {\n}\n# BEGIN consul example/my-consul\nconsul:53 {\n}\n",
+			ip:       "10.96.0.53",
+			wantErr:  true,
+		},
+		{
+			name:     "missing begin",
+			corefile: ".:53 {\n}\n# END consul example/my-consul\n",
+			ip:       "",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &ConfigFunction{}
+			f.Name, f.Namespace = "my-consul", "example"
+			got, err := f.corefileWithStubDomain(tt.corefile, tt.ip)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("Corefile:\n%v\nwant:\n%v", got, tt.want)
+			}
+		})
+	}
+}
+
+// indent indents every line of s by four spaces, for a block scalar in a
+// ConfigMap's data.
+func indent(s string) string {
+	lines := strings.Split(strings.TrimRight(s, "\n"), "\n")
+	return "    " + strings.Join(lines, "\n    ") + "\n"
+}
@@ -1,6 +1,12 @@
 package consul
 
 import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/bzub/config-functions/cfunc"
 	"sigs.k8s.io/kustomize/kyaml/yaml"
 )
@@ -19,11 +25,55 @@ data:
   acl_bootstrap_job_enabled: "{{ .Data.ACLBootstrapJobEnabled }}"
   agent_sidecar_injector_enabled: "{{ .Data.AgentSidecarInjectorEnabled }}"
   backup_cron_job_enabled: "{{ .Data.BackupCronJobEnabled }}"
+  client_daemonset_enabled: "{{ .Data.ClientDaemonSetEnabled }}"
+  coredns_stub_domain_enabled: "{{ .Data.CoreDNSStubDomainEnabled }}"
+  coredns_configmap_name: "{{ .Data.CoreDNSConfigMapName }}"
+  coredns_configmap_namespace: "{{ .Data.CoreDNSConfigMapNamespace }}"
+  dns_cluster_ip: "{{ .Data.DNSClusterIP }}"
+  client_host_network: "{{ .Data.ClientHostNetwork }}"
+  client_host_port_enabled: "{{ .Data.ClientHostPortEnabled }}"
   backup_secret_name: "{{ .Data.BackupSecretName }}"
-  restore_secret_name: "{{ .Data.RestoreSecretName }}"
+  backup_schedule: "{{ .Data.BackupSchedule }}"
+  backup_successful_jobs_history_limit: "{{ .Data.BackupSuccessfulJobsHistoryLimit }}"
+  backup_failed_jobs_history_limit: "{{ .Data.BackupFailedJobsHistoryLimit }}"
+  backup_concurrency_policy: "{{ .Data.BackupConcurrencyPolicy }}"
+  backup_starting_deadline_seconds: "{{ .Data.BackupStartingDeadlineSeconds }}"
+  backup_s3_endpoint: "{{ .Data.BackupS3Endpoint }}"
+  backup_s3_bucket: "{{ .Data.BackupS3Bucket }}"
+  backup_s3_secret_name: "{{ .Data.BackupS3SecretName }}"
+  backup_s3_ca_secret_name: "{{ .Data.BackupS3CASecretName }}"
+  backup_retention_count: "{{ .Data.BackupRetentionCount }}"
+  kv_seed_job_enabled: "{{ .Data.KVSeedJobEnabled }}"
+  kv_prefix: "{{ .Data.KVPrefix }}"
+  kv_prune_enabled: "{{ .Data.KVPruneEnabled }}"
+  restore_from: "{{ .Data.RestoreFrom }}"
+  log_level: "{{ .Data.LogLevel }}"
+  ui_enabled: "{{ .Data.UIEnabled }}"
+  ui_ingress_host: "{{ .Data.UIIngressHost }}"
+  ui_ingress_class: "{{ .Data.UIIngressClass }}"
+  ui_ingress_tls_secret_name: "{{ .Data.UIIngressTLSSecretName }}"
+  raft_multiplier: "{{ .Data.RaftMultiplier }}"
+  autopilot_cleanup_dead_servers: "{{ .Data.AutopilotCleanupDeadServers }}"
+  autopilot_last_contact_threshold: "{{ .Data.AutopilotLastContactThreshold }}"
+  autopilot_server_stabilization_time: "{{ .Data.AutopilotServerStabilizationTime }}"
+  telemetry_statsd_address: "{{ .Data.TelemetryStatsdAddress }}"
+  telemetry_dogstatsd_address: "{{ .Data.TelemetryDogstatsdAddress }}"
+  telemetry_disable_hostname: "{{ .Data.TelemetryDisableHostname }}"
+  prometheus_retention_time: "{{ .Data.PrometheusRetentionTime }}"
+  prometheus_token_secret_name: "{{ .Data.PrometheusTokenSecretName }}"
+  server_extra_hcl: {{ quote .Data.ServerExtraHCL }}
   tls_generator_job_enabled: "{{ .Data.TLSGeneratorJobEnabled }}"
+  tls_rotation_cron_job_enabled: "{{ .Data.TLSRotationCronJobEnabled }}"
+  tls_rotation_schedule: "{{ .Data.TLSRotationSchedule }}"
+  tls_rotation_threshold_days: "{{ .Data.TLSRotationThresholdDays }}"
+  tls_external_ca_secret_name: "{{ .Data.TLSExternalCASecretName }}"
+  tls_external_ca_cert_file: "{{ .Data.TLSExternalCACertFile }}"
+  tls_external_ca_key_file: "{{ .Data.TLSExternalCAKeyFile }}"
+  tls_cfssl_instance: "{{ .Data.TLSCfsslInstance }}"
   gossip_key_generator_job_enabled: "{{ .Data.GossipKeyGeneratorJobEnabled }}"
+  gossip_key_rotation: "{{ .Data.GossipKeyRotation }}"
   acl_bootstrap_secret_name: "{{ .Data.ACLBootstrapSecretName }}"
+  client_acl_token_secret_name: "{{ .Data.ClientACLTokenSecretName }}"
   tls_server_secret_name: "{{ .Data.TLSServerSecretName }}"
   tls_ca_secret_name: "{{ .Data.TLSCASecretName }}"
   tls_cli_secret_name: "{{ .Data.TLSCLISecretName }}"
@@ -38,6 +88,21 @@ type ConfigFunction struct {
 
 	// Data contains various options specific to this config function.
 	Data Options
+
+	// SidecarWorkloads are the workloads with an injected agent sidecar.
+	// The TLS rotation CronJob restarts them so their agents load the new
+	// certificates.
+	SidecarWorkloads []yaml.ResourceMeta `yaml:"-"`
+
+	// SidecarNamespaces are the namespaces other than the Consul namespace
+	// of SidecarWorkloads. The TLS rotation CronJob updates the copies of
+	// the agent certificate Secrets in them.
+	SidecarNamespaces []string `yaml:"-"`
+
+	// RestoreComplete is set when the input contains a succeeded restore
+	// snapshot Job. The restore Jobs are not generated again while the Job
+	// is part of the package.
+	RestoreComplete bool `yaml:"-"`
 }
 
 // Options holds settings used in the config function.
@@ -57,6 +122,45 @@ type Options struct {
 	// https://www.consul.io/docs/agent/basics.html
 	AgentSidecarInjectorEnabled bool `yaml:"agent_sidecar_injector_enabled"`
 
+	// ClientDaemonSetEnabled adds a DaemonSet running a Consul client agent
+	// on every node. Workloads can use the node-local agent instead of a
+	// sidecar agent via the `node_local_agent` injector option.
+	//
+	// https://www.consul.io/docs/agent/basics.html
+	ClientDaemonSetEnabled bool `yaml:"client_daemonset_enabled"`
+
+	// ClientHostNetwork runs the client agent DaemonSet Pods in the host's
+	// network namespace. The agent API only listens on loopback and the
+	// node's IP.
+	ClientHostNetwork bool `yaml:"client_host_network"`
+
+	// ClientHostPortEnabled exposes the client agent's HTTP(S) and gRPC
+	// ports on each node's IP via hostPorts. The ports are forwarded from
+	// every node address, so restrict access to them with a firewall.
+	ClientHostPortEnabled bool `yaml:"client_host_port_enabled"`
+
+	// CoreDNSStubDomainEnabled configures CoreDNS to forward queries for
+	// the `consul` domain to the server DNS Service. If the CoreDNS
+	// ConfigMap is part of the input, a server block is added to its
+	// Corefile. The CoreDNS ConfigMap must be part of the input, it is
+	// never generated. The server block is enclosed in BEGIN/END comment
+	// lines naming this Consul instance, and only those lines are managed.
+	// Disabling the option removes the server block on the next run.
+	//
+	// https://www.consul.io/docs/platform/k8s/dns.html
+	CoreDNSStubDomainEnabled bool `yaml:"coredns_stub_domain_enabled"`
+
+	// CoreDNSConfigMapName is the name of the CoreDNS ConfigMap.
+	CoreDNSConfigMapName string `yaml:"coredns_configmap_name"`
+
+	// CoreDNSConfigMapNamespace is the namespace of the CoreDNS ConfigMap.
+	CoreDNSConfigMapNamespace string `yaml:"coredns_configmap_namespace"`
+
+	// DNSClusterIP sets the ClusterIP of the server DNS Service. CoreDNS
+	// only forwards to IP addresses, so when it is empty the ClusterIP of
+	// the server DNS Service in the input is used for the stub domain.
+	DNSClusterIP string `yaml:"dns_cluster_ip"`
+
 	// BackupCronJobEnabled adds a CronJob that runs `consul snapshot save`
 	// on the cluster periodically.
 	//
@@ -69,23 +173,238 @@ type Options struct {
 	// https://learn.hashicorp.com/consul/security-networking/certificates
 	TLSGeneratorJobEnabled bool `yaml:"tls_generator_job_enabled"`
 
+	// TLSRotationCronJobEnabled adds a CronJob that re-issues the server,
+	// CLI and client certificates from the generated CA when any of them
+	// expire within TLSRotationThresholdDays. The Secrets are updated and
+	// the Consul servers are restarted. Requires TLSGeneratorJobEnabled.
+	TLSRotationCronJobEnabled bool `yaml:"tls_rotation_cron_job_enabled"`
+
+	// TLSRotationSchedule is the Cron schedule of the TLS rotation CronJob.
+	// It is validated like BackupSchedule when TLSRotationCronJobEnabled.
+	TLSRotationSchedule string `yaml:"tls_rotation_schedule"`
+
+	// TLSRotationThresholdDays is the number of days before expiry at which
+	// certificates are re-issued.
+	TLSRotationThresholdDays int `yaml:"tls_rotation_threshold_days"`
+
+	// TLSExternalCASecretName is the name of an existing Secret holding a
+	// CA certificate and key, such as an intermediate of an organization's
+	// CA. When set, the TLS generator Job signs certificates with it instead
+	// of creating a new CA. The CA key is not copied to other Secrets.
+	TLSExternalCASecretName string `yaml:"tls_external_ca_secret_name"`
+
+	// TLSExternalCACertFile is the key of the CA certificate in the
+	// external CA Secret. It may contain the CA chain, starting with the
+	// signing CA.
+	TLSExternalCACertFile string `yaml:"tls_external_ca_cert_file"`
+
+	// TLSExternalCAKeyFile is the key of the CA private key in the external
+	// CA Secret.
+	TLSExternalCAKeyFile string `yaml:"tls_external_ca_key_file"`
+
+	// TLSCfsslInstance is the metadata.name of a cfssl config function
+	// instance in the same namespace. Its CA Secret is used as the external
+	// CA. Mutually exclusive with TLSExternalCASecretName.
+	TLSCfsslInstance string `yaml:"tls_cfssl_instance"`
+
+	// TLSCASourceSecretName is the name of the Secret the TLS generator Job
+	// signs certificates with. It is resolved from TLSExternalCASecretName
+	// or TLSCfsslInstance, and is empty when the Job creates its own CA.
+	TLSCASourceSecretName string `yaml:"-"`
+
 	// GossipKeyGeneratorJobEnabled creates a Job which generates a Consul
 	// gossip encryption key Secret.
 	//
 	// https://learn.hashicorp.com/consul/security-networking/agent-encryption
 	GossipKeyGeneratorJobEnabled bool `yaml:"gossip_key_generator_job_enabled"`
 
+	// GossipKeyRotation is a counter which, when greater than zero, creates
+	// a Job that rotates the gossip encryption key. The Job installs a new
+	// key, makes it the primary key, removes the old key and updates the
+	// gossip Secret. Incrementing the counter triggers another rotation.
+	//
+	// https://www.consul.io/docs/commands/keyring.html
+	GossipKeyRotation int `yaml:"gossip_key_rotation"`
+
 	// ACLBootstrapSecretName is the name of the Secret used to hold Consul
 	// cluster ACL bootstrap information.
 	ACLBootstrapSecretName string `yaml:"acl_bootstrap_secret_name"`
 
+	// ClientACLTokenSecretName is the name of the Secret holding the client
+	// agent DaemonSet's ACL agent token. When ACLBootstrapJobEnabled and
+	// ClientDaemonSetEnabled are set, a Job creates the token and Secret.
+	ClientACLTokenSecretName string `yaml:"client_acl_token_secret_name"`
+
 	// BackupSecretName is the name of the Secret used to hold a backup of
 	// the Consul k8s secrets and database.
 	BackupSecretName string `json:"backup_secret_name"`
 
-	// RestoreSecretName is the name of the Secret that restore Jobs will
-	// look for to restore from backups.
-	RestoreSecretName string `json:"restore_secret_name"`
+	// BackupSchedule is the Cron schedule of the backup CronJob. It is
+	// validated when the function runs with BackupCronJobEnabled, and may
+	// also be an `@every <duration>` interval.
+	//
+	// https://kubernetes.io/docs/concepts/workloads/controllers/cron-jobs/#cron-schedule-syntax
+	BackupSchedule string `yaml:"backup_schedule"`
+
+	// BackupSuccessfulJobsHistoryLimit is the number of successful backup
+	// Jobs to keep.
+	BackupSuccessfulJobsHistoryLimit int `yaml:"backup_successful_jobs_history_limit"`
+
+	// BackupFailedJobsHistoryLimit is the number of failed backup Jobs to
+	// keep.
+	BackupFailedJobsHistoryLimit int `yaml:"backup_failed_jobs_history_limit"`
+
+	// BackupConcurrencyPolicy specifies how concurrent backup Jobs are
+	// treated. Valid values are `Allow`, `Forbid` and `Replace`.
+	//
+	// https://kubernetes.io/docs/tasks/job/automated-tasks-with-cron-jobs/#concurrency-policy
+	BackupConcurrencyPolicy string `yaml:"backup_concurrency_policy"`
+
+	// BackupStartingDeadlineSeconds is the deadline in seconds for starting
+	// a backup Job that missed its scheduled time. Zero means no deadline.
+	BackupStartingDeadlineSeconds int `yaml:"backup_starting_deadline_seconds"`
+
+	// BackupS3Endpoint is the URL of an S3-compatible object storage
+	// service, such as `https://minio.example.svc:9000`. When it is set
+	// along with BackupS3Bucket, backup bundles are uploaded there instead
+	// of being stored in the backup Secret.
+	BackupS3Endpoint string `yaml:"backup_s3_endpoint"`
+
+	// BackupS3Bucket is the object storage bucket backup bundles are
+	// uploaded to.
+	BackupS3Bucket string `yaml:"backup_s3_bucket"`
+
+	// BackupS3SecretName is the name of the Secret holding object storage
+	// credentials in `AWS_ACCESS_KEY_ID` and `AWS_SECRET_ACCESS_KEY` keys.
+	BackupS3SecretName string `yaml:"backup_s3_secret_name"`
+
+	// BackupS3CASecretName is the name of a Secret holding a PEM encoded
+	// CA certificate under the `ca.crt` key. When set, only this CA is
+	// trusted for an HTTPS BackupS3Endpoint, for example an in-cluster
+	// service with a private CA. Otherwise the endpoint must use a
+	// publicly trusted certificate.
+	BackupS3CASecretName string `yaml:"backup_s3_ca_secret_name"`
+
+	// BackupRetentionCount is the number of backup bundles kept in object
+	// storage. Older bundles are pruned after each backup. Zero keeps all
+	// bundles.
+	BackupRetentionCount int `yaml:"backup_retention_count"`
+
+	// KVSeedJobEnabled creates a Job which imports KV data from
+	// ConfigMaps that contain the `config.bzub.dev/consul-kv` annotation
+	// with a value that targets this Consul instance. A new Job is created
+	// whenever the KV data changes.
+	//
+	// https://www.consul.io/docs/commands/kv/import.html
+	KVSeedJobEnabled bool `yaml:"kv_seed_job_enabled"`
+
+	// KVPrefix is a KV path all seeded keys are placed under.
+	KVPrefix string `yaml:"kv_prefix"`
+
+	// KVPruneEnabled deletes keys under KVPrefix that are not part of the
+	// seeded KV data. Requires KVPrefix.
+	KVPruneEnabled bool `yaml:"kv_prune_enabled"`
+
+	// RestoreFrom is the name of a Secret containing a backup bundle to
+	// restore from. When it is set, Jobs are created which restore the
+	// bundled Secrets, wait for a Consul leader, bootstrap ACLs when
+	// ACLBootstrapJobEnabled is set and restore the snapshot, in that
+	// order.
+	//
+	// Once the input contains the restore snapshot Job with a succeeded
+	// status, the other restore Jobs are removed and none are generated.
+	// The succeeded Job is kept as a record of the restore until
+	// RestoreFrom is unset, which removes it.
+	RestoreFrom string `yaml:"restore_from"`
+
+	// RestoreSecretName was the name of the Secret the suspended restore
+	// CronJobs of older versions restored from. Function configs written by
+	// those versions contain its default value, which is ignored. Any other
+	// value is an error.
+	//
+	// Deprecated: use RestoreFrom.
+	RestoreSecretName string `yaml:"restore_secret_name"`
+
+	// LogLevel is the log level of the Consul servers. One of TRACE, DEBUG,
+	// INFO, WARN or ERR.
+	//
+	// https://www.consul.io/docs/agent/options.html#_log_level
+	LogLevel string `yaml:"log_level"`
+
+	// UIEnabled serves the web UI from the Consul servers, and creates the
+	// server UI Service.
+	UIEnabled bool `yaml:"ui_enabled"`
+
+	// UIIngressHost is the host of an Ingress for the server UI Service. No
+	// Ingress is created when it is empty.
+	UIIngressHost string `yaml:"ui_ingress_host"`
+
+	// UIIngressClass is the `kubernetes.io/ingress.class` of the UI Ingress.
+	UIIngressClass string `yaml:"ui_ingress_class"`
+
+	// UIIngressTLSSecretName is the name of a Secret with a certificate for
+	// UIIngressHost. The UI Ingress terminates TLS when it is set.
+	UIIngressTLSSecretName string `yaml:"ui_ingress_tls_secret_name"`
+
+	// RaftMultiplier scales Raft timing parameters. Zero uses the Consul
+	// default.
+	//
+	// https://www.consul.io/docs/install/performance.html
+	RaftMultiplier int `yaml:"raft_multiplier"`
+
+	// AutopilotCleanupDeadServers enables the automatic removal of dead
+	// servers when a new server joins.
+	//
+	// https://www.consul.io/docs/guides/autopilot.html
+	AutopilotCleanupDeadServers bool `yaml:"autopilot_cleanup_dead_servers"`
+
+	// AutopilotLastContactThreshold is the maximum time a server can go
+	// without contact from the leader before it is considered unhealthy,
+	// e.g. "200ms". Empty uses the Consul default.
+	AutopilotLastContactThreshold string `yaml:"autopilot_last_contact_threshold"`
+
+	// AutopilotServerStabilizationTime is the time a server must be stable
+	// before it is promoted to a voter, e.g. "10s". Empty uses the Consul
+	// default.
+	AutopilotServerStabilizationTime string `yaml:"autopilot_server_stabilization_time"`
+
+	// TelemetryStatsdAddress is a statsd server address metrics are sent
+	// to.
+	//
+	// https://www.consul.io/docs/agent/options.html#telemetry
+	TelemetryStatsdAddress string `yaml:"telemetry_statsd_address"`
+
+	// TelemetryDogstatsdAddress is a DogStatsD server address metrics are
+	// sent to.
+	TelemetryDogstatsdAddress string `yaml:"telemetry_dogstatsd_address"`
+
+	// TelemetryDisableHostname leaves the hostname out of metric names,
+	// which is recommended when scraping metrics with Prometheus.
+	TelemetryDisableHostname bool `yaml:"telemetry_disable_hostname"`
+
+	// PrometheusRetentionTime enables Prometheus metrics on the
+	// `/v1/agent/metrics` endpoint, retaining them for the given duration,
+	// e.g. "60s". The server Service is annotated with a scrape config for
+	// the prometheus config function when it is set, along with the TLS and
+	// ACL token Secrets Prometheus needs to mount.
+	//
+	// https://www.consul.io/docs/agent/options.html#telemetry-prometheus_retention_time
+	PrometheusRetentionTime string `yaml:"prometheus_retention_time"`
+
+	// PrometheusTokenSecretName is the name of a Secret with an ACL token
+	// allowed to read agent metrics in its `secret_id.txt` key. When set,
+	// Prometheus authenticates with the token.
+	PrometheusTokenSecretName string `yaml:"prometheus_token_secret_name"`
+
+	// ServerExtraHCL is additional server configuration for anything not
+	// covered by other options.
+	//
+	// https://www.consul.io/docs/agent/options.html#configuration_files
+	ServerExtraHCL string `yaml:"server_extra_hcl"`
+
+	// ServerConfigFiles maps file names to indented HCL content for the
+	// server ConfigMap. It is populated from other options.
+	ServerConfigFiles map[string]string `yaml:"-"`
 
 	// TLSServerSecretName is the name of the Secret used to hold Consul
 	// server TLS assets.
@@ -108,6 +427,103 @@ type Options struct {
 	GossipSecretName string `yaml:"gossip_secret_name"`
 }
 
+// AgentSidecarOptions holds per-workload settings for a Consul agent sidecar.
+// They are read from the `data` field of a workload's
+// `config.bzub.dev/consul-agent-sidecar-injector` annotation value.
+type AgentSidecarOptions struct {
+	// Services is HCL containing service definitions registered by the
+	// agent.
+	//
+	// https://www.consul.io/docs/agent/services.html
+	Services string `yaml:"services"`
+
+	// Checks is HCL containing health check definitions registered by the
+	// agent.
+	//
+	// https://www.consul.io/docs/agent/checks.html
+	Checks string `yaml:"checks"`
+
+	// ExtraHCL is additional agent configuration for anything not covered
+	// by other options.
+	//
+	// https://www.consul.io/docs/agent/options.html#configuration_files
+	ExtraHCL string `yaml:"extra_hcl"`
+
+	// AgentTokenSecretName is the name of a Secret in the workload's
+	// namespace containing an ACL token under the `secret_id.txt` key. The
+	// token is used as the agent's ACL token and as CONSUL_HTTP_TOKEN in
+	// the sidecar.
+	//
+	// https://www.consul.io/docs/agent/options.html#acl_tokens_agent
+	AgentTokenSecretName string `yaml:"agent_token_secret_name"`
+
+	// ACLTokenRules is an ACL policy in HCL for the workload. When set, a
+	// Job creates a policy with these rules, plus node write access for
+	// the sidecar agent, and stores a token using it in
+	// AgentTokenSecretName. Requires ACLBootstrapJobEnabled and a workload
+	// in the Consul namespace.
+	//
+	// https://www.consul.io/docs/acl/acl-rules.html
+	ACLTokenRules string `yaml:"acl_token_rules"`
+
+	// CPURequest is the sidecar container's CPU resource request.
+	CPURequest string `yaml:"cpu_request"`
+
+	// CPULimit is the sidecar container's CPU resource limit.
+	CPULimit string `yaml:"cpu_limit"`
+
+	// MemoryRequest is the sidecar container's memory resource request.
+	MemoryRequest string `yaml:"memory_request"`
+
+	// MemoryLimit is the sidecar container's memory resource limit.
+	MemoryLimit string `yaml:"memory_limit"`
+
+	// ConnectEnabled registers ConnectServiceName with a Connect sidecar
+	// proxy, and injects an Envoy proxy container into the workload.
+	//
+	// https://www.consul.io/docs/connect/proxies/envoy.html
+	ConnectEnabled bool `yaml:"connect_enabled"`
+
+	// ConnectServiceName is the name of the service registered for the
+	// workload when ConnectEnabled is true.
+	ConnectServiceName string `yaml:"connect_service_name"`
+
+	// ConnectServicePort is the port the workload's service listens on
+	// when ConnectEnabled is true.
+	ConnectServicePort int `yaml:"connect_service_port"`
+
+	// ConnectUpstreams are the Connect services the workload consumes via
+	// the Envoy proxy. In the annotation they are written as a comma
+	// separated list of `destination_name:local_bind_port` pairs.
+	//
+	// https://www.consul.io/docs/connect/registration/service-registration.html#upstream-configuration-reference
+	ConnectUpstreams []ConnectUpstream `yaml:"connect_upstreams"`
+
+	// NodeLocalAgent configures the workload's containers to use the
+	// client agent DaemonSet on their node instead of injecting a sidecar
+	// agent. Requires ClientDaemonSetEnabled with ClientHostNetwork or
+	// ClientHostPortEnabled.
+	NodeLocalAgent bool `yaml:"node_local_agent"`
+
+	// Containers is a comma separated list of the workload's containers
+	// which are pointed at the node-local agent when NodeLocalAgent is
+	// set. All containers are by default. With TLSGeneratorJobEnabled the
+	// CLI certificates are only mounted into these containers, so the list
+	// is required.
+	Containers []string `yaml:"containers"`
+}
+
+// ConnectUpstream is a Connect service reachable by a workload on a local
+// port.
+type ConnectUpstream struct {
+	// DestinationName is the name of the upstream Connect service.
+	DestinationName string
+
+	// LocalBindPort is the port the Envoy proxy listens on for connections
+	// to the upstream service.
+	LocalBindPort int
+}
+
 // casiConfig holds information used to patch workload Resources with a sidecar
 // continer.
 type casiConfig struct {
@@ -115,6 +531,16 @@ type casiConfig struct {
 	// patched.
 	PatchTarget yaml.ResourceMeta
 
+	// Sidecar contains per-workload options from the injector annotation.
+	Sidecar AgentSidecarOptions
+
+	// AgentConfigFiles maps file names to indented HCL content for the
+	// per-workload agent ConfigMap.
+	AgentConfigFiles map[string]string
+
+	// Containers holds the names of the workload's containers.
+	Containers []string
+
 	// FunctionConfig contains information used to configure the Consul
 	// agent sidecar.
 	*ConfigFunction
@@ -132,6 +558,28 @@ func (f *ConfigFunction) Filter(in []*yaml.RNode) ([]*yaml.RNode, error) {
 		return nil, err
 	}
 
+	// Make sure the schedules of enabled CronJobs are usable.
+	if f.Data.BackupCronJobEnabled {
+		if err := cfunc.ValidateCronSchedule(f.Data.BackupSchedule); err != nil {
+			return nil, fmt.Errorf("invalid backup_schedule: %v", err)
+		}
+	}
+	if f.Data.TLSRotationCronJobEnabled {
+		if err := cfunc.ValidateCronSchedule(f.Data.TLSRotationSchedule); err != nil {
+			return nil, fmt.Errorf("invalid tls_rotation_schedule: %v", err)
+		}
+	}
+
+	// Object storage needs both an endpoint and a bucket.
+	if (f.Data.BackupS3Endpoint == "") != (f.Data.BackupS3Bucket == "") {
+		return nil, fmt.Errorf("backup_s3_endpoint and backup_s3_bucket must be set together.")
+	}
+
+	// Resolve the external CA Secret, which may belong to a cfssl instance.
+	if err := f.syncCfsslCA(in); err != nil {
+		return nil, err
+	}
+
 	// Generate a ConfigMap from the function config.
 	fnConfigMap, err := cfunc.ParseTemplate("function-cm", functionCMTemplate, f)
 	if err != nil {
@@ -148,6 +596,30 @@ func (f *ConfigFunction) Filter(in []*yaml.RNode) ([]*yaml.RNode, error) {
 	}
 	generatedRs = append(generatedRs, serverRs...)
 
+	// Remove UI Resources which are no longer enabled.
+	in, err = f.removeStaleUIResources(in)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Data.UIEnabled {
+		// Generate the server UI Service.
+		uiSvc, err := cfunc.ParseTemplate("server-ui-svc", serverUISvcTemplate, f)
+		if err != nil {
+			return nil, err
+		}
+		generatedRs = append(generatedRs, uiSvc)
+
+		if f.Data.UIIngressHost != "" {
+			// Generate an Ingress for the server UI Service.
+			uiIngress, err := cfunc.ParseTemplate("server-ui-ingress", serverUIIngressTemplate, f)
+			if err != nil {
+				return nil, err
+			}
+			generatedRs = append(generatedRs, uiIngress)
+		}
+	}
+
 	if f.Data.GossipKeyGeneratorJobEnabled {
 		// Generate gossip Resouces from templates.
 		gossipRs, err := cfunc.ParseTemplates(gossipTemplates(), f)
@@ -157,6 +629,21 @@ func (f *ConfigFunction) Filter(in []*yaml.RNode) ([]*yaml.RNode, error) {
 		generatedRs = append(generatedRs, gossipRs...)
 	}
 
+	// Remove gossip key rotation Jobs from previous rotations.
+	in, err = f.removeStaleGossipRotationJobs(in)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Data.GossipKeyGeneratorJobEnabled && f.Data.GossipKeyRotation > 0 {
+		// Generate gossip key rotation Resources from templates.
+		rotationRs, err := cfunc.ParseTemplates(gossipRotationTemplates(), f)
+		if err != nil {
+			return nil, err
+		}
+		generatedRs = append(generatedRs, rotationRs...)
+	}
+
 	if f.Data.TLSGeneratorJobEnabled {
 		// Generate agent TLS Resources from templates.
 		tlsRs, err := cfunc.ParseTemplates(tlsTemplates(), f)
@@ -166,6 +653,35 @@ func (f *ConfigFunction) Filter(in []*yaml.RNode) ([]*yaml.RNode, error) {
 		generatedRs = append(generatedRs, tlsRs...)
 	}
 
+	if f.Data.TLSGeneratorJobEnabled && f.Data.TLSRotationCronJobEnabled {
+		// Find the sidecar agents using the rotated certificates.
+		f.SidecarWorkloads, err = f.sidecarWorkloads(in)
+		if err != nil {
+			return nil, err
+		}
+		f.SidecarNamespaces = f.sidecarNamespaces(f.SidecarWorkloads)
+
+		// Generate TLS rotation CronJob Resources from templates.
+		tlsRotationRs, err := cfunc.ParseTemplates(tlsRotationCronJobTemplates(), f)
+		if err != nil {
+			return nil, err
+		}
+		generatedRs = append(generatedRs, tlsRotationRs...)
+
+		// Allow the CronJob to update sidecar workloads in other
+		// namespaces.
+		for _, ns := range f.SidecarNamespaces {
+			rbacRs, err := cfunc.ParseTemplates(tlsRotationTargetTemplates(), &tlsRotationTarget{
+				TargetNamespace: ns,
+				ConfigFunction:  f,
+			})
+			if err != nil {
+				return nil, err
+			}
+			generatedRs = append(generatedRs, rbacRs...)
+		}
+	}
+
 	if f.Data.ACLBootstrapJobEnabled {
 		// Generate ACL bootstrap Resources from templates.
 		aclRs, err := cfunc.ParseTemplates(aclJobTemplates(), f)
@@ -175,6 +691,31 @@ func (f *ConfigFunction) Filter(in []*yaml.RNode) ([]*yaml.RNode, error) {
 		generatedRs = append(generatedRs, aclRs...)
 	}
 
+	// Configure CoreDNS to forward the consul domain, or stop forwarding
+	// it when disabled.
+	if err := f.corednsStubDomain(in); err != nil {
+		return nil, err
+	}
+
+	if f.Data.ClientDaemonSetEnabled {
+		// Generate client agent DaemonSet Resources from templates.
+		clientRs, err := cfunc.ParseTemplates(clientTemplates(), f)
+		if err != nil {
+			return nil, err
+		}
+		generatedRs = append(generatedRs, clientRs...)
+
+		if f.Data.ACLBootstrapJobEnabled {
+			// Generate Resources which create the client agent
+			// ACL token.
+			tokenRs, err := f.clientACLToken()
+			if err != nil {
+				return nil, err
+			}
+			generatedRs = append(generatedRs, tokenRs...)
+		}
+	}
+
 	if f.Data.AgentSidecarInjectorEnabled {
 		// Generate sidecar patch Resources for workloads that call for
 		// them from input.
@@ -185,6 +726,33 @@ func (f *ConfigFunction) Filter(in []*yaml.RNode) ([]*yaml.RNode, error) {
 		generatedRs = append(generatedRs, sidecarRs...)
 	}
 
+	// Remove ACL token Jobs for previous policies.
+	in, err = f.removeStaleACLTokenJobs(in, generatedRs)
+	if err != nil {
+		return nil, err
+	}
+
+	kvSeedHash := ""
+	if f.Data.KVSeedJobEnabled {
+		// Generate KV seeding Resources from annotated ConfigMaps.
+		kvCfg, err := f.kvSeed(in)
+		if err != nil {
+			return nil, err
+		}
+		kvRs, err := cfunc.ParseTemplates(kvSeedTemplates(), kvCfg)
+		if err != nil {
+			return nil, err
+		}
+		generatedRs = append(generatedRs, kvRs...)
+		kvSeedHash = kvCfg.Hash
+	}
+
+	// Remove KV seeding Jobs and ConfigMaps for previous KV data.
+	in, err = f.removeStaleKVSeedResources(in, kvSeedHash)
+	if err != nil {
+		return nil, err
+	}
+
 	if f.Data.BackupCronJobEnabled {
 		// Generate backup CronJob Resources from templates.
 		backupRs, err := cfunc.ParseTemplates(backupCronJobTemplates(), f)
@@ -194,6 +762,39 @@ func (f *ConfigFunction) Filter(in []*yaml.RNode) ([]*yaml.RNode, error) {
 		generatedRs = append(generatedRs, backupRs...)
 	}
 
+	switch {
+	case f.Data.RestoreFrom != "" && f.RestoreComplete:
+		// Keep the succeeded snapshot Job, so the restore is not
+		// performed again over live data.
+		in, err = f.removeRestoreResources(in, f.Name+"-restore-snapshot")
+		if err != nil {
+			return nil, err
+		}
+	case f.Data.RestoreFrom != "":
+		// Generate restore Job Resources from templates.
+		restoreRs, err := cfunc.ParseTemplates(restoreJobTemplates(), f)
+		if err != nil {
+			return nil, err
+		}
+		generatedRs = append(generatedRs, restoreRs...)
+
+		if f.Data.ACLBootstrapJobEnabled {
+			// Bootstrap ACLs on the new cluster for the snapshot
+			// restore.
+			restoreACLJob, err := cfunc.ParseTemplate("restore-acl-bootstrap-job", restoreACLBootstrapJobTemplate, f)
+			if err != nil {
+				return nil, err
+			}
+			generatedRs = append(generatedRs, restoreACLJob)
+		}
+	default:
+		// Remove restore Resources from a previous run.
+		in, err = f.removeRestoreResources(in, "")
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// Return the generated resources + patches + input.
 	return append(generatedRs, in...), nil
 }
@@ -211,14 +812,32 @@ func (f *ConfigFunction) syncData(in []*yaml.RNode) error {
 
 	// Set defaults.
 	f.Data = Options{
-		ACLBootstrapSecretName: fnMeta.Name + "-" + fnMeta.Namespace + "-acl",
-		TLSServerSecretName:    fnMeta.Name + "-" + fnMeta.Namespace + "-tls-server",
-		TLSCASecretName:        fnMeta.Name + "-" + fnMeta.Namespace + "-tls-ca",
-		TLSCLISecretName:       fnMeta.Name + "-" + fnMeta.Namespace + "-tls-cli",
-		TLSClientSecretName:    fnMeta.Name + "-" + fnMeta.Namespace + "-tls-client",
-		GossipSecretName:       fnMeta.Name + "-" + fnMeta.Namespace + "-gossip",
-		BackupSecretName:       fnMeta.Name + "-" + fnMeta.Namespace + "-backup",
-		RestoreSecretName:      fnMeta.Name + "-" + fnMeta.Namespace + "-restore",
+		ACLBootstrapSecretName:   fnMeta.Name + "-" + fnMeta.Namespace + "-acl",
+		ClientACLTokenSecretName: fnMeta.Name + "-" + fnMeta.Namespace + "-client-acl-token",
+		TLSServerSecretName:      fnMeta.Name + "-" + fnMeta.Namespace + "-tls-server",
+		TLSCASecretName:          fnMeta.Name + "-" + fnMeta.Namespace + "-tls-ca",
+		TLSCLISecretName:         fnMeta.Name + "-" + fnMeta.Namespace + "-tls-cli",
+		TLSClientSecretName:      fnMeta.Name + "-" + fnMeta.Namespace + "-tls-client",
+		GossipSecretName:         fnMeta.Name + "-" + fnMeta.Namespace + "-gossip",
+		BackupSecretName:         fnMeta.Name + "-" + fnMeta.Namespace + "-backup",
+		BackupS3SecretName:       fnMeta.Name + "-" + fnMeta.Namespace + "-backup-s3",
+		BackupSchedule:           "0 */1 * * *",
+
+		BackupSuccessfulJobsHistoryLimit: 3,
+		BackupFailedJobsHistoryLimit:     1,
+		BackupConcurrencyPolicy:          "Allow",
+
+		TLSRotationSchedule:      "0 0 * * *",
+		TLSRotationThresholdDays: 30,
+		TLSExternalCACertFile:    "ca.pem",
+		TLSExternalCAKeyFile:     "ca-key.pem",
+
+		CoreDNSConfigMapName:      "coredns",
+		CoreDNSConfigMapNamespace: "kube-system",
+
+		LogLevel:                    "INFO",
+		UIEnabled:                   true,
+		AutopilotCleanupDeadServers: true,
 	}
 
 	// Populate function data from config.
@@ -226,6 +845,24 @@ func (f *ConfigFunction) syncData(in []*yaml.RNode) error {
 		return err
 	}
 
+	// The restore CronJobs were replaced by restore Jobs.
+	if f.Data.RestoreSecretName != "" &&
+		f.Data.RestoreSecretName != fnMeta.Name+"-"+fnMeta.Namespace+"-restore" {
+		return fmt.Errorf("restore_secret_name is no longer supported. Remove it, and set restore_from to %q to restore from that Secret.", f.Data.RestoreSecretName)
+	}
+
+	// A completed restore is not performed again.
+	f.RestoreComplete, err = f.restoreComplete(in)
+	if err != nil {
+		return err
+	}
+
+	// Collect additional server configuration files.
+	f.Data.ServerConfigFiles = map[string]string{}
+	if f.Data.ServerExtraHCL != "" {
+		f.Data.ServerConfigFiles["90-extra.hcl"] = cfunc.Indent(f.Data.ServerExtraHCL, "    ")
+	}
+
 	return nil
 }
 
@@ -248,16 +885,174 @@ func (d *Options) UnmarshalYAML(node *yaml.Node) error {
 			d.AgentSidecarInjectorEnabled = true
 		case key == "backup_cron_job_enabled" && value == "true":
 			d.BackupCronJobEnabled = true
+		case key == "coredns_stub_domain_enabled" && value == "true":
+			d.CoreDNSStubDomainEnabled = true
+		case key == "coredns_configmap_name":
+			d.CoreDNSConfigMapName = value
+		case key == "coredns_configmap_namespace":
+			d.CoreDNSConfigMapNamespace = value
+		case key == "dns_cluster_ip":
+			d.DNSClusterIP = value
+		case key == "client_daemonset_enabled" && value == "true":
+			d.ClientDaemonSetEnabled = true
+		case key == "client_host_network" && value == "true":
+			d.ClientHostNetwork = true
+		case key == "client_host_port_enabled" && value == "true":
+			d.ClientHostPortEnabled = true
 		case key == "tls_generator_job_enabled" && value == "true":
 			d.TLSGeneratorJobEnabled = true
+		case key == "tls_rotation_cron_job_enabled" && value == "true":
+			d.TLSRotationCronJobEnabled = true
+		case key == "tls_rotation_schedule":
+			d.TLSRotationSchedule = value
+		case key == "tls_rotation_threshold_days":
+			days, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid tls_rotation_threshold_days: %v", err)
+			}
+			d.TLSRotationThresholdDays = days
+		case key == "tls_external_ca_secret_name":
+			d.TLSExternalCASecretName = value
+		case key == "tls_external_ca_cert_file":
+			d.TLSExternalCACertFile = value
+		case key == "tls_external_ca_key_file":
+			d.TLSExternalCAKeyFile = value
+		case key == "tls_cfssl_instance":
+			d.TLSCfsslInstance = value
 		case key == "gossip_key_generator_job_enabled" && value == "true":
 			d.GossipKeyGeneratorJobEnabled = true
+		case key == "gossip_key_rotation":
+			rotation, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid gossip_key_rotation: %v", err)
+			}
+			d.GossipKeyRotation = rotation
 		case key == "acl_bootstrap_secret_name":
 			d.ACLBootstrapSecretName = value
+		case key == "client_acl_token_secret_name":
+			d.ClientACLTokenSecretName = value
 		case key == "backup_secret_name":
 			d.BackupSecretName = value
+		case key == "backup_schedule":
+			d.BackupSchedule = value
+		case key == "backup_successful_jobs_history_limit":
+			limit, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid backup_successful_jobs_history_limit: %v", err)
+			}
+			if limit < 0 {
+				return fmt.Errorf("invalid backup_successful_jobs_history_limit %v, must not be negative.", limit)
+			}
+			d.BackupSuccessfulJobsHistoryLimit = limit
+		case key == "backup_failed_jobs_history_limit":
+			limit, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid backup_failed_jobs_history_limit: %v", err)
+			}
+			if limit < 0 {
+				return fmt.Errorf("invalid backup_failed_jobs_history_limit %v, must not be negative.", limit)
+			}
+			d.BackupFailedJobsHistoryLimit = limit
+		case key == "backup_concurrency_policy":
+			switch value {
+			case "Allow", "Forbid", "Replace":
+			default:
+				return fmt.Errorf("invalid backup_concurrency_policy %q, must be one of Allow, Forbid or Replace.", value)
+			}
+			d.BackupConcurrencyPolicy = value
+		case key == "backup_starting_deadline_seconds":
+			seconds, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid backup_starting_deadline_seconds: %v", err)
+			}
+			if seconds < 0 {
+				return fmt.Errorf("invalid backup_starting_deadline_seconds %v, must not be negative.", seconds)
+			}
+			d.BackupStartingDeadlineSeconds = seconds
+		case key == "backup_s3_endpoint":
+			d.BackupS3Endpoint = value
+		case key == "backup_s3_bucket":
+			d.BackupS3Bucket = value
+		case key == "backup_s3_secret_name":
+			d.BackupS3SecretName = value
+		case key == "backup_s3_ca_secret_name":
+			d.BackupS3CASecretName = value
+		case key == "backup_retention_count":
+			count, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid backup_retention_count: %v", err)
+			}
+			if count < 0 {
+				return fmt.Errorf("invalid backup_retention_count %v, must not be negative.", count)
+			}
+			d.BackupRetentionCount = count
+		case key == "kv_seed_job_enabled" && value == "true":
+			d.KVSeedJobEnabled = true
+		case key == "kv_prefix":
+			d.KVPrefix = strings.Trim(value, "/")
+		case key == "kv_prune_enabled" && value == "true":
+			d.KVPruneEnabled = true
+		case key == "restore_from":
+			d.RestoreFrom = value
 		case key == "restore_secret_name":
 			d.RestoreSecretName = value
+		case key == "log_level":
+			switch value {
+			case "TRACE", "DEBUG", "INFO", "WARN", "ERR":
+			default:
+				return fmt.Errorf("invalid log_level %q, must be one of TRACE, DEBUG, INFO, WARN or ERR.", value)
+			}
+			d.LogLevel = value
+		case key == "ui_enabled":
+			d.UIEnabled = value == "true"
+		case key == "ui_ingress_host":
+			d.UIIngressHost = value
+		case key == "ui_ingress_class":
+			d.UIIngressClass = value
+		case key == "ui_ingress_tls_secret_name":
+			d.UIIngressTLSSecretName = value
+		case key == "raft_multiplier":
+			multiplier, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid raft_multiplier: %v", err)
+			}
+			if multiplier < 0 || multiplier > 10 {
+				return fmt.Errorf("invalid raft_multiplier %v, must be between 0 and 10.", multiplier)
+			}
+			d.RaftMultiplier = multiplier
+		case key == "autopilot_cleanup_dead_servers":
+			d.AutopilotCleanupDeadServers = value == "true"
+		case key == "autopilot_last_contact_threshold":
+			if err := parseDuration(key, value); err != nil {
+				return err
+			}
+			d.AutopilotLastContactThreshold = value
+		case key == "autopilot_server_stabilization_time":
+			if err := parseDuration(key, value); err != nil {
+				return err
+			}
+			d.AutopilotServerStabilizationTime = value
+		case key == "telemetry_statsd_address":
+			if err := parseAddress(key, value); err != nil {
+				return err
+			}
+			d.TelemetryStatsdAddress = value
+		case key == "telemetry_dogstatsd_address":
+			if err := parseAddress(key, value); err != nil {
+				return err
+			}
+			d.TelemetryDogstatsdAddress = value
+		case key == "telemetry_disable_hostname" && value == "true":
+			d.TelemetryDisableHostname = true
+		case key == "prometheus_retention_time":
+			if err := parseDuration(key, value); err != nil {
+				return err
+			}
+			d.PrometheusRetentionTime = value
+		case key == "prometheus_token_secret_name":
+			d.PrometheusTokenSecretName = value
+		case key == "server_extra_hcl":
+			d.ServerExtraHCL = value
 		case key == "tls_server_secret_name":
 			d.TLSServerSecretName = value
 		case key == "tls_ca_secret_name":
@@ -275,3 +1070,131 @@ func (d *Options) UnmarshalYAML(node *yaml.Node) error {
 
 	return nil
 }
+
+// UnmarshalYAML implements yaml.Unmarshaler. It ensures all values from
+// the injector annotation's KV data can be converted into relevant Go types.
+func (d *AgentSidecarOptions) UnmarshalYAML(node *yaml.Node) error {
+	var key, value string
+	for i := range node.Content {
+		if key == "" {
+			key = node.Content[i].Value
+			continue
+		}
+		value = node.Content[i].Value
+
+		// Convert KV string values into associated AgentSidecarOptions
+		// types.
+		switch {
+		case key == "services":
+			d.Services = value
+		case key == "checks":
+			d.Checks = value
+		case key == "extra_hcl":
+			d.ExtraHCL = value
+		case key == "agent_token_secret_name":
+			d.AgentTokenSecretName = value
+		case key == "acl_token_rules":
+			d.ACLTokenRules = value
+		case key == "cpu_request":
+			d.CPURequest = value
+		case key == "cpu_limit":
+			d.CPULimit = value
+		case key == "memory_request":
+			d.MemoryRequest = value
+		case key == "memory_limit":
+			d.MemoryLimit = value
+		case key == "connect_enabled" && value == "true":
+			d.ConnectEnabled = true
+		case key == "connect_service_name":
+			d.ConnectServiceName = value
+		case key == "connect_service_port":
+			port, err := strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid connect_service_port: %v", err)
+			}
+			if port < 1 || port > 65535 {
+				return fmt.Errorf("invalid connect_service_port %v, must be between 1 and 65535.", port)
+			}
+			d.ConnectServicePort = port
+		case key == "connect_upstreams":
+			upstreams, err := parseConnectUpstreams(value)
+			if err != nil {
+				return err
+			}
+			d.ConnectUpstreams = upstreams
+		case key == "node_local_agent" && value == "true":
+			d.NodeLocalAgent = true
+		case key == "containers":
+			d.Containers = parseList(value)
+		}
+
+		key = ""
+	}
+
+	return nil
+}
+
+// parseList splits a comma separated list, ignoring empty entries.
+func parseList(value string) []string {
+	names := []string{}
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// parseDuration checks that an option holding a Consul duration, such as
+// "10s", is empty or parses as a Go duration.
+func parseDuration(key, value string) error {
+	if value == "" {
+		return nil
+	}
+	if _, err := time.ParseDuration(value); err != nil {
+		return fmt.Errorf("invalid %v %q, must be a duration such as 10s.", key, value)
+	}
+	return nil
+}
+
+// parseAddress checks that an option holding a metrics sink address is
+// empty or a host:port pair.
+func parseAddress(key, value string) error {
+	if value == "" {
+		return nil
+	}
+	host, port, err := net.SplitHostPort(value)
+	if err != nil || host == "" || port == "" {
+		return fmt.Errorf("invalid %v %q, must be a host:port address.", key, value)
+	}
+	return nil
+}
+
+// parseConnectUpstreams converts a comma separated list of
+// `destination_name:local_bind_port` pairs into ConnectUpstreams.
+func parseConnectUpstreams(value string) ([]ConnectUpstream, error) {
+	upstreams := []ConnectUpstream{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		parts := strings.Split(pair, ":")
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid connect upstream %q, expected destination_name:local_bind_port.", pair)
+		}
+
+		port, err := strconv.Atoi(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid connect upstream %q: %v", pair, err)
+		}
+
+		upstreams = append(upstreams, ConnectUpstream{
+			DestinationName: parts[0],
+			LocalBindPort:   port,
+		})
+	}
+
+	return upstreams, nil
+}
@@ -0,0 +1,99 @@
+package consul
+
+import (
+	"testing"
+
+	"sigs.k8s.io/kustomize/kyaml/kio"
+	"sigs.k8s.io/kustomize/kyaml/kio/filters"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// newFunction returns the function with the given function config data.
+func newFunction(t *testing.T, data map[string]string) *ConfigFunction {
+	t.Helper()
+
+	fnConfig := yaml.MustParse(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: my-consul
+  namespace: example
+data: {}
+`)
+	for key, value := range data {
+		if err := fnConfig.PipeE(yaml.Lookup("data"), yaml.SetField(key, yaml.NewScalarRNode(value))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f := &ConfigFunction{}
+	f.RW = &kio.ByteReadWriter{FunctionConfig: fnConfig}
+	return f
+}
+
+// runFilter runs the function with the given function config data on items,
+// and merges the generated patches like the function's main does.
+func runFilter(t *testing.T, data map[string]string, items ...string) []*yaml.RNode {
+	t.Helper()
+
+	in := []*yaml.RNode{}
+	for _, item := range items {
+		in = append(in, yaml.MustParse(item))
+	}
+
+	out, err := newFunction(t, data).Filter(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = filters.MergeFilter{}.Filter(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// findResource returns the Resource with the given kind and name in the
+// example namespace, failing the test if it is missing.
+func findResource(t *testing.T, rs []*yaml.RNode, kind, name string) *yaml.RNode {
+	t.Helper()
+	if r := lookupResource(t, rs, kind, name); r != nil {
+		return r
+	}
+	t.Fatalf("%v %v not found", kind, name)
+	return nil
+}
+
+// lookupResource returns the Resource with the given kind and name in the
+// example namespace, or nil.
+func lookupResource(t *testing.T, rs []*yaml.RNode, kind, name string) *yaml.RNode {
+	t.Helper()
+	for _, r := range rs {
+		rMeta, err := r.GetMeta()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rMeta.Kind == kind && rMeta.Name == name && rMeta.Namespace == "example" {
+			return r
+		}
+	}
+	return nil
+}
+
+// lookup returns the node at path in r, or nil.
+func lookup(t *testing.T, r *yaml.RNode, path ...string) *yaml.RNode {
+	t.Helper()
+	node, err := r.Pipe(yaml.Lookup(path...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+// value returns the scalar value at path in r, or "" if it is missing.
+func value(t *testing.T, r *yaml.RNode, path ...string) string {
+	t.Helper()
+	node := lookup(t, r, path...)
+	if node == nil {
+		return ""
+	}
+	return node.YNode().Value
+}
@@ -1,5 +1,12 @@
 package consul
 
+import (
+	"fmt"
+	"strings"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
 func gossipTemplates() map[string]string {
 	return map[string]string{
 		"gossip-job":         gossipJobTemplate,
@@ -102,3 +109,217 @@ subjects:
   - kind: ServiceAccount
     name: {{ .Name }}-gossip-encryption
 `
+
+func gossipRotationTemplates() map[string]string {
+	return map[string]string{
+		"gossip-rotation-job":         gossipRotationJobTemplate,
+		"gossip-rotation-sa":          gossipRotationSATemplate,
+		"gossip-rotation-role":        gossipRotationRoleTemplate,
+		"gossip-rotation-rolebinding": gossipRotationRoleBindingTemplate,
+	}
+}
+
+// removeStaleGossipRotationJobs filters out gossip key rotation Jobs other
+// than the one for the current GossipKeyRotation value.
+func (f *ConfigFunction) removeStaleGossipRotationJobs(in []*yaml.RNode) ([]*yaml.RNode, error) {
+	prefix := f.Name + "-gossip-rotation-"
+	current := fmt.Sprintf("%v%v", prefix, f.Data.GossipKeyRotation)
+
+	out := []*yaml.RNode{}
+	for _, r := range in {
+		rMeta, err := r.GetMeta()
+		if err != nil {
+			return nil, err
+		}
+
+		if rMeta.Kind == "Job" &&
+			rMeta.Namespace == f.Namespace &&
+			strings.HasPrefix(rMeta.Name, prefix) &&
+			rMeta.Name != current {
+			continue
+		}
+		out = append(out, r)
+	}
+
+	return out, nil
+}
+
+var gossipRotationJobTemplate = `apiVersion: batch/v1
+kind: Job
+metadata:
+  name: {{ .Name }}-gossip-rotation-{{ .Data.GossipKeyRotation }}
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+spec:
+  template:
+    spec:
+      serviceAccountName: {{ .Name }}-gossip-rotation
+      restartPolicy: OnFailure
+      initContainers:
+        - name: rotate-gossip-encryption-key
+          image: docker.io/library/consul:1.7.2
+          command:
+            - /bin/sh
+            - -ec
+            - |-
+              old_key="$(\
+                grep '^encrypt = ' /config/current/00-gossip-encryption.hcl |\
+                  cut -d '"' -f 2 \
+              )"
+              new_key="$(consul keygen)"
+
+              # Succeeds when every keyring pool lists the key as installed
+              # on all of its members, e.g. "<key> [3/3]".
+              key_on_all_members() {
+                counts="$(consul keyring -list | grep -F "$1" | awk '{print $NF}' | tr -d '[]')"
+                [ -n "${counts}" ] || return 1
+                for count in ${counts}; do
+                  [ "${count%/*}" = "${count#*/}" ] || return 1
+                done
+              }
+
+              wait_for_new_key() {
+                attempts=0
+                until key_on_all_members "${new_key}"; do
+                  attempts=$((attempts + 1))
+                  if [ "${attempts}" -ge 60 ]; then
+                    echo "[ERROR] New gossip encryption key is not installed on all members."
+                    exit 1
+                  fi
+                  echo "[INFO] Waiting for all members to install the new key."
+                  sleep 5
+                done
+              }
+
+              echo "[INFO] Installing new gossip encryption key."
+              consul keyring -install "${new_key}"
+              wait_for_new_key
+
+              echo "[INFO] Switching to the new gossip encryption key."
+              consul keyring -use "${new_key}"
+
+              # Members which joined since the install must have the new key
+              # before the old one is removed.
+              wait_for_new_key
+
+              echo "[INFO] Removing old gossip encryption key."
+              consul keyring -remove "${old_key}"
+
+              config_file=/config/generated/00-gossip-encryption.hcl
+              cat <<EOF > "${config_file}"
+              encrypt = "${new_key}"
+              encrypt_verify_incoming = true
+              encrypt_verify_outgoing = true
+              EOF
+          env:
+            - name: CONSUL_HTTP_TOKEN
+              valueFrom:
+                secretKeyRef:
+                  name: {{ .Data.ACLBootstrapSecretName }}
+                  key: secret_id.txt
+                  optional: true
+{{- if .Data.TLSGeneratorJobEnabled }}
+            - name: CONSUL_HTTP_ADDR
+              value: https://{{ .Name }}-server.{{ .Namespace }}.svc:8500
+            - name: CONSUL_CACERT
+              value: /consul/tls/consul-agent-ca.pem
+            - name: CONSUL_CLIENT_CERT
+              value: /consul/tls/dc1-cli-consul-0.pem
+            - name: CONSUL_CLIENT_KEY
+              value: /consul/tls/dc1-cli-consul-0-key.pem
+{{- else }}
+            - name: CONSUL_HTTP_ADDR
+              value: http://{{ .Name }}-server.{{ .Namespace }}.svc:8500
+{{- end }}
+          volumeMounts:
+            - mountPath: /config/current
+              name: config-current
+            - mountPath: /config/generated
+              name: config-generated
+{{- if .Data.TLSGeneratorJobEnabled }}
+            - mountPath: /consul/tls
+              name: consul-tls-secret
+{{- end }}
+      containers:
+        - name: update-gossip-encryption-config-secret
+          image: k8s.gcr.io/hyperkube:v1.17.4
+          command:
+            - /bin/sh
+            - -ec
+            - |-
+              secret="$(gossip_secret_name)"
+              config_dir="/config/generated"
+              kubectl create secret generic "--from-file=${config_dir}" "${secret}" \
+                --dry-run -o yaml |\
+                kubectl replace -f -
+          envFrom:
+            - configMapRef:
+                name: {{ .Name }}
+          volumeMounts:
+            - mountPath: /config/generated
+              name: config-generated
+      volumes:
+        - name: config-current
+          secret:
+            secretName: {{ .Data.GossipSecretName }}
+        - name: config-generated
+          emptyDir: {}
+{{- if .Data.TLSGeneratorJobEnabled }}
+        - name: consul-tls-secret
+          projected:
+            sources:
+              - secret:
+                  name: {{ .Data.TLSCASecretName }}
+              - secret:
+                  name: {{ .Data.TLSCLISecretName }}
+{{- end }}
+`
+
+var gossipRotationSATemplate = `apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: {{ .Name }}-gossip-rotation
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+`
+
+var gossipRotationRoleTemplate = `apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: {{ .Name }}-gossip-rotation
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+rules:
+  - apiGroups:
+      - ""
+    resources:
+      - secrets
+    verbs:
+      - get
+      - update
+    resourceNames:
+      - {{ .Data.GossipSecretName }}
+`
+
+var gossipRotationRoleBindingTemplate = `apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: {{ .Name }}-gossip-rotation
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: Role
+  name: {{ .Name }}-gossip-rotation
+subjects:
+  - kind: ServiceAccount
+    name: {{ .Name }}-gossip-rotation
+`
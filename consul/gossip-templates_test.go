@@ -0,0 +1,135 @@
+package consul
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeConsul is a `consul` stand-in which logs keyring operations to
+// $CONSUL_LOG. `keyring -list` reports the new key on $INSTALLED_AFTER fewer
+// members than exist until it has been listed that many times.
+const fakeConsul = `#!/bin/sh
+case "$1 $2" in
+  "keygen ") echo "new-key" ;;
+  "keyring -list")
+    lists=$(($(cat "$STATE" 2>/dev/null || echo 0) + 1))
+    echo "${lists}" > "$STATE"
+    echo "keyring -list" >> "$CONSUL_LOG"
+    members=3
+    [ "${lists}" -gt "$INSTALLED_AFTER" ] || members=2
+    printf 'WAN:\n  old-key [3/3]\n  new-key [%s/3]\n\ndc1 (LAN):\n  old-key [3/3]\n  new-key [%s/3]\n' "${members}" "${members}"
+    ;;
+  *) echo "$*" >> "$CONSUL_LOG" ;;
+esac
+`
+
+func TestGossipRotation(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh is not available")
+	}
+
+	data := map[string]string{
+		"gossip_key_generator_job_enabled": "true",
+		"gossip_key_rotation":              "1",
+	}
+	out := runFilter(t, data)
+	command := lookup(t, findResource(t, out, "Job", "my-consul-gossip-rotation-1"),
+		"spec", "template", "spec", "initContainers", "[name=rotate-gossip-encryption-key]", "command")
+	if command == nil {
+		t.Fatal("rotate-gossip-encryption-key has no command")
+	}
+	script := command.Content()[len(command.Content())-1].Value
+
+	tests := []struct {
+		name           string
+		installedAfter string
+		log            []string
+		wantErr        bool
+	}{
+		{
+			"installed",
+			"0",
+			[]string{"keyring -install new-key", "keyring -list", "keyring -use new-key", "keyring -list", "keyring -remove old-key"},
+			false,
+		},
+		{
+			"waits for members",
+			"2",
+			[]string{"keyring -install new-key", "keyring -list", "keyring -list", "keyring -list", "keyring -use new-key", "keyring -list", "keyring -remove old-key"},
+			false,
+		},
+		{
+			"never installed",
+			"100",
+			nil,
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "gossip-rotation")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			if err := ioutil.WriteFile(filepath.Join(dir, "consul"), []byte(fakeConsul), 0755); err != nil {
+				t.Fatal(err)
+			}
+			for _, d := range []string{"config/current", "config/generated"} {
+				if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			current := "encrypt = \"old-key\"\nencrypt_verify_incoming = true\n"
+			if err := ioutil.WriteFile(filepath.Join(dir, "config/current/00-gossip-encryption.hcl"), []byte(current), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			// Run against the temporary directory without waiting.
+			s := strings.ReplaceAll(script, "/config/", dir+"/config/")
+			s = strings.ReplaceAll(s, "sleep 5", "true")
+
+			consulLog := filepath.Join(dir, "consul.log")
+			cmd := exec.Command("sh", "-ec", s)
+			cmd.Env = append(os.Environ(),
+				"PATH="+dir+string(os.PathListSeparator)+os.Getenv("PATH"),
+				"CONSUL_LOG="+consulLog,
+				"STATE="+filepath.Join(dir, "state"),
+				"INSTALLED_AFTER="+tt.installedAfter,
+			)
+			output, err := cmd.CombinedOutput()
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("rotation succeeded, want an error\n%s", output)
+				}
+				if log, _ := ioutil.ReadFile(consulLog); strings.Contains(string(log), "-use") {
+					t.Errorf("switched to a key which is not installed on all members:\n%s", log)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("rotation failed: %v\n%s", err, output)
+			}
+
+			log, err := ioutil.ReadFile(consulLog)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Split(strings.TrimSpace(string(log)), "\n"); strings.Join(got, ",") != strings.Join(tt.log, ",") {
+				t.Errorf("consul calls:\n%v\nwant:\n%v", strings.Join(got, "\n"), strings.Join(tt.log, "\n"))
+			}
+
+			generated, err := ioutil.ReadFile(filepath.Join(dir, "config/generated/00-gossip-encryption.hcl"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(generated), `encrypt = "new-key"`) {
+				t.Errorf("generated config does not use the new key:\n%s", generated)
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+package consul
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const kvAnnotation = "config.bzub.dev/consul-kv"
+
+// kvSeedConfig holds information used to generate KV seeding Resources.
+type kvSeedConfig struct {
+	// KVJSON is the KV data in `consul kv import` format.
+	KVJSON string
+
+	// Keys is a newline separated list of seeded keys.
+	Keys string
+
+	// Hash identifies the KV data. It is part of the Job and ConfigMap
+	// names so changes to the data result in a new Job, which never reads
+	// the data of another Job.
+	Hash string
+
+	// FunctionConfig contains information used to configure the Job.
+	*ConfigFunction
+}
+
+// kvEntry is a KV pair in `consul kv import` format.
+type kvEntry struct {
+	Key   string `json:"key"`
+	Flags int    `json:"flags"`
+	Value string `json:"value"`
+}
+
+// kvSeed collects KV data from annotated ConfigMaps in the input.
+func (f *ConfigFunction) kvSeed(in []*yaml.RNode) (*kvSeedConfig, error) {
+	if f.Data.KVPruneEnabled && f.Data.KVPrefix == "" {
+		return nil, fmt.Errorf("kv_prune_enabled requires kv_prefix.")
+	}
+
+	kv := map[string]string{}
+	for _, r := range in {
+		aValue, err := r.Pipe(yaml.GetAnnotation(kvAnnotation))
+		if err != nil {
+			return nil, err
+		}
+		if aValue == nil {
+			continue
+		}
+
+		rMeta, err := r.GetMeta()
+		if err != nil {
+			return nil, err
+		}
+		if rMeta.Kind != "ConfigMap" {
+			return nil, fmt.Errorf("%v annotation is only supported on ConfigMaps, found %v %v.", kvAnnotation, rMeta.Kind, rMeta.Name)
+		}
+
+		config, err := yaml.Parse(aValue.Document().Value)
+		if err != nil {
+			return nil, err
+		}
+
+		// Determine if the KV config targets this Consul instance.
+		cName, err := config.Pipe(yaml.Lookup("metadata", "name"))
+		switch {
+		case err != nil:
+			return nil, err
+		case cName == nil:
+			return nil, fmt.Errorf("metadata.name missing in config.")
+		case cName.Document().Value != f.Name:
+			continue
+		}
+		cNS, err := config.Pipe(yaml.Lookup("metadata", "namespace"))
+		switch {
+		case err != nil:
+			return nil, err
+		case cNS == nil:
+			return nil, fmt.Errorf("metadata.namespace missing in config.")
+		case cNS.Document().Value != f.Namespace:
+			continue
+		}
+
+		// Keys are placed under the ConfigMap name, unless a path is
+		// given.
+		path := rMeta.Name
+		cPath, err := config.Pipe(yaml.Lookup("data", "path"))
+		if err != nil {
+			return nil, err
+		}
+		if cPath != nil {
+			path = cPath.Document().Value
+		}
+		path = strings.Trim(f.Data.KVPrefix+"/"+path, "/")
+
+		data, err := r.Pipe(yaml.Lookup("data"))
+		if err != nil {
+			return nil, err
+		}
+		if data == nil {
+			continue
+		}
+		err = data.VisitFields(func(node *yaml.MapNode) error {
+			key := strings.Trim(path+"/"+node.Key.YNode().Value, "/")
+			if _, ok := kv[key]; ok {
+				return fmt.Errorf("consul KV key %q is defined more than once.", key)
+			}
+			kv[key] = node.Value.YNode().Value
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Render KV data in a stable order.
+	keys := []string{}
+	for k := range kv {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	entries := []kvEntry{}
+	for _, k := range keys {
+		entries = append(entries, kvEntry{
+			Key:   k,
+			Value: base64.StdEncoding.EncodeToString([]byte(kv[k])),
+		})
+	}
+	kvJSON, err := json.Marshal(entries)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &kvSeedConfig{
+		KVJSON:         string(kvJSON),
+		Keys:           strings.Join(keys, "\n"),
+		ConfigFunction: f,
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%v%v%v", cfg.KVJSON, f.Data.KVPrefix, f.Data.KVPruneEnabled)))
+	cfg.Hash = fmt.Sprintf("%x", sum)[:10]
+
+	return cfg, nil
+}
+
+// removeStaleKVSeedResources filters out KV seeding Jobs and ConfigMaps
+// other than the ones for the current KV data. An empty hash removes them
+// all. Resources must carry this instance's label, so a Consul instance
+// whose name starts with `<name>-kv-seed-` is left alone.
+func (f *ConfigFunction) removeStaleKVSeedResources(in []*yaml.RNode, hash string) ([]*yaml.RNode, error) {
+	prefix := f.Name + "-kv-seed"
+	current := ""
+	if hash != "" {
+		current = prefix + "-" + hash
+	}
+	instance := f.Labels["app.kubernetes.io/instance"]
+
+	out := []*yaml.RNode{}
+	for _, r := range in {
+		rMeta, err := r.GetMeta()
+		if err != nil {
+			return nil, err
+		}
+
+		// ConfigMaps used to share the fixed `<name>-kv-seed` name, which
+		// is removed as well.
+		if (rMeta.Kind == "Job" || rMeta.Kind == "ConfigMap") &&
+			rMeta.Namespace == f.Namespace &&
+			rMeta.Labels["app.kubernetes.io/instance"] == instance &&
+			(rMeta.Name == prefix || strings.HasPrefix(rMeta.Name, prefix+"-")) &&
+			rMeta.Name != current {
+			continue
+		}
+		out = append(out, r)
+	}
+
+	return out, nil
+}
+
+func kvSeedTemplates() map[string]string {
+	return map[string]string{
+		"kv-seed-cm":  kvSeedCMTemplate,
+		"kv-seed-job": kvSeedJobTemplate,
+	}
+}
+
+var kvSeedCMTemplate = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .Name }}-kv-seed-{{ .Hash }}
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+data:
+  kv.json: {{ quote .KVJSON }}
+  keys.txt: {{ quote .Keys }}
+`
+
+var kvSeedJobTemplate = `apiVersion: batch/v1
+kind: Job
+metadata:
+  name: {{ .Name }}-kv-seed-{{ .Hash }}
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+spec:
+  template:
+    spec:
+      restartPolicy: OnFailure
+      containers:
+        - name: consul-kv-seed
+          image: docker.io/library/consul:1.7.2
+          command:
+            - /bin/sh
+            - -ec
+            - |-
+              echo "[INFO] Importing KV data."
+              consul kv import @/consul/kv-seed/kv.json
+{{- if .Data.KVPruneEnabled }}
+
+              echo "[INFO] Pruning unmanaged keys under {{ .Data.KVPrefix }}/."
+              consul kv get -keys -separator="" "{{ .Data.KVPrefix }}/" |\
+                while read -r key; do
+                  if ! grep -Fxq "${key}" /consul/kv-seed/keys.txt; then
+                    echo "[INFO] Deleting ${key}."
+                    consul kv delete "${key}"
+                  fi
+                done
+{{- end }}
+          env:
+{{- if .Data.ACLBootstrapJobEnabled }}
+            - name: CONSUL_HTTP_TOKEN
+              valueFrom:
+                secretKeyRef:
+                  name: {{ .Data.ACLBootstrapSecretName }}
+                  key: secret_id.txt
+{{- end }}
+{{- if .Data.TLSGeneratorJobEnabled }}
+            - name: CONSUL_HTTP_ADDR
+              value: https://{{ .Name }}-server.{{ .Namespace }}.svc:8500
+            - name: CONSUL_CACERT
+              value: /consul/tls/consul-agent-ca.pem
+            - name: CONSUL_CLIENT_CERT
+              value: /consul/tls/dc1-cli-consul-0.pem
+            - name: CONSUL_CLIENT_KEY
+              value: /consul/tls/dc1-cli-consul-0-key.pem
+{{- else }}
+            - name: CONSUL_HTTP_ADDR
+              value: http://{{ .Name }}-server.{{ .Namespace }}.svc:8500
+{{- end }}
+          volumeMounts:
+            - name: kv-seed
+              mountPath: /consul/kv-seed
+{{- if .Data.TLSGeneratorJobEnabled }}
+            - name: consul-tls-secret
+              mountPath: /consul/tls
+{{- end }}
+      volumes:
+        - name: kv-seed
+          configMap:
+            name: {{ .Name }}-kv-seed-{{ .Hash }}
+{{- if .Data.TLSGeneratorJobEnabled }}
+        - name: consul-tls-secret
+          projected:
+            sources:
+              - secret:
+                  name: {{ .Data.TLSCASecretName }}
+              - secret:
+                  name: {{ .Data.TLSCLISecretName }}
+{{- end }}
+`
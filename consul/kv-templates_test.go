@@ -0,0 +1,304 @@
+package consul
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// kvConfigMap returns a ConfigMap with the KV annotation targeting the
+// given Consul instance. An empty path leaves it out of the annotation.
+func kvConfigMap(name, target, path, data string) string {
+	cm := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: ` + name + `
+  namespace: example
+  annotations:
+    config.bzub.dev/consul-kv: |-
+      metadata:
+        name: ` + target + `
+        namespace: example
+`
+	if path != "" {
+		cm += `      data:
+        path: ` + path + `
+`
+	}
+	return cm + `data:
+` + data
+}
+
+// kvSeedNames returns the names of the KV seeding Job and ConfigMap of the
+// my-consul instance in rs, keyed by kind.
+func kvSeedNames(t *testing.T, rs []*yaml.RNode) map[string][]string {
+	t.Helper()
+	names := map[string][]string{}
+	for _, r := range rs {
+		rMeta, err := r.GetMeta()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(rMeta.Name, "my-consul-kv-seed") &&
+			rMeta.Labels["app.kubernetes.io/instance"] == "my-consul" {
+			names[rMeta.Kind] = append(names[rMeta.Kind], rMeta.Name)
+		}
+	}
+	return names
+}
+
+// kvSeedEntries returns the seeded keys and values of the only KV seeding
+// ConfigMap in rs.
+func kvSeedEntries(t *testing.T, rs []*yaml.RNode) map[string]string {
+	t.Helper()
+	names := kvSeedNames(t, rs)["ConfigMap"]
+	if len(names) != 1 {
+		t.Fatalf("found KV seeding ConfigMaps %v, want one", names)
+	}
+
+	entries := []kvEntry{}
+	kvJSON := value(t, findResource(t, rs, "ConfigMap", names[0]), "data", "kv.json")
+	if err := json.Unmarshal([]byte(kvJSON), &entries); err != nil {
+		t.Fatal(err)
+	}
+	kv := map[string]string{}
+	for _, e := range entries {
+		v, err := base64.StdEncoding.DecodeString(e.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		kv[e.Key] = string(v)
+	}
+	return kv
+}
+
+func TestKVSeedAnnotations(t *testing.T) {
+	data := map[string]string{
+		"kv_seed_job_enabled": "true",
+		"kv_prefix":           "managed",
+	}
+	out := runFilter(t, data,
+		kvConfigMap("app-config", "my-consul", "", "  db_host: db.example\n"),
+		kvConfigMap("web-config", "my-consul", "apps/web", "  port: \"8080\"\n"),
+		kvConfigMap("other-config", "other-consul", "", "  ignored: \"true\"\n"),
+	)
+
+	got := kvSeedEntries(t, out)
+	want := map[string]string{
+		"managed/app-config/db_host": "db.example",
+		"managed/apps/web/port":      "8080",
+	}
+	if len(got) != len(want) {
+		t.Errorf("seeded %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("seeded %v = %q, want %q", k, got[k], v)
+		}
+	}
+
+	name := kvSeedNames(t, out)["ConfigMap"][0]
+	keys := value(t, findResource(t, out, "ConfigMap", name), "data", "keys.txt")
+	if keys != "managed/app-config/db_host\nmanaged/apps/web/port" {
+		t.Errorf("unexpected keys.txt:\n%v", keys)
+	}
+}
+
+func TestKVSeedAnnotationErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  map[string]string
+		items []string
+		want  string
+	}{
+		{
+			name: "not a ConfigMap",
+			items: []string{`apiVersion: v1
+kind: Secret
+metadata:
+  name: app-secret
+  namespace: example
+  annotations:
+    config.bzub.dev/consul-kv: |-
+      metadata:
+        name: my-consul
+        namespace: example
+`},
+			want: "config.bzub.dev/consul-kv annotation is only supported on ConfigMaps, found Secret app-secret.",
+		},
+		{
+			name: "missing name",
+			items: []string{`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+  namespace: example
+  annotations:
+    config.bzub.dev/consul-kv: |-
+      metadata:
+        namespace: example
+`},
+			want: "metadata.name missing in config.",
+		},
+		{
+			name: "duplicate key",
+			items: []string{
+				kvConfigMap("app-config", "my-consul", "apps/web", "  port: \"8080\"\n"),
+				kvConfigMap("web-config", "my-consul", "apps/web", "  port: \"8081\"\n"),
+			},
+			want: `consul KV key "apps/web/port" is defined more than once.`,
+		},
+		{
+			name: "prune without prefix",
+			data: map[string]string{"kv_prune_enabled": "true"},
+			want: "kv_prune_enabled requires kv_prefix.",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := map[string]string{"kv_seed_job_enabled": "true"}
+			for k, v := range tt.data {
+				data[k] = v
+			}
+			in := []*yaml.RNode{}
+			for _, item := range tt.items {
+				in = append(in, yaml.MustParse(item))
+			}
+			_, err := newFunction(t, data).Filter(in)
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("got error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestKVSeedHash(t *testing.T) {
+	appConfig := kvConfigMap("app-config", "my-consul", "", "  db_host: db.example\n")
+	base := map[string]string{
+		"kv_seed_job_enabled": "true",
+		"kv_prefix":           "managed",
+	}
+	hash := func(data map[string]string, items ...string) string {
+		t.Helper()
+		merged := map[string]string{}
+		for k, v := range base {
+			merged[k] = v
+		}
+		for k, v := range data {
+			merged[k] = v
+		}
+		names := kvSeedNames(t, runFilter(t, merged, items...))
+		if len(names["Job"]) != 1 || len(names["ConfigMap"]) != 1 {
+			t.Fatalf("found KV seeding Resources %v, want one Job and one ConfigMap", names)
+		}
+		job := strings.TrimPrefix(names["Job"][0], "my-consul-kv-seed-")
+		cm := strings.TrimPrefix(names["ConfigMap"][0], "my-consul-kv-seed-")
+		if job != cm {
+			t.Errorf("Job hash %v does not match ConfigMap hash %v", job, cm)
+		}
+		return job
+	}
+
+	current := hash(nil, appConfig)
+	if got := hash(nil, appConfig); got != current {
+		t.Errorf("hash changed from %v to %v for the same data", current, got)
+	}
+	changes := map[string]string{
+		"data":   hash(nil, kvConfigMap("app-config", "my-consul", "", "  db_host: db.other\n")),
+		"prefix": hash(map[string]string{"kv_prefix": "other"}, appConfig),
+		"prune":  hash(map[string]string{"kv_prune_enabled": "true"}, appConfig),
+	}
+	for change, got := range changes {
+		if got == current {
+			t.Errorf("hash %v unchanged after changing %v", got, change)
+		}
+	}
+}
+
+func TestKVSeedPrune(t *testing.T) {
+	for _, prune := range []bool{false, true} {
+		data := map[string]string{
+			"kv_seed_job_enabled": "true",
+			"kv_prefix":           "managed",
+		}
+		if prune {
+			data["kv_prune_enabled"] = "true"
+		}
+		out := runFilter(t, data, kvConfigMap("app-config", "my-consul", "", "  db_host: db.example\n"))
+
+		job := findResource(t, out, "Job", kvSeedNames(t, out)["Job"][0])
+		script := lookup(t, job, "spec", "template", "spec", "containers", "[name=consul-kv-seed]", "command").Content()[2].Value
+		for _, want := range []string{
+			`consul kv get -keys -separator="" "managed/"`,
+			`consul kv delete "${key}"`,
+		} {
+			if got := strings.Contains(script, want); got != prune {
+				t.Errorf("kv_prune_enabled=%v: script contains %q %v, want %v", prune, want, got, prune)
+			}
+		}
+	}
+}
+
+func TestKVSeedStaleResources(t *testing.T) {
+	data := map[string]string{
+		"kv_seed_job_enabled": "true",
+		"kv_prefix":           "managed",
+	}
+	appConfig := kvConfigMap("app-config", "my-consul", "", "  db_host: db.example\n")
+
+	// A Consul instance whose name shares the KV seeding prefix.
+	otherInstance := `apiVersion: batch/v1
+kind: Job
+metadata:
+  name: my-consul-kv-seed-0123456789
+  namespace: example
+  labels:
+    app.kubernetes.io/instance: my-consul-kv-seed
+`
+	// The fixed-name ConfigMap of earlier releases.
+	legacy := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: my-consul-kv-seed
+  namespace: example
+  labels:
+    app.kubernetes.io/instance: my-consul
+data:
+  kv.json: "[]"
+`
+
+	items := []string{appConfig, otherInstance, legacy}
+	first := runFilter(t, data, appConfig)
+	previous := kvSeedNames(t, first)
+	for _, r := range first {
+		rMeta, err := r.GetMeta()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.HasPrefix(rMeta.Name, "my-consul-kv-seed-") {
+			items = append(items, r.MustString())
+		}
+	}
+
+	// Changing the data replaces the Job and ConfigMap.
+	items[0] = kvConfigMap("app-config", "my-consul", "", "  db_host: db.other\n")
+	out := runFilter(t, data, items...)
+	names := kvSeedNames(t, out)
+	for _, kind := range []string{"Job", "ConfigMap"} {
+		if len(names[kind]) != 1 || names[kind][0] == previous[kind][0] {
+			t.Errorf("found %v %v, want only a new one replacing %v", kind, names[kind], previous[kind])
+		}
+	}
+	if lookupResource(t, out, "Job", "my-consul-kv-seed-0123456789") == nil {
+		t.Error("Job of another instance was removed")
+	}
+
+	// Disabling the Job removes all KV seeding Resources.
+	data["kv_seed_job_enabled"] = "false"
+	if names := kvSeedNames(t, runFilter(t, data, items...)); len(names) != 0 {
+		t.Errorf("found KV seeding Resources %v with kv_seed_job_enabled false", names)
+	}
+}
@@ -0,0 +1,455 @@
+package consul
+
+import (
+	"strconv"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+func restoreJobTemplates() map[string]string {
+	return map[string]string{
+		"restore-secrets-job":     restoreSecretsJobTemplate,
+		"restore-wait-leader-job": restoreWaitLeaderJobTemplate,
+		"restore-snapshot-job":    restoreSnapshotJobTemplate,
+		"restore-sa":              restoreSATemplate,
+		"restore-role":            restoreRoleTemplate,
+		"restore-rolebinding":     restoreRoleBindingTemplate,
+	}
+}
+
+// restoreComplete determines if the input contains a restore snapshot Job that
+// has succeeded, meaning the restore from RestoreFrom is complete.
+func (f *ConfigFunction) restoreComplete(in []*yaml.RNode) (bool, error) {
+	for _, r := range in {
+		rMeta, err := r.GetMeta()
+		if err != nil {
+			return false, err
+		}
+		if rMeta.Kind != "Job" || rMeta.Name != f.Name+"-restore-snapshot" || rMeta.Namespace != f.Namespace {
+			continue
+		}
+
+		succeeded, err := r.Pipe(yaml.Lookup("status", "succeeded"))
+		if err != nil {
+			return false, err
+		}
+		if succeeded == nil {
+			return false, nil
+		}
+
+		count, err := strconv.Atoi(succeeded.Document().Value)
+		if err != nil {
+			return false, err
+		}
+		return count > 0, nil
+	}
+
+	return false, nil
+}
+
+// removeRestoreResources filters out Resources generated for a restore by a
+// previous run, including the suspended restore CronJobs of older versions.
+// The Job named keepJob is kept, if any.
+func (f *ConfigFunction) removeRestoreResources(in []*yaml.RNode, keepJob string) ([]*yaml.RNode, error) {
+	restoreRs := map[string][]string{
+		"Job": {
+			f.Name + "-restore-secrets",
+			f.Name + "-restore-wait-leader",
+			f.Name + "-restore-acl-bootstrap",
+			f.Name + "-restore-snapshot",
+		},
+		"CronJob":        {f.Name + "-restore-secrets", f.Name + "-restore-snapshot"},
+		"ServiceAccount": {f.Name + "-restore", f.Name + "-restore-secrets"},
+		"Role":           {f.Name + "-restore", f.Name + "-restore-secrets"},
+		"RoleBinding":    {f.Name + "-restore", f.Name + "-restore-secrets"},
+	}
+
+	out := []*yaml.RNode{}
+	for _, r := range in {
+		rMeta, err := r.GetMeta()
+		if err != nil {
+			return nil, err
+		}
+
+		remove := false
+		if rMeta.Namespace == f.Namespace && !(rMeta.Kind == "Job" && rMeta.Name == keepJob) {
+			for _, name := range restoreRs[rMeta.Kind] {
+				if rMeta.Name == name {
+					remove = true
+				}
+			}
+		}
+		if !remove {
+			out = append(out, r)
+		}
+	}
+
+	return out, nil
+}
+
+// Restore Secrets Resources
+var restoreSecretsJobTemplate = `apiVersion: batch/v1
+kind: Job
+metadata:
+  name: {{ .Name }}-restore-secrets
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+spec:
+  template:
+    spec:
+      serviceAccountName: {{ .Name }}-restore
+      restartPolicy: OnFailure
+      containers:
+        - name: consul-restore-secrets
+          image: k8s.gcr.io/hyperkube:v1.17.4
+          command:
+            - /bin/sh
+            - -ec
+            - |-
+              for secret_yaml in /consul/restore/*.yaml; do
+                kubectl create -f "${secret_yaml}"
+              done
+          volumeMounts:
+            - name: restore-secret
+              mountPath: /consul/restore
+      volumes:
+        - name: restore-secret
+          projected:
+            sources:
+              - secret:
+                  name: {{ .Data.RestoreFrom }}
+`
+
+// Restore Wait Leader Resources
+var restoreWaitLeaderJobTemplate = `apiVersion: batch/v1
+kind: Job
+metadata:
+  name: {{ .Name }}-restore-wait-leader
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+spec:
+  template:
+    spec:
+      serviceAccountName: {{ .Name }}-restore
+      restartPolicy: OnFailure
+      initContainers:
+        - name: wait-for-restore-secrets
+          image: k8s.gcr.io/hyperkube:v1.17.4
+          command:
+            - /bin/sh
+            - -ec
+            - |-
+              job="job/{{ .Name }}-restore-secrets"
+              until kubectl wait --for=condition=complete --timeout=60s "${job}"; do
+                echo "[INFO] Waiting for ${job} to complete."
+                sleep 5
+              done
+      containers:
+        - name: consul-wait-leader
+          image: docker.io/library/consul:1.7.2
+          command:
+            - /bin/sh
+            - -ec
+            - |-
+              until curl \
+{{- if .Data.TLSGeneratorJobEnabled }}
+                  --cacert "${CONSUL_CACERT}" \
+                  --cert "${CONSUL_CLIENT_CERT}" \
+                  --key "${CONSUL_CLIENT_KEY}" \
+{{- end }}
+                  "${CONSUL_HTTP_ADDR}/v1/status/leader" 2>/dev/null |\
+                grep -E '".+"'; do
+                echo "[INFO] Waiting for a Consul leader."
+                sleep 5
+              done
+          env:
+{{- if .Data.TLSGeneratorJobEnabled }}
+            - name: CONSUL_HTTP_ADDR
+              value: https://{{ .Name }}-server.{{ .Namespace }}.svc:8500
+            - name: CONSUL_CACERT
+              value: /consul/tls/consul-agent-ca.pem
+            - name: CONSUL_CLIENT_CERT
+              value: /consul/tls/dc1-cli-consul-0.pem
+            - name: CONSUL_CLIENT_KEY
+              value: /consul/tls/dc1-cli-consul-0-key.pem
+{{- else }}
+            - name: CONSUL_HTTP_ADDR
+              value: http://{{ .Name }}-server.{{ .Namespace }}.svc:8500
+{{- end }}
+{{- if .Data.TLSGeneratorJobEnabled }}
+          volumeMounts:
+            - name: consul-tls-secret
+              mountPath: /consul/tls
+      volumes:
+        - name: consul-tls-secret
+          projected:
+            sources:
+              - secret:
+                  name: {{ .Data.TLSCASecretName }}
+              - secret:
+                  name: {{ .Data.TLSCLISecretName }}
+{{- end }}
+`
+
+// Restore ACL Bootstrap Resources
+var restoreACLBootstrapJobTemplate = `apiVersion: batch/v1
+kind: Job
+metadata:
+  name: {{ .Name }}-restore-acl-bootstrap
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+spec:
+  template:
+    spec:
+      serviceAccountName: {{ .Name }}-restore
+      restartPolicy: OnFailure
+      initContainers:
+        - name: wait-for-restore-wait-leader
+          image: k8s.gcr.io/hyperkube:v1.17.4
+          command:
+            - /bin/sh
+            - -ec
+            - |-
+              job="job/{{ .Name }}-restore-wait-leader"
+              until kubectl wait --for=condition=complete --timeout=60s "${job}"; do
+                echo "[INFO] Waiting for ${job} to complete."
+                sleep 5
+              done
+        - name: consul-acl-bootstrap
+          image: docker.io/library/consul:1.7.2
+          command:
+            - /bin/sh
+            - -ec
+            - |-
+              secret_dir="/consul/acl"
+
+              output="$(consul acl bootstrap)"
+
+              if [ "${output}" = "" ]; then
+                echo "[ERROR] No consul acl bootstrap output. Is consul up and running?"
+                exit 1
+              fi
+
+              echo "${output}"|grep SecretID|awk '{print $2}'|tr -d '\n' \
+                > "${secret_dir}/secret_id.txt"
+          env:
+{{- if .Data.TLSGeneratorJobEnabled }}
+            - name: CONSUL_HTTP_ADDR
+              value: https://{{ .Name }}-server.{{ .Namespace }}.svc:8500
+            - name: CONSUL_CACERT
+              value: /consul/tls/consul-agent-ca.pem
+            - name: CONSUL_CLIENT_CERT
+              value: /consul/tls/dc1-cli-consul-0.pem
+            - name: CONSUL_CLIENT_KEY
+              value: /consul/tls/dc1-cli-consul-0-key.pem
+{{- else }}
+            - name: CONSUL_HTTP_ADDR
+              value: http://{{ .Name }}-server.{{ .Namespace }}.svc:8500
+{{- end }}
+          volumeMounts:
+            - name: consul-acl-token
+              mountPath: /consul/acl
+{{- if .Data.TLSGeneratorJobEnabled }}
+            - name: consul-tls-secret
+              mountPath: /consul/tls
+{{- end }}
+      containers:
+        - name: create-restore-acl-secret
+          image: k8s.gcr.io/hyperkube:v1.17.4
+          command:
+            - /bin/sh
+            - -ec
+            - |-
+              kubectl create secret generic \
+                --from-file=/consul/acl "{{ .Name }}-{{ .Namespace }}-restore-acl"
+          volumeMounts:
+            - name: consul-acl-token
+              mountPath: /consul/acl
+      volumes:
+        - name: consul-acl-token
+          emptyDir: {}
+{{- if .Data.TLSGeneratorJobEnabled }}
+        - name: consul-tls-secret
+          projected:
+            sources:
+              - secret:
+                  name: {{ .Data.TLSCASecretName }}
+              - secret:
+                  name: {{ .Data.TLSCLISecretName }}
+{{- end }}
+`
+
+// Restore Snapshot Resources
+var restoreSnapshotJobTemplate = `apiVersion: batch/v1
+kind: Job
+metadata:
+  name: {{ .Name }}-restore-snapshot
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+spec:
+  template:
+    spec:
+      serviceAccountName: {{ .Name }}-restore
+      restartPolicy: OnFailure
+      initContainers:
+{{- if .Data.ACLBootstrapJobEnabled }}
+        - name: wait-for-restore-acl-bootstrap
+{{- else }}
+        - name: wait-for-restore-wait-leader
+{{- end }}
+          image: k8s.gcr.io/hyperkube:v1.17.4
+          command:
+            - /bin/sh
+            - -ec
+            - |-
+{{- if .Data.ACLBootstrapJobEnabled }}
+              job="job/{{ .Name }}-restore-acl-bootstrap"
+{{- else }}
+              job="job/{{ .Name }}-restore-wait-leader"
+{{- end }}
+              until kubectl wait --for=condition=complete --timeout=60s "${job}"; do
+                echo "[INFO] Waiting for ${job} to complete."
+                sleep 5
+              done
+{{- if not .Data.ACLBootstrapJobEnabled }}
+      containers:
+{{- end }}
+        - name: consul-restore-snapshot
+          image: docker.io/library/consul:1.7.2
+          command:
+            - consul
+            - snapshot
+            - restore
+{{- if .Data.ACLBootstrapJobEnabled }}
+            - -token-file=/consul/acl/secret_id.txt
+{{- end }}
+            - /consul/restore/backup.snap
+          env:
+{{- if .Data.TLSGeneratorJobEnabled }}
+            - name: CONSUL_HTTP_ADDR
+              value: https://{{ .Name }}-server.{{ .Namespace }}.svc:8500
+            - name: CONSUL_CACERT
+              value: /consul/tls/consul-agent-ca.pem
+            - name: CONSUL_CLIENT_CERT
+              value: /consul/tls/dc1-cli-consul-0.pem
+            - name: CONSUL_CLIENT_KEY
+              value: /consul/tls/dc1-cli-consul-0-key.pem
+{{- else }}
+            - name: CONSUL_HTTP_ADDR
+              value: http://{{ .Name }}-server.{{ .Namespace }}.svc:8500
+{{- end }}
+          volumeMounts:
+{{- if .Data.ACLBootstrapJobEnabled }}
+            - name: consul-acl-token
+              mountPath: /consul/acl
+{{- end }}
+{{- if .Data.TLSGeneratorJobEnabled }}
+            - name: consul-tls-secret
+              mountPath: /consul/tls
+{{- end }}
+            - name: restore-secret
+              mountPath: /consul/restore
+{{- if .Data.ACLBootstrapJobEnabled }}
+      containers:
+        - name: delete-restore-acl-secret
+          image: k8s.gcr.io/hyperkube:v1.17.4
+          command:
+            - /bin/sh
+            - -ec
+            - |-
+              # The restored snapshot replaces the temporary ACL bootstrap
+              # token, so it is no longer of any use.
+              kubectl delete secret "{{ .Name }}-{{ .Namespace }}-restore-acl"
+{{- end }}
+      volumes:
+{{- if .Data.ACLBootstrapJobEnabled }}
+        - name: consul-acl-token
+          secret:
+            secretName: {{ .Name }}-{{ .Namespace }}-restore-acl
+{{- end }}
+        - name: restore-secret
+          projected:
+            sources:
+              - secret:
+                  name: {{ .Data.RestoreFrom }}
+{{- if .Data.TLSGeneratorJobEnabled }}
+        - name: consul-tls-secret
+          projected:
+            sources:
+              - secret:
+                  name: {{ .Data.TLSCASecretName }}
+              - secret:
+                  name: {{ .Data.TLSCLISecretName }}
+{{- end }}
+`
+
+// Restore RBAC
+var restoreSATemplate = `apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: {{ .Name }}-restore
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+`
+
+var restoreRoleTemplate = `apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: {{ .Name }}-restore
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+rules:
+  - apiGroups:
+      - ""
+    resources:
+      - secrets
+    verbs:
+      - create
+{{- if .Data.ACLBootstrapJobEnabled }}
+  - apiGroups:
+      - ""
+    resources:
+      - secrets
+    verbs:
+      - delete
+    resourceNames:
+      - {{ .Name }}-{{ .Namespace }}-restore-acl
+{{- end }}
+  - apiGroups:
+      - batch
+    resources:
+      - jobs
+    verbs:
+      - get
+      - list
+      - watch
+`
+
+var restoreRoleBindingTemplate = `apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: {{ .Name }}-restore
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: Role
+  name: {{ .Name }}-restore
+subjects:
+  - kind: ServiceAccount
+    name: {{ .Name }}-restore
+`
@@ -0,0 +1,159 @@
+package consul
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/kustomize/kyaml/kio"
+	"sigs.k8s.io/kustomize/kyaml/kio/filters"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+func TestRestoreJobs(t *testing.T) {
+	tests := []struct {
+		name    string
+		acl     bool
+		jobs    []string
+		waitFor string
+	}{
+		{
+			"acl",
+			true,
+			[]string{"my-consul-restore-secrets", "my-consul-restore-wait-leader", "my-consul-restore-acl-bootstrap", "my-consul-restore-snapshot"},
+			"my-consul-restore-acl-bootstrap",
+		},
+		{
+			"no acl",
+			false,
+			[]string{"my-consul-restore-secrets", "my-consul-restore-wait-leader", "my-consul-restore-snapshot"},
+			"my-consul-restore-wait-leader",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := map[string]string{"restore_from": "my-consul-example-backup"}
+			if tt.acl {
+				data["acl_bootstrap_job_enabled"] = "true"
+			}
+			out := runFilter(t, data)
+
+			jobs := []string{}
+			for _, r := range out {
+				rMeta, err := r.GetMeta()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if rMeta.Kind == "Job" && strings.HasPrefix(rMeta.Name, "my-consul-restore-") {
+					jobs = append(jobs, rMeta.Name)
+				}
+			}
+			sort.Strings(jobs)
+			sort.Strings(tt.jobs)
+			if strings.Join(jobs, ",") != strings.Join(tt.jobs, ",") {
+				t.Errorf("restore Jobs %v, want %v", jobs, tt.jobs)
+			}
+
+			snapshot := findResource(t, out, "Job", "my-consul-restore-snapshot").MustString()
+			if !strings.Contains(snapshot, `job="job/`+tt.waitFor+`"`) {
+				t.Errorf("snapshot Job does not wait for %v:\n%v", tt.waitFor, snapshot)
+			}
+			if got := strings.Contains(snapshot, "-token-file="); got != tt.acl {
+				t.Errorf("snapshot restore uses a token file %v, want %v", got, tt.acl)
+			}
+			if got := strings.Contains(snapshot, "restore-acl"); got != tt.acl {
+				t.Errorf("snapshot Job references the restore ACL Secret %v, want %v", got, tt.acl)
+			}
+		})
+	}
+}
+
+func TestRestoreComplete(t *testing.T) {
+	fnConfig := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: my-consul
+  namespace: example
+data:
+  restore_from: my-consul-example-backup
+`
+	job := `apiVersion: batch/v1
+kind: Job
+metadata:
+  name: my-consul-restore-snapshot
+  namespace: example
+status:
+  succeeded: 1
+`
+	// run runs the function like `config run` does, reading the function
+	// config from the package.
+	run := func(in []*yaml.RNode) []*yaml.RNode {
+		t.Helper()
+		f := &ConfigFunction{}
+		f.RW = &kio.ByteReadWriter{FunctionConfig: yaml.MustParse(findResource(t, in, "ConfigMap", "my-consul").MustString())}
+		out, err := f.Filter(in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err = filters.MergeFilter{}.Filter(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	restoreJobs := func(rs []*yaml.RNode) []string {
+		t.Helper()
+		jobs := []string{}
+		for _, name := range []string{"secrets", "wait-leader", "acl-bootstrap", "snapshot"} {
+			if lookupResource(t, rs, "Job", "my-consul-restore-"+name) != nil {
+				jobs = append(jobs, name)
+			}
+		}
+		return jobs
+	}
+
+	// The user's function config keeps restore_from set, so later runs must
+	// not restore the old snapshot over live data.
+	out := []*yaml.RNode{yaml.MustParse(fnConfig), yaml.MustParse(job)}
+	for i := 1; i <= 3; i++ {
+		out = run(out)
+		if got := restoreJobs(out); strings.Join(got, ",") != "snapshot" {
+			t.Fatalf("run %v: restore Jobs %v, want only the succeeded snapshot Job", i, got)
+		}
+		if got := value(t, findResource(t, out, "Job", "my-consul-restore-snapshot"), "status", "succeeded"); got != "1" {
+			t.Fatalf("run %v: snapshot Job succeeded = %q, want 1", i, got)
+		}
+	}
+
+	// Unsetting restore_from removes the record of the restore.
+	if err := findResource(t, out, "ConfigMap", "my-consul").PipeE(
+		yaml.Lookup("data"), yaml.SetField("restore_from", yaml.NewScalarRNode(""))); err != nil {
+		t.Fatal(err)
+	}
+	out = run(out)
+	if got := restoreJobs(out); len(got) != 0 {
+		t.Errorf("restore Jobs %v after unsetting restore_from, want none", got)
+	}
+}
+
+func TestRestoreSecretName(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"my-consul-example-restore", ""},
+		{"my-backup", `restore_secret_name is no longer supported. Remove it, and set restore_from to "my-backup" to restore from that Secret.`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			_, err := newFunction(t, map[string]string{"restore_secret_name": tt.value}).Filter(nil)
+			got := ""
+			if err != nil {
+				got = err.Error()
+			}
+			if got != tt.want {
+				t.Errorf("got error %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -1,5 +1,7 @@
 package consul
 
+import "sigs.k8s.io/kustomize/kyaml/yaml"
+
 func serverTemplates() map[string]string {
 	return map[string]string{
 		"agent-cm":       agentCmTemplate,
@@ -7,7 +9,6 @@ func serverTemplates() map[string]string {
 		"server-sts":     serverStsTemplate,
 		"server-svc":     serverSvcTemplate,
 		"server-dns-svc": serverDNSSvcTemplate,
-		"server-ui-svc":  serverUISvcTemplate,
 	}
 }
 
@@ -56,12 +57,49 @@ data:
     connect = {
       enabled = true
     }
+  10-server-options.hcl: |-
+    log_level = {{ quote .Data.LogLevel }}
+    ui = {{ .Data.UIEnabled }}
+{{- if .Data.RaftMultiplier }}
+    performance = {
+      raft_multiplier = {{ .Data.RaftMultiplier }}
+    }
+{{- end }}
+    autopilot = {
+      cleanup_dead_servers = {{ .Data.AutopilotCleanupDeadServers }}
+{{- if .Data.AutopilotLastContactThreshold }}
+      last_contact_threshold = {{ quote .Data.AutopilotLastContactThreshold }}
+{{- end }}
+{{- if .Data.AutopilotServerStabilizationTime }}
+      server_stabilization_time = {{ quote .Data.AutopilotServerStabilizationTime }}
+{{- end }}
+    }
+{{- if or .Data.TelemetryStatsdAddress .Data.TelemetryDogstatsdAddress .Data.TelemetryDisableHostname .Data.PrometheusRetentionTime }}
+    telemetry = {
+{{- if .Data.TelemetryStatsdAddress }}
+      statsd_address = {{ quote .Data.TelemetryStatsdAddress }}
+{{- end }}
+{{- if .Data.TelemetryDogstatsdAddress }}
+      dogstatsd_addr = {{ quote .Data.TelemetryDogstatsdAddress }}
+{{- end }}
+{{- if .Data.TelemetryDisableHostname }}
+      disable_hostname = true
+{{- end }}
+{{- if .Data.PrometheusRetentionTime }}
+      prometheus_retention_time = {{ quote .Data.PrometheusRetentionTime }}
+{{- end }}
+    }
+{{- end }}
 {{- if .Data.TLSGeneratorJobEnabled }}
   00-server-defaults.hcl: |-
     verify_server_hostname = true
     cert_file = "/consul/tls/server-consul.pem"
     key_file = "/consul/tls/server-consul-key.pem"
 {{- end }}
+{{- range $file, $hcl := .Data.ServerConfigFiles }}
+  {{ $file }}: |-
+{{ $hcl }}
+{{- end }}
 `
 
 var serverStsTemplate = `apiVersion: apps/v1
@@ -123,7 +161,6 @@ spec:
             - -bootstrap-expect=$(CONSUL_REPLICAS)
             - -client=0.0.0.0
             - -config-dir=/consul/config
-            - -ui
             - -retry-join={{ .Name }}-server.$(NAMESPACE).svc.cluster.local
             - -server
           envFrom:
@@ -241,6 +278,71 @@ metadata:
   labels:
     app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
     app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+{{- if .Data.PrometheusRetentionTime }}
+  annotations:
+{{- if or .Data.TLSGeneratorJobEnabled .Data.PrometheusTokenSecretName }}
+    config.bzub.dev/prometheus-scrape_secrets: |-
+{{- if .Data.TLSGeneratorJobEnabled }}
+      - name: consul-{{ .Name }}-{{ .Namespace }}-tls
+        mountPath: /etc/prometheus/consul/{{ .Name }}-{{ .Namespace }}/tls
+        secrets:
+          - {{ .Data.TLSCASecretName }}
+          - {{ .Data.TLSCLISecretName }}
+{{- end }}
+{{- if .Data.PrometheusTokenSecretName }}
+      - name: consul-{{ .Name }}-{{ .Namespace }}-acl
+        mountPath: /etc/prometheus/consul/{{ .Name }}-{{ .Namespace }}/acl
+        secrets:
+          - {{ .Data.PrometheusTokenSecretName }}
+{{- end }}
+{{- end }}
+    config.bzub.dev/prometheus-scrape_configs: |-
+      - job_name: {{ .Name }}
+        metrics_path: /v1/agent/metrics
+        params:
+          format:
+            - prometheus
+{{- if .Data.TLSGeneratorJobEnabled }}
+        scheme: https
+        tls_config:
+          ca_file: /etc/prometheus/consul/{{ .Name }}-{{ .Namespace }}/tls/consul-agent-ca.pem
+          cert_file: /etc/prometheus/consul/{{ .Name }}-{{ .Namespace }}/tls/dc1-cli-consul-0.pem
+          key_file: /etc/prometheus/consul/{{ .Name }}-{{ .Namespace }}/tls/dc1-cli-consul-0-key.pem
+          server_name: server.dc1.consul
+{{- end }}
+{{- if .Data.PrometheusTokenSecretName }}
+        bearer_token_file: /etc/prometheus/consul/{{ .Name }}-{{ .Namespace }}/acl/secret_id.txt
+{{- end }}
+        kubernetes_sd_configs:
+          - role: endpoints
+            namespaces:
+              names:
+                - {{ .Namespace }}
+        relabel_configs:
+          - source_labels: [__meta_kubernetes_service_name]
+            action: keep
+            regex: {{ .Name }}-server
+          - source_labels: [__meta_kubernetes_endpoint_port_name]
+            action: keep
+{{- if .Data.TLSGeneratorJobEnabled }}
+            regex: https
+{{- else }}
+            regex: http
+{{- end }}
+          - action: labelmap
+            regex: __meta_kubernetes_service_label_(.+)
+          - source_labels: [__meta_kubernetes_namespace]
+            action: replace
+            target_label: kubernetes_namespace
+          - source_labels: [__meta_kubernetes_service_name]
+            action: replace
+            target_label: kubernetes_service_name
+          - action: labelmap
+            regex: __meta_kubernetes_pod_label_(.+)
+          - source_labels: [__meta_kubernetes_pod_name]
+            action: replace
+            target_label: kubernetes_pod_name
+{{- end }}
 spec:
   selector:
     app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
@@ -295,6 +397,9 @@ metadata:
     app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
     app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
 spec:
+{{- if .Data.DNSClusterIP }}
+  clusterIP: {{ .Data.DNSClusterIP }}
+{{- end }}
   selector:
     app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
     app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
@@ -309,6 +414,30 @@ spec:
       targetPort: dns-udp
 `
 
+// removeStaleUIResources filters out the server UI Service and Ingress
+// generated by a previous run, when UIEnabled or UIIngressHost are unset.
+func (f *ConfigFunction) removeStaleUIResources(in []*yaml.RNode) ([]*yaml.RNode, error) {
+	out := []*yaml.RNode{}
+	for _, r := range in {
+		rMeta, err := r.GetMeta()
+		if err != nil {
+			return nil, err
+		}
+
+		if rMeta.Namespace == f.Namespace && rMeta.Name == f.Name+"-server-ui" {
+			if rMeta.Kind == "Service" && !f.Data.UIEnabled {
+				continue
+			}
+			if rMeta.Kind == "Ingress" && (!f.Data.UIEnabled || f.Data.UIIngressHost == "") {
+				continue
+			}
+		}
+		out = append(out, r)
+	}
+
+	return out, nil
+}
+
 var serverUISvcTemplate = `apiVersion: v1
 kind: Service
 metadata:
@@ -332,3 +461,41 @@ spec:
       targetPort: 8500
 {{- end }}
 `
+
+var serverUIIngressTemplate = `apiVersion: networking.k8s.io/v1beta1
+kind: Ingress
+metadata:
+  name: {{ .Name }}-server-ui
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+{{- if or .Data.UIIngressClass .Data.TLSGeneratorJobEnabled }}
+  annotations:
+{{- if .Data.UIIngressClass }}
+    kubernetes.io/ingress.class: {{ .Data.UIIngressClass }}
+{{- end }}
+{{- if .Data.TLSGeneratorJobEnabled }}
+    nginx.ingress.kubernetes.io/backend-protocol: HTTPS
+{{- end }}
+{{- end }}
+spec:
+{{- if .Data.UIIngressTLSSecretName }}
+  tls:
+    - hosts:
+        - {{ .Data.UIIngressHost }}
+      secretName: {{ .Data.UIIngressTLSSecretName }}
+{{- end }}
+  rules:
+    - host: {{ .Data.UIIngressHost }}
+      http:
+        paths:
+          - path: /
+            backend:
+              serviceName: {{ .Name }}-server-ui
+{{- if .Data.TLSGeneratorJobEnabled }}
+              servicePort: https
+{{- else }}
+              servicePort: http
+{{- end }}
+`
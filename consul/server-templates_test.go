@@ -0,0 +1,128 @@
+package consul
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestServerPrometheusTelemetry(t *testing.T) {
+	tests := []struct {
+		name            string
+		data            map[string]string
+		disableHostname bool
+		scrapeSecrets   []string
+	}{
+		{
+			name: "metrics",
+			data: map[string]string{"prometheus_retention_time": "60s"},
+		},
+		{
+			name: "hostname disabled",
+			data: map[string]string{
+				"prometheus_retention_time":  "60s",
+				"telemetry_disable_hostname": "true",
+			},
+			disableHostname: true,
+		},
+		{
+			name: "tls and token",
+			data: map[string]string{
+				"prometheus_retention_time":    "60s",
+				"tls_generator_job_enabled":    "true",
+				"prometheus_token_secret_name": "my-prometheus-consul-token",
+			},
+			scrapeSecrets: []string{
+				"mountPath: /etc/prometheus/consul/my-consul-example/tls",
+				"- my-consul-example-tls-ca",
+				"- my-consul-example-tls-cli",
+				"mountPath: /etc/prometheus/consul/my-consul-example/acl",
+				"- my-prometheus-consul-token",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := runFilter(t, tt.data)
+
+			options := value(t, findResource(t, out, "ConfigMap", "my-consul-example-server"), "data", "10-server-options.hcl")
+			if got := strings.Contains(options, "disable_hostname = true"); got != tt.disableHostname {
+				t.Errorf("disable_hostname set %v, want %v", got, tt.disableHostname)
+			}
+
+			svc := findResource(t, out, "Service", "my-consul-server")
+			secrets := value(t, svc, "metadata", "annotations", "config.bzub.dev/prometheus-scrape_secrets")
+			if (secrets != "") != (len(tt.scrapeSecrets) > 0) {
+				t.Errorf("unexpected scrape Secrets annotation %q", secrets)
+			}
+			for _, want := range tt.scrapeSecrets {
+				if !strings.Contains(secrets, want) {
+					t.Errorf("scrape Secrets annotation is missing %q", want)
+				}
+			}
+		})
+	}
+}
+
+func TestServerAutopilotTelemetryOptions(t *testing.T) {
+	data := map[string]string{
+		"autopilot_last_contact_threshold":    "200ms",
+		"autopilot_server_stabilization_time": "10s",
+		"telemetry_statsd_address":            "statsd.example.svc:8125",
+		"telemetry_dogstatsd_address":         "[::1]:8125",
+	}
+	out := runFilter(t, data)
+
+	options := value(t, findResource(t, out, "ConfigMap", "my-consul-example-server"), "data", "10-server-options.hcl")
+	for _, want := range []string{
+		`last_contact_threshold = "200ms"`,
+		`server_stabilization_time = "10s"`,
+		`statsd_address = "statsd.example.svc:8125"`,
+		`dogstatsd_addr = "[::1]:8125"`,
+	} {
+		if !strings.Contains(options, want) {
+			t.Errorf("server options missing %v:\n%v", want, options)
+		}
+	}
+}
+
+func TestServerAutopilotTelemetryOptionErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data map[string]string
+		want string
+	}{
+		{
+			"last contact threshold",
+			map[string]string{"autopilot_last_contact_threshold": `1s" bootstrap = true "`},
+			`invalid autopilot_last_contact_threshold "1s\" bootstrap = true \"", must be a duration such as 10s.`,
+		},
+		{
+			"server stabilization time",
+			map[string]string{"autopilot_server_stabilization_time": "10"},
+			`invalid autopilot_server_stabilization_time "10", must be a duration such as 10s.`,
+		},
+		{
+			"prometheus retention time",
+			map[string]string{"prometheus_retention_time": "a minute"},
+			`invalid prometheus_retention_time "a minute", must be a duration such as 10s.`,
+		},
+		{
+			"statsd address",
+			map[string]string{"telemetry_statsd_address": "statsd.example.svc"},
+			`invalid telemetry_statsd_address "statsd.example.svc", must be a host:port address.`,
+		},
+		{
+			"dogstatsd address",
+			map[string]string{"telemetry_dogstatsd_address": `:8125"`},
+			`invalid telemetry_dogstatsd_address ":8125\"", must be a host:port address.`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := newFunction(t, tt.data).Filter(nil)
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("got error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -2,6 +2,8 @@ package consul
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/bzub/config-functions/cfunc"
 	"sigs.k8s.io/kustomize/kyaml/yaml"
@@ -9,54 +11,155 @@ import (
 
 const casiAnnotation = "config.bzub.dev/consul-agent-sidecar-injector"
 
-func (f *ConfigFunction) sidecarPatches(in []*yaml.RNode) ([]*yaml.RNode, error) {
-	patches := []*yaml.RNode{}
+// sidecarOptions returns the sidecar options from r's injector annotation, or
+// nil if r does not target this Consul instance.
+func (f *ConfigFunction) sidecarOptions(r *yaml.RNode) (*AgentSidecarOptions, error) {
+	aValue, err := r.Pipe(yaml.GetAnnotation(casiAnnotation))
+	if err != nil {
+		return nil, err
+	}
+	if aValue == nil {
+		return nil, nil
+	}
+
+	config, err := yaml.Parse(aValue.Document().Value)
+	if err != nil {
+		return nil, err
+	}
+
+	// Determine if sidecar injector config name matches this Consul
+	// instance.
+	cName, err := config.Pipe(yaml.Lookup("metadata", "name"))
+	switch {
+	case err != nil:
+		return nil, err
+	case cName == nil:
+		return nil, fmt.Errorf("metadata.name missing in config.")
+	case cName.Document().Value != f.Name:
+		return nil, nil
+	}
+
+	// Determine if sidecar injector config namespace matches this Consul
+	// instance.
+	cNS, err := config.Pipe(yaml.Lookup("metadata", "namespace"))
+	switch {
+	case err != nil:
+		return nil, err
+	case cNS == nil:
+		return nil, fmt.Errorf("metadata.namespace missing in config.")
+	case cNS.Document().Value != f.Namespace:
+		return nil, nil
+	}
+
+	// Read per-workload sidecar options, if any.
+	sidecarOpts := &AgentSidecarOptions{}
+	cData, err := config.Pipe(yaml.Lookup("data"))
+	if err != nil {
+		return nil, err
+	}
+	if cData != nil {
+		if err := yaml.Unmarshal([]byte(cData.MustString()), sidecarOpts); err != nil {
+			return nil, err
+		}
+	}
+
+	return sidecarOpts, nil
+}
+
+// sidecarWorkloads returns the metadata of workloads which get an agent sidecar
+// injected.
+func (f *ConfigFunction) sidecarWorkloads(in []*yaml.RNode) ([]yaml.ResourceMeta, error) {
+	workloads := []yaml.ResourceMeta{}
+	if !f.Data.AgentSidecarInjectorEnabled {
+		return workloads, nil
+	}
+
 	for _, r := range in {
-		aValue, err := r.Pipe(yaml.GetAnnotation(casiAnnotation))
+		opts, err := f.sidecarOptions(r)
 		if err != nil {
 			return nil, err
 		}
-		if aValue == nil {
+		if opts == nil || opts.NodeLocalAgent {
 			continue
 		}
 
-		config, err := yaml.Parse(aValue.Document().Value)
+		rMeta, err := r.GetMeta()
 		if err != nil {
 			return nil, err
 		}
+		workloads = append(workloads, rMeta)
+	}
 
-		// Determine if sidecar injector config name matches this
-		// Consul instance.
-		cName, err := config.Pipe(yaml.Lookup("metadata", "name"))
-		switch {
-		case err != nil:
+	return workloads, nil
+}
+
+// sidecarNamespaces returns the sorted namespaces other than the Consul
+// namespace of the given workloads.
+func (f *ConfigFunction) sidecarNamespaces(workloads []yaml.ResourceMeta) []string {
+	seen := map[string]bool{}
+	namespaces := []string{}
+	for _, w := range workloads {
+		if w.Namespace != f.Namespace && !seen[w.Namespace] {
+			seen[w.Namespace] = true
+			namespaces = append(namespaces, w.Namespace)
+		}
+	}
+	sort.Strings(namespaces)
+
+	return namespaces
+}
+
+func (f *ConfigFunction) sidecarPatches(in []*yaml.RNode) ([]*yaml.RNode, error) {
+	patches := []*yaml.RNode{}
+	for _, r := range in {
+		opts, err := f.sidecarOptions(r)
+		if err != nil {
 			return nil, err
-		case cName == nil:
-			return nil, fmt.Errorf("metadata.name missing in config.")
-		case cName.Document().Value != f.Name:
+		}
+		if opts == nil {
 			continue
 		}
+		sidecarOpts := *opts
 
-		// Determine if sidecar injector config namespace matches this
-		// Consul instance.
-		cNS, err := config.Pipe(yaml.Lookup("metadata", "namespace"))
-		switch {
-		case err != nil:
-			return nil, err
-		case cNS == nil:
-			return nil, fmt.Errorf("metadata.namespace missing in config.")
-		case cNS.Document().Value != f.Namespace:
+		if sidecarOpts.NodeLocalAgent {
+			// Point the workload at the node-local client agent
+			// instead of injecting a sidecar.
+			nlaPatch, err := f.nodeLocalAgentPatch(r, sidecarOpts)
+			if err != nil {
+				return nil, err
+			}
+			patches = append(patches, nlaPatch)
 			continue
 		}
 
+		// Collect agent configuration files for this workload.
+		agentConfigFiles := map[string]string{}
+		if sidecarOpts.Services != "" {
+			agentConfigFiles["10-services.hcl"] = cfunc.Indent(sidecarOpts.Services, "    ")
+		}
+		if sidecarOpts.Checks != "" {
+			agentConfigFiles["10-checks.hcl"] = cfunc.Indent(sidecarOpts.Checks, "    ")
+		}
+		if sidecarOpts.ConnectEnabled {
+			if sidecarOpts.ConnectServiceName == "" {
+				return nil, fmt.Errorf("connect_service_name is required when connect_enabled is true.")
+			}
+			agentConfigFiles["20-connect.hcl"] = cfunc.Indent(connectServiceHCL(sidecarOpts), "    ")
+		}
+		if sidecarOpts.ExtraHCL != "" {
+			agentConfigFiles["90-extra.hcl"] = cfunc.Indent(sidecarOpts.ExtraHCL, "    ")
+		}
+
 		// Create a sidecar patch config for this Resource.
 		rMeta, err := r.GetMeta()
 		if err != nil {
 			return nil, err
 		}
 		patchCfg := &casiConfig{
-			PatchTarget:    rMeta,
-			ConfigFunction: f,
+			PatchTarget:      rMeta,
+			Sidecar:          sidecarOpts,
+			AgentConfigFiles: agentConfigFiles,
+			ConfigFunction:   f,
 		}
 
 		// Create a sidecar patch for this Resource.
@@ -68,6 +171,32 @@ func (f *ConfigFunction) sidecarPatches(in []*yaml.RNode) ([]*yaml.RNode, error)
 		}
 		patches = append(patches, scPatch)
 
+		if len(agentConfigFiles) > 0 {
+			// Create a ConfigMap with this workload's agent
+			// configuration.
+			sidecarAgentCM, err := cfunc.ParseTemplate(
+				"sidecar-agent-cm", sidecarAgentCMTemplate, patchCfg,
+			)
+			if err != nil {
+				return nil, err
+			}
+			patches = append(patches, sidecarAgentCM)
+		}
+
+		if sidecarOpts.ACLTokenRules != "" {
+			// Create Resources which generate this workload's ACL
+			// token.
+			tokenCfg, err := f.aclToken(patchCfg)
+			if err != nil {
+				return nil, err
+			}
+			tokenRs, err := cfunc.ParseTemplates(aclTokenTemplates(), tokenCfg)
+			if err != nil {
+				return nil, err
+			}
+			patches = append(patches, tokenRs...)
+		}
+
 		if f.Data.TLSGeneratorJobEnabled {
 			// Create a ConfigMap to configure Consul agent TLS.
 			sidecarTLSCM, err := cfunc.ParseTemplate(
@@ -83,6 +212,92 @@ func (f *ConfigFunction) sidecarPatches(in []*yaml.RNode) ([]*yaml.RNode, error)
 	return patches, nil
 }
 
+// nodeLocalAgentPatch creates a patch which sets CONSUL_HTTP_ADDR and related
+// environment variables on every container of a workload, targeting the
+// client agent DaemonSet Pod on the same node.
+func (f *ConfigFunction) nodeLocalAgentPatch(r *yaml.RNode, opts AgentSidecarOptions) (*yaml.RNode, error) {
+	switch {
+	case !f.Data.ClientDaemonSetEnabled:
+		return nil, fmt.Errorf("node_local_agent requires client_daemonset_enabled.")
+	case !f.Data.ClientHostNetwork && !f.Data.ClientHostPortEnabled:
+		return nil, fmt.Errorf("node_local_agent requires client_host_network or client_host_port_enabled.")
+	case opts.Services != "" || opts.Checks != "" || opts.ExtraHCL != "" || opts.ConnectEnabled:
+		return nil, fmt.Errorf("node_local_agent can not be combined with sidecar agent configuration.")
+	}
+
+	rMeta, err := r.GetMeta()
+	if err != nil {
+		return nil, err
+	}
+
+	// The CLI certificates only exist in the Consul namespace.
+	if f.Data.TLSGeneratorJobEnabled {
+		switch {
+		case rMeta.Namespace != f.Namespace:
+			return nil, fmt.Errorf("node_local_agent with tls_generator_job_enabled requires %v %v to be in the %v namespace.",
+				rMeta.Kind, rMeta.Name, f.Namespace)
+		case len(opts.Containers) == 0:
+			return nil, fmt.Errorf("node_local_agent with tls_generator_job_enabled requires containers to be set for %v %v.",
+				rMeta.Kind, rMeta.Name)
+		}
+	}
+
+	// Collect container names to patch.
+	names := opts.Containers
+	if len(names) == 0 {
+		containers, err := r.Pipe(yaml.Lookup("spec", "template", "spec", "containers"))
+		if err != nil {
+			return nil, err
+		}
+		if containers == nil {
+			return nil, fmt.Errorf("%v %v has no containers to configure.", rMeta.Kind, rMeta.Name)
+		}
+		err = containers.VisitElements(func(c *yaml.RNode) error {
+			name, err := c.Pipe(yaml.Lookup("name"))
+			if err != nil {
+				return err
+			}
+			if name != nil {
+				names = append(names, name.Document().Value)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	patchCfg := &casiConfig{
+		PatchTarget:    rMeta,
+		Sidecar:        opts,
+		Containers:     names,
+		ConfigFunction: f,
+	}
+
+	return cfunc.ParseTemplate("node-local-agent-patch", nodeLocalAgentPatchTemplate, patchCfg)
+}
+
+// connectServiceHCL renders a service definition with a Connect sidecar
+// service registration for the Envoy proxy.
+func connectServiceHCL(opts AgentSidecarOptions) string {
+	b := &strings.Builder{}
+	// Envoy fetches its configuration from the agent's gRPC port.
+	fmt.Fprintf(b, "ports {\n  grpc = 8502\n}\n")
+	fmt.Fprintf(b, "service {\n  name = %q\n", opts.ConnectServiceName)
+	if opts.ConnectServicePort != 0 {
+		fmt.Fprintf(b, "  port = %v\n", opts.ConnectServicePort)
+	}
+	fmt.Fprintf(b, "  connect {\n    sidecar_service {\n      port = 20000\n")
+	fmt.Fprintf(b, "      proxy {\n        upstreams = [\n")
+	for _, u := range opts.ConnectUpstreams {
+		fmt.Fprintf(b, "          {\n            destination_name = %q\n            local_bind_port = %v\n          },\n",
+			u.DestinationName, u.LocalBindPort)
+	}
+	fmt.Fprintf(b, "        ]\n      }\n    }\n  }\n}")
+
+	return b.String()
+}
+
 var sidecarPatchTemplate = `apiVersion: {{ .PatchTarget.APIVersion }}
 kind: {{ .PatchTarget.Kind }}
 metadata:
@@ -100,7 +315,18 @@ spec:
             - -bind=0.0.0.0
             - -config-dir=/consul/configs
             - -retry-join={{ .Name }}-server.{{ .Namespace }}.svc.cluster.local
+{{- if .Sidecar.AgentTokenSecretName }}
+            - '-hcl=acl { tokens { agent = "$(CONSUL_HTTP_TOKEN)" } }'
+{{- end }}
           env:
+{{- if .Sidecar.AgentTokenSecretName }}
+            - name: CONSUL_HTTP_TOKEN
+              valueFrom:
+                secretKeyRef:
+                  name: {{ .Sidecar.AgentTokenSecretName }}
+                  key: secret_id.txt
+{{- end }}
+{{- if .Data.TLSGeneratorJobEnabled }}
             - name: CONSUL_HTTP_ADDR
               value: https://127.0.0.1:8500
             - name: CONSUL_CACERT
@@ -109,6 +335,10 @@ spec:
               value: /consul/tls/dc1-cli-consul-0.pem
             - name: CONSUL_CLIENT_KEY
               value: /consul/tls/dc1-cli-consul-0-key.pem
+{{- else }}
+            - name: CONSUL_HTTP_ADDR
+              value: http://127.0.0.1:8500
+{{- end }}
           readinessProbe:
             exec:
               command:
@@ -116,19 +346,118 @@ spec:
                 - -ec
                 - |
                   curl \
+{{- if .Data.TLSGeneratorJobEnabled }}
                     --cacert $(CONSUL_CACERT) \
                     --cert $(CONSUL_CLIENT_CERT) \
                     --key $(CONSUL_CLIENT_KEY) \
+{{- end }}
                     $(CONSUL_HTTP_ADDR)/v1/status/leader 2>/dev/null |\
                   grep -E '".+"'
+{{- if or .Sidecar.CPURequest .Sidecar.MemoryRequest .Sidecar.CPULimit .Sidecar.MemoryLimit }}
+          resources:
+{{- if or .Sidecar.CPURequest .Sidecar.MemoryRequest }}
+            requests:
+{{- if .Sidecar.CPURequest }}
+              cpu: "{{ .Sidecar.CPURequest }}"
+{{- end }}
+{{- if .Sidecar.MemoryRequest }}
+              memory: "{{ .Sidecar.MemoryRequest }}"
+{{- end }}
+{{- end }}
+{{- if or .Sidecar.CPULimit .Sidecar.MemoryLimit }}
+            limits:
+{{- if .Sidecar.CPULimit }}
+              cpu: "{{ .Sidecar.CPULimit }}"
+{{- end }}
+{{- if .Sidecar.MemoryLimit }}
+              memory: "{{ .Sidecar.MemoryLimit }}"
+{{- end }}
+{{- end }}
+{{- end }}
           volumeMounts:
             - name: consul-data
               mountPath: /consul/data
             - name: consul-configs
               mountPath: /consul/configs
+{{- if .Data.TLSGeneratorJobEnabled }}
             - name: consul-tls-secret
               mountPath: /consul/tls
+{{- end }}
+{{- if .Sidecar.ConnectEnabled }}
+        - name: consul-connect-envoy
+          image: docker.io/envoyproxy/envoy-alpine:v1.13.1
+          command:
+            - /bin/sh
+            - -ec
+            - |-
+              # Wait for the agent to register the sidecar service, then
+              # bootstrap Envoy from it. This can not happen in an init
+              # container, since the agent sidecar only starts after all
+              # init containers have completed.
+              until /consul/connect/bin/consul connect envoy \
+                  -sidecar-for "{{ .Sidecar.ConnectServiceName }}" \
+                  -bootstrap > /consul/connect/envoy-bootstrap.json; do
+                echo "[INFO] Waiting for {{ .Sidecar.ConnectServiceName }} sidecar service registration."
+                sleep 2
+              done
+
+              exec envoy \
+                --config-path /consul/connect/envoy-bootstrap.json \
+                --disable-hot-restart
+          env:
+{{- if .Sidecar.AgentTokenSecretName }}
+            - name: CONSUL_HTTP_TOKEN
+              valueFrom:
+                secretKeyRef:
+                  name: {{ .Sidecar.AgentTokenSecretName }}
+                  key: secret_id.txt
+{{- end }}
+{{- if .Data.TLSGeneratorJobEnabled }}
+            - name: CONSUL_HTTP_ADDR
+              value: https://127.0.0.1:8500
+            - name: CONSUL_GRPC_ADDR
+              value: https://127.0.0.1:8502
+            - name: CONSUL_CACERT
+              value: /consul/tls/consul-agent-ca.pem
+            - name: CONSUL_CLIENT_CERT
+              value: /consul/tls/dc1-cli-consul-0.pem
+            - name: CONSUL_CLIENT_KEY
+              value: /consul/tls/dc1-cli-consul-0-key.pem
+{{- else }}
+            - name: CONSUL_HTTP_ADDR
+              value: http://127.0.0.1:8500
+            - name: CONSUL_GRPC_ADDR
+              value: 127.0.0.1:8502
+{{- end }}
+          ports:
+            - name: envoy-sidecar
+              containerPort: 20000
+              protocol: "TCP"
+          volumeMounts:
+            - name: consul-connect
+              mountPath: /consul/connect
+{{- if .Data.TLSGeneratorJobEnabled }}
+            - name: consul-tls-secret
+              mountPath: /consul/tls
+{{- end }}
+      initContainers:
+        - name: consul-connect-init
+          image: docker.io/library/consul:1.7.2
+          command:
+            - /bin/sh
+            - -ec
+            - |-
+              mkdir -p /consul/connect/bin
+              cp "$(which consul)" /consul/connect/bin/consul
+          volumeMounts:
+            - name: consul-connect
+              mountPath: /consul/connect
+{{- end }}
       volumes:
+{{- if .Sidecar.ConnectEnabled }}
+        - name: consul-connect
+          emptyDir: {}
+{{- end }}
         - name: consul-data
           emptyDir: {}
         - name: consul-configs
@@ -136,10 +465,19 @@ spec:
             sources:
               - configMap:
                   name: {{ .Name }}-{{ .Namespace }}-agent
+{{- if .Data.GossipKeyGeneratorJobEnabled }}
               - secret:
                   name: {{ .Data.GossipSecretName }}
+{{- end }}
+{{- if .Data.TLSGeneratorJobEnabled }}
               - configMap:
                   name: {{ .Name }}-{{ .Namespace }}-client-tls
+{{- end }}
+{{- if .AgentConfigFiles }}
+              - configMap:
+                  name: {{ .PatchTarget.Name }}-consul-agent
+{{- end }}
+{{- if .Data.TLSGeneratorJobEnabled }}
         - name: consul-tls-secret
           projected:
             sources:
@@ -149,6 +487,66 @@ spec:
                   name: {{ .Data.TLSCLISecretName }}
               - secret:
                   name: {{ .Data.TLSClientSecretName }}
+{{- end }}
+`
+
+var nodeLocalAgentPatchTemplate = `apiVersion: {{ .PatchTarget.APIVersion }}
+kind: {{ .PatchTarget.Kind }}
+metadata:
+  name: {{ .PatchTarget.Name }}
+  namespace: "{{ .PatchTarget.Namespace }}"
+spec:
+  template:
+    spec:
+      containers:
+{{- range .Containers }}
+        - name: {{ . }}
+          env:
+            - name: HOST_IP
+              valueFrom:
+                fieldRef:
+                  fieldPath: status.hostIP
+{{- if $.Sidecar.AgentTokenSecretName }}
+            - name: CONSUL_HTTP_TOKEN
+              valueFrom:
+                secretKeyRef:
+                  name: {{ $.Sidecar.AgentTokenSecretName }}
+                  key: secret_id.txt
+{{- end }}
+{{- if $.Data.TLSGeneratorJobEnabled }}
+            - name: CONSUL_HTTP_ADDR
+              value: https://$(HOST_IP):8500
+            - name: CONSUL_GRPC_ADDR
+              value: https://$(HOST_IP):8502
+            # Client certificates are not issued for node IPs.
+            - name: CONSUL_TLS_SERVER_NAME
+              value: client.dc1.consul
+            - name: CONSUL_CACERT
+              value: /consul/tls/consul-agent-ca.pem
+            - name: CONSUL_CLIENT_CERT
+              value: /consul/tls/dc1-cli-consul-0.pem
+            - name: CONSUL_CLIENT_KEY
+              value: /consul/tls/dc1-cli-consul-0-key.pem
+          volumeMounts:
+            - name: consul-tls-secret
+              mountPath: /consul/tls
+{{- else }}
+            - name: CONSUL_HTTP_ADDR
+              value: http://$(HOST_IP):8500
+            - name: CONSUL_GRPC_ADDR
+              value: $(HOST_IP):8502
+{{- end }}
+{{- end }}
+{{- if .Data.TLSGeneratorJobEnabled }}
+      volumes:
+        - name: consul-tls-secret
+          projected:
+            sources:
+              - secret:
+                  name: {{ .Data.TLSCASecretName }}
+              - secret:
+                  name: {{ .Data.TLSCLISecretName }}
+{{- end }}
 `
 
 var sidecarTLSCMTemplate = `apiVersion: v1
@@ -161,3 +559,15 @@ data:
     cert_file = "/consul/tls/dc1-client-consul-0.pem"
     key_file = "/consul/tls/dc1-client-consul-0-key.pem"
 `
+
+var sidecarAgentCMTemplate = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .PatchTarget.Name }}-consul-agent
+  namespace: {{ .PatchTarget.Namespace }}
+data:
+{{- range $file, $hcl := .AgentConfigFiles }}
+  {{ $file }}: |-
+{{ $hcl }}
+{{- end }}
+`
@@ -0,0 +1,445 @@
+package consul
+
+import (
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const injectedDeployment = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: my-app
+  namespace: example
+  annotations:
+    config.bzub.dev/consul-agent-sidecar-injector: |-
+      metadata:
+        name: my-consul
+        namespace: example
+spec:
+  template:
+    spec:
+      containers:
+        - name: my-app
+          image: my-app
+`
+
+func TestSidecarPatchTLSAndGossip(t *testing.T) {
+	tests := []struct {
+		name   string
+		tls    bool
+		gossip bool
+	}{
+		{"plain", false, false},
+		{"tls", true, false},
+		{"gossip", false, true},
+		{"tls and gossip", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			data := map[string]string{"agent_sidecar_injector_enabled": "true"}
+			if tt.tls {
+				data["tls_generator_job_enabled"] = "true"
+			}
+			if tt.gossip {
+				data["gossip_key_generator_job_enabled"] = "true"
+			}
+			out := runFilter(t, data, injectedDeployment)
+
+			podSpec := lookup(t, findResource(t, out, "Deployment", "my-app"), "spec", "template", "spec")
+			agent := lookup(t, podSpec, "containers", "[name=consul-agent]")
+			if agent == nil {
+				t.Fatal("consul-agent container not injected")
+			}
+
+			wantAddr := "http://127.0.0.1:8500"
+			if tt.tls {
+				wantAddr = "https://127.0.0.1:8500"
+			}
+			if got := value(t, agent, "env", "[name=CONSUL_HTTP_ADDR]", "value"); got != wantAddr {
+				t.Errorf("CONSUL_HTTP_ADDR = %q, want %q", got, wantAddr)
+			}
+			for _, env := range []string{"CONSUL_CACERT", "CONSUL_CLIENT_CERT", "CONSUL_CLIENT_KEY"} {
+				if got := lookup(t, agent, "env", "[name="+env+"]") != nil; got != tt.tls {
+					t.Errorf("%v set %v, want %v", env, got, tt.tls)
+				}
+			}
+
+			hasMount := lookup(t, agent, "volumeMounts", "[name=consul-tls-secret]") != nil
+			hasVolume := lookup(t, podSpec, "volumes", "[name=consul-tls-secret]") != nil
+			if hasMount != tt.tls || hasVolume != tt.tls {
+				t.Errorf("consul-tls-secret mount %v and volume %v, want %v", hasMount, hasVolume, tt.tls)
+			}
+			hasTLSCM := lookupResource(t, out, "ConfigMap", "my-consul-example-client-tls") != nil
+			if hasTLSCM != tt.tls {
+				t.Errorf("client TLS ConfigMap generated %v, want %v", hasTLSCM, tt.tls)
+			}
+
+			sources := map[string]bool{}
+			configs := lookup(t, podSpec, "volumes", "[name=consul-configs]", "projected", "sources")
+			if configs == nil {
+				t.Fatal("consul-configs projected volume missing")
+			}
+			err := configs.VisitElements(func(source *yaml.RNode) error {
+				for _, kind := range []string{"configMap", "secret"} {
+					if name := value(t, source, kind, "name"); name != "" {
+						sources[kind+"/"+name] = true
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for source, want := range map[string]bool{
+				"configMap/my-consul-example-agent":      true,
+				"configMap/my-consul-example-client-tls": tt.tls,
+				"secret/my-consul-example-gossip":        tt.gossip,
+			} {
+				if sources[source] != want {
+					t.Errorf("consul-configs source %v present %v, want %v", source, sources[source], want)
+				}
+			}
+		})
+	}
+}
+
+func TestSidecarACLToken(t *testing.T) {
+	deployment := func(ns, data string) string {
+		return `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: my-app
+  namespace: ` + ns + `
+  annotations:
+    config.bzub.dev/consul-agent-sidecar-injector: |-
+      metadata:
+        name: my-consul
+        namespace: example
+      data:
+` + data + `
+spec:
+  template:
+    spec:
+      containers:
+        - name: my-app
+          image: my-app
+`
+	}
+	rules := func(key string) string {
+		return `        agent_token_secret_name: my-app-consul-token
+        acl_token_rules: |-
+          key_prefix "` + key + `" {
+            policy = "write"
+          }`
+	}
+	data := map[string]string{
+		"agent_sidecar_injector_enabled": "true",
+		"acl_bootstrap_job_enabled":      "true",
+	}
+
+	out := runFilter(t, data, deployment("example", rules("my-app/")))
+
+	jobs := []*yaml.RNode{}
+	for _, r := range out {
+		rMeta, err := r.GetMeta()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rMeta.Kind == "Job" && strings.HasPrefix(rMeta.Name, "my-consul-acl-token-my-app-") {
+			jobs = append(jobs, r)
+		}
+	}
+	if len(jobs) != 1 {
+		t.Fatalf("got %v ACL token Jobs, want 1", len(jobs))
+	}
+	podSpec := lookup(t, jobs[0], "spec", "template", "spec")
+	policy := value(t, podSpec, "initContainers", "[name=consul-acl-token]", "env", "[name=ACL_TOKEN_RULES]", "value")
+	for _, want := range []string{`node_prefix "my-app-"`, `key_prefix "my-app/"`} {
+		if !strings.Contains(policy, want) {
+			t.Errorf("ACL_TOKEN_RULES missing %v:\n%v", want, policy)
+		}
+	}
+	if got := value(t, podSpec, "initContainers", "[name=consul-acl-token]", "env", "[name=CONSUL_HTTP_TOKEN]", "valueFrom", "secretKeyRef", "name"); got != "my-consul-example-acl" {
+		t.Errorf("Job uses token from %v, want the bootstrap token", got)
+	}
+	if got := value(t, podSpec, "containers", "[name=secret-create]", "env", "[name=SECRET_NAME]", "value"); got != "my-app-consul-token" {
+		t.Errorf("Job creates Secret %v, want my-app-consul-token", got)
+	}
+	role := findResource(t, out, "Role", "my-consul-acl-token-my-app")
+	if !strings.Contains(role.MustString(), "- my-app-consul-token") {
+		t.Errorf("Role does not allow reading the token Secret")
+	}
+
+	// A policy change replaces the Job.
+	jobMeta, err := jobs[0].GetMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := []string{}
+	for _, r := range out {
+		rMeta, err := r.GetMeta()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rMeta.Kind == "Deployment" || (rMeta.Kind == "ConfigMap" && rMeta.Name == "my-consul") {
+			continue
+		}
+		items = append(items, r.MustString())
+	}
+	items = append(items, deployment("example", rules("my-app/v2/")))
+	out = runFilter(t, data, items...)
+	count := 0
+	for _, r := range out {
+		rMeta, err := r.GetMeta()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rMeta.Kind == "Job" && strings.HasPrefix(rMeta.Name, "my-consul-acl-token-my-app-") {
+			count++
+			if rMeta.Name == jobMeta.Name {
+				t.Errorf("Job %v for the previous policy was kept", rMeta.Name)
+			}
+		}
+	}
+	if count != 1 {
+		t.Errorf("got %v ACL token Jobs after a policy change, want 1", count)
+	}
+
+	errTests := []struct {
+		name string
+		data map[string]string
+		item string
+		want string
+	}{
+		{
+			"acl disabled",
+			map[string]string{"agent_sidecar_injector_enabled": "true"},
+			deployment("example", rules("my-app/")),
+			"acl_token_rules requires acl_bootstrap_job_enabled.",
+		},
+		{
+			"no secret name",
+			data,
+			deployment("example", "        acl_token_rules: x"),
+			"acl_token_rules requires agent_token_secret_name.",
+		},
+		{
+			"other namespace",
+			data,
+			deployment("other", rules("my-app/")),
+			"acl_token_rules requires Deployment my-app to be in the example namespace.",
+		},
+	}
+	for _, tt := range errTests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newFunction(t, tt.data)
+			_, err := f.Filter([]*yaml.RNode{yaml.MustParse(tt.item)})
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("got error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSidecarAgentOptions(t *testing.T) {
+	deployment := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: my-app
+  namespace: example
+  annotations:
+    config.bzub.dev/consul-agent-sidecar-injector: |-
+      metadata:
+        name: my-consul
+        namespace: example
+      data:
+        services: |-
+          service {
+            name = "my-app"
+            port = 8080
+          }
+        checks: |-
+          check {
+            id = "disk"
+            args = ["df"]
+            interval = "30s"
+          }
+        extra_hcl: |-
+          log_level = "debug"
+        cpu_request: 50m
+        memory_limit: 128Mi
+spec:
+  template:
+    spec:
+      containers:
+        - name: my-app
+          image: my-app
+`
+	out := runFilter(t, map[string]string{"agent_sidecar_injector_enabled": "true"}, deployment)
+
+	cm := findResource(t, out, "ConfigMap", "my-app-consul-agent")
+	for file, want := range map[string]string{
+		"10-services.hcl": "service {\n  name = \"my-app\"\n  port = 8080\n}",
+		"10-checks.hcl":   "check {\n  id = \"disk\"\n  args = [\"df\"]\n  interval = \"30s\"\n}",
+		"90-extra.hcl":    `log_level = "debug"`,
+	} {
+		if got := value(t, cm, "data", file); got != want {
+			t.Errorf("%v = %q, want %q", file, got, want)
+		}
+	}
+
+	podSpec := lookup(t, findResource(t, out, "Deployment", "my-app"), "spec", "template", "spec")
+	agent := lookup(t, podSpec, "containers", "[name=consul-agent]")
+	resources := map[string]string{
+		"requests.cpu":    value(t, agent, "resources", "requests", "cpu"),
+		"requests.memory": value(t, agent, "resources", "requests", "memory"),
+		"limits.cpu":      value(t, agent, "resources", "limits", "cpu"),
+		"limits.memory":   value(t, agent, "resources", "limits", "memory"),
+	}
+	for key, want := range map[string]string{
+		"requests.cpu":    "50m",
+		"requests.memory": "",
+		"limits.cpu":      "",
+		"limits.memory":   "128Mi",
+	} {
+		if resources[key] != want {
+			t.Errorf("consul-agent resources %v = %q, want %q", key, resources[key], want)
+		}
+	}
+
+	configs := lookup(t, podSpec, "volumes", "[name=consul-configs]")
+	if !strings.Contains(configs.MustString(), "name: my-app-consul-agent\n") {
+		t.Errorf("consul-configs does not project the workload's agent ConfigMap:\n%v", configs.MustString())
+	}
+}
+
+func TestSidecarWithoutAgentOptions(t *testing.T) {
+	out := runFilter(t, map[string]string{"agent_sidecar_injector_enabled": "true"}, injectedDeployment)
+
+	if lookupResource(t, out, "ConfigMap", "my-app-consul-agent") != nil {
+		t.Error("agent ConfigMap generated without agent configuration")
+	}
+	agent := lookup(t, findResource(t, out, "Deployment", "my-app"),
+		"spec", "template", "spec", "containers", "[name=consul-agent]")
+	if lookup(t, agent, "resources") != nil {
+		t.Error("consul-agent resources set without resource options")
+	}
+}
+
+// connectDeployment returns a Deployment with Connect enabled through the
+// injector annotation, plus the given annotation data lines.
+func connectDeployment(data string) string {
+	return `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: my-app
+  namespace: example
+  annotations:
+    config.bzub.dev/consul-agent-sidecar-injector: |-
+      metadata:
+        name: my-consul
+        namespace: example
+      data:
+        connect_enabled: "true"
+` + data + `
+spec:
+  template:
+    spec:
+      containers:
+        - name: my-app
+          image: my-app
+`
+}
+
+func TestSidecarConnect(t *testing.T) {
+	data := map[string]string{"agent_sidecar_injector_enabled": "true"}
+	out := runFilter(t, data, connectDeployment(`        connect_service_name: my-app
+        connect_service_port: "8080"
+        connect_upstreams: db:5432, cache:6379`))
+
+	hcl := value(t, findResource(t, out, "ConfigMap", "my-app-consul-agent"), "data", "20-connect.hcl")
+	for _, want := range []string{
+		"grpc = 8502",
+		`name = "my-app"`,
+		"port = 8080",
+		"sidecar_service {\n      port = 20000",
+		"destination_name = \"db\"\n            local_bind_port = 5432",
+		"destination_name = \"cache\"\n            local_bind_port = 6379",
+	} {
+		if !strings.Contains(hcl, want) {
+			t.Errorf("20-connect.hcl missing %q:\n%v", want, hcl)
+		}
+	}
+
+	podSpec := lookup(t, findResource(t, out, "Deployment", "my-app"), "spec", "template", "spec")
+	envoy := lookup(t, podSpec, "containers", "[name=consul-connect-envoy]")
+	if envoy == nil {
+		t.Fatal("consul-connect-envoy container not injected")
+	}
+	command := lookup(t, envoy, "command")
+	script := command.Content()[len(command.Content())-1].Value
+	for _, want := range []string{`-sidecar-for "my-app"`, "-bootstrap", "exec envoy"} {
+		if !strings.Contains(script, want) {
+			t.Errorf("envoy command missing %v:\n%v", want, script)
+		}
+	}
+	if got := value(t, envoy, "ports", "[name=envoy-sidecar]", "containerPort"); got != "20000" {
+		t.Errorf("envoy-sidecar port = %v, want 20000", got)
+	}
+	if got := value(t, envoy, "env", "[name=CONSUL_GRPC_ADDR]", "value"); got != "127.0.0.1:8502" {
+		t.Errorf("CONSUL_GRPC_ADDR = %v, want 127.0.0.1:8502", got)
+	}
+	if lookup(t, podSpec, "initContainers", "[name=consul-connect-init]") == nil {
+		t.Error("consul-connect-init container not injected")
+	}
+	if lookup(t, podSpec, "volumes", "[name=consul-connect]") == nil {
+		t.Error("consul-connect volume missing")
+	}
+}
+
+func TestSidecarConnectErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want string
+	}{
+		{
+			"missing service name",
+			`        connect_service_port: "8080"`,
+			"connect_service_name is required when connect_enabled is true.",
+		},
+		{
+			"non-numeric port",
+			`        connect_service_name: my-app
+        connect_service_port: http`,
+			`invalid connect_service_port: strconv.Atoi: parsing "http": invalid syntax`,
+		},
+		{
+			"port out of range",
+			`        connect_service_name: my-app
+        connect_service_port: "70000"`,
+			"invalid connect_service_port 70000, must be between 1 and 65535.",
+		},
+		{
+			"invalid upstream",
+			`        connect_service_name: my-app
+        connect_upstreams: db`,
+			`invalid connect upstream "db", expected destination_name:local_bind_port.`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			in, err := yaml.Parse(connectDeployment(tt.data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			f := newFunction(t, map[string]string{"agent_sidecar_injector_enabled": "true"})
+			_, err = f.Filter([]*yaml.RNode{in})
+			if err == nil || err.Error() != tt.want {
+				t.Errorf("got error %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
@@ -1,5 +1,11 @@
 package consul
 
+import (
+	"fmt"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
 func tlsTemplates() map[string]string {
 	return map[string]string{
 		"tls-job":         tlsJobTemplate,
@@ -9,6 +15,71 @@ func tlsTemplates() map[string]string {
 	}
 }
 
+// tlsRotationTarget holds information used to let the TLS rotation CronJob
+// update sidecar workloads in another namespace.
+type tlsRotationTarget struct {
+	// TargetNamespace is the namespace of the sidecar workloads.
+	TargetNamespace string
+
+	// ConfigFunction contains the Consul instance information.
+	*ConfigFunction
+}
+
+func tlsRotationTargetTemplates() map[string]string {
+	return map[string]string{
+		"tls-rotation-target-role":        tlsRotationTargetRoleTemplate,
+		"tls-rotation-target-rolebinding": tlsRotationTargetRoleBindingTemplate,
+	}
+}
+
+func tlsRotationCronJobTemplates() map[string]string {
+	return map[string]string{
+		"tls-rotation-cronjob":     tlsRotationCronJobTemplate,
+		"tls-rotation-sa":          tlsRotationSATemplate,
+		"tls-rotation-role":        tlsRotationRoleTemplate,
+		"tls-rotation-rolebinding": tlsRotationRoleBindingTemplate,
+	}
+}
+
+// syncCfsslCA sets TLSCASourceSecretName to TLSExternalCASecretName, or to
+// the Secret of the cfssl instance named by TLSCfsslInstance. The instance's
+// `secret_name` is used if its function config is found in the input.
+func (f *ConfigFunction) syncCfsslCA(in []*yaml.RNode) error {
+	f.Data.TLSCASourceSecretName = f.Data.TLSExternalCASecretName
+	if f.Data.TLSCfsslInstance == "" {
+		return nil
+	}
+	if f.Data.TLSExternalCASecretName != "" {
+		return fmt.Errorf("tls_cfssl_instance and tls_external_ca_secret_name are mutually exclusive.")
+	}
+
+	// Default cfssl Secret name.
+	f.Data.TLSCASourceSecretName = f.Data.TLSCfsslInstance + "-" + f.Namespace
+
+	for _, r := range in {
+		rMeta, err := r.GetMeta()
+		if err != nil {
+			return err
+		}
+
+		if rMeta.Kind != "ConfigMap" ||
+			rMeta.Name != f.Data.TLSCfsslInstance ||
+			rMeta.Namespace != f.Namespace {
+			continue
+		}
+
+		secretName, err := r.Pipe(yaml.Lookup("data", "secret_name"))
+		if err != nil {
+			return err
+		}
+		if secretName != nil && secretName.Document().Value != "" {
+			f.Data.TLSCASourceSecretName = secretName.Document().Value
+		}
+	}
+
+	return nil
+}
+
 var tlsJobTemplate = `apiVersion: batch/v1
 kind: Job
 metadata:
@@ -31,7 +102,12 @@ spec:
             - |-
               tls_dir=/tls/generated
               cd "${tls_dir}"
+{{- if .Data.TLSCASourceSecretName }}
+              cp "/tls/ca/{{ .Data.TLSExternalCACertFile }}" consul-agent-ca.pem
+              cp "/tls/ca/{{ .Data.TLSExternalCAKeyFile }}" consul-agent-ca-key.pem
+{{- else }}
               consul tls ca create
+{{- end }}
               consul tls cert create -cli
               consul tls cert create -client
               for i in $(seq 3); do
@@ -39,9 +115,16 @@ spec:
                   -additional-dnsname "{{ .Name }}-server.{{ .Namespace }}" \
                   -additional-dnsname "{{ .Name }}-server.{{ .Namespace }}.svc"
               done
+{{- if .Data.TLSCASourceSecretName }}
+              rm consul-agent-ca-key.pem
+{{- end }}
           volumeMounts:
             - mountPath: /tls/generated
               name: tls-generated
+{{- if .Data.TLSCASourceSecretName }}
+            - mountPath: /tls/ca
+              name: tls-ca
+{{- end }}
       containers:
         - name: create-tls-secret
           image: k8s.gcr.io/hyperkube:v1.17.4
@@ -76,6 +159,11 @@ spec:
       volumes:
         - name: tls-generated
           emptyDir: {}
+{{- if .Data.TLSCASourceSecretName }}
+        - name: tls-ca
+          secret:
+            secretName: {{ .Data.TLSCASourceSecretName }}
+{{- end }}
 `
 
 // RBAC
@@ -124,3 +212,300 @@ subjects:
   - kind: ServiceAccount
     name: {{ .Name }}-tls
 `
+
+var tlsRotationCronJobTemplate = `apiVersion: batch/v1beta1
+kind: CronJob
+metadata:
+  name: {{ .Name }}-tls-rotation
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+spec:
+  schedule: "{{ .Data.TLSRotationSchedule }}"
+  concurrencyPolicy: Forbid
+  jobTemplate:
+    metadata:
+      labels:
+        app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+        app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+    spec:
+      template:
+        metadata:
+          labels:
+            app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+            app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+        spec:
+          serviceAccountName: {{ .Name }}-tls-rotation
+          restartPolicy: OnFailure
+          initContainers:
+            - name: check-tls-expiry
+              image: docker.io/jitesoft/cfssl:828c23c
+              command:
+                - /bin/sh
+                - -ec
+                - |-
+                  threshold="$(( $(date -u +%s) + ${tls_rotation_threshold_days} * 86400 ))"
+
+                  for cert in /tls/current/dc1-*.pem; do
+                    case "${cert}" in *-key.pem) continue;; esac
+
+                    not_after="$(\
+                      cfssl certinfo -cert "${cert}" |\
+                        grep '"not_after"' | cut -d '"' -f 4 \
+                    )"
+                    expiry="$(date -u -D '%Y-%m-%dT%H:%M:%SZ' -d "${not_after}" +%s)"
+
+                    if [ "${expiry}" -lt "${threshold}" ]; then
+                      echo "[INFO] ${cert##*/} expires ${not_after}."
+                      touch /tls/generated/renew
+                    fi
+                  done
+              envFrom:
+                - configMapRef:
+                    name: {{ .Name }}
+              volumeMounts:
+                - mountPath: /tls/current
+                  name: tls-current
+                - mountPath: /tls/generated
+                  name: tls-generated
+            - name: renew-tls
+              image: docker.io/library/consul:1.7.2
+              command:
+                - /bin/sh
+                - -ec
+                - |-
+                  tls_dir=/tls/generated
+                  cd "${tls_dir}"
+                  [ -f renew ] || exit 0
+                  rm renew
+
+{{- if .Data.TLSCASourceSecretName }}
+                  cp "/tls/ca/{{ .Data.TLSExternalCACertFile }}" consul-agent-ca.pem
+                  cp "/tls/ca/{{ .Data.TLSExternalCAKeyFile }}" consul-agent-ca-key.pem
+{{- else }}
+                  # The CA Secret is shared with agents, so a generated CA's
+                  # key is only kept in the server Secret.
+                  cp /tls/ca/consul-agent-ca.pem .
+                  cp /tls/current/consul-agent-ca-key.pem .
+{{- end }}
+                  consul tls cert create -cli
+                  consul tls cert create -client
+                  for i in $(seq 3); do
+                    consul tls cert create -server \
+                      -additional-dnsname "{{ .Name }}-server.{{ .Namespace }}" \
+                      -additional-dnsname "{{ .Name }}-server.{{ .Namespace }}.svc"
+                  done
+{{- if .Data.TLSCASourceSecretName }}
+                  rm consul-agent-ca-key.pem
+{{- end }}
+              volumeMounts:
+                - mountPath: /tls/current
+                  name: tls-current
+                - mountPath: /tls/generated
+                  name: tls-generated
+                - mountPath: /tls/ca
+                  name: tls-ca
+          containers:
+            - name: update-tls-secrets
+              image: k8s.gcr.io/hyperkube:v1.17.4
+              command:
+                - /bin/sh
+                - -ec
+                - |-
+                  tls_dir="/tls/generated"
+                  if [ ! -f "${tls_dir}/consul-agent-ca.pem" ]; then
+                    echo "[INFO] No certificates are due for renewal."
+                    exit 0
+                  fi
+
+                  secret="$(tls_server_secret_name)"
+                  kubectl create secret generic "${secret}" "--from-file=${tls_dir}" \
+                    --dry-run -o yaml |\
+                    kubectl replace -f -
+
+                  secret="$(tls_cli_secret_name)"
+                  kubectl create secret generic "${secret}" \
+                    "--from-file=${tls_dir}/dc1-cli-consul-0.pem" \
+                    "--from-file=${tls_dir}/dc1-cli-consul-0-key.pem" \
+                    --dry-run -o yaml |\
+                    kubectl replace -f -
+
+                  secret="$(tls_client_secret_name)"
+                  kubectl create secret generic "${secret}" \
+                    "--from-file=${tls_dir}/dc1-client-consul-0.pem" \
+                    "--from-file=${tls_dir}/dc1-client-consul-0-key.pem" \
+                    --dry-run -o yaml |\
+                    kubectl replace -f -
+
+                  echo "[INFO] Restarting Consul servers."
+                  kubectl rollout restart statefulset/{{ .Name }}-server
+                  kubectl rollout status statefulset/{{ .Name }}-server
+{{- if .Data.ClientDaemonSetEnabled }}
+
+                  echo "[INFO] Restarting Consul client agents."
+                  kubectl rollout restart daemonset/{{ .Name }}-client
+{{- end }}
+{{- range .SidecarNamespaces }}
+
+                  # Sidecars in other namespaces use copies of the Secrets.
+                  echo "[INFO] Updating agent certificates in the {{ . }} namespace."
+                  kubectl create secret generic "$(tls_cli_secret_name)" \
+                    "--from-file=${tls_dir}/dc1-cli-consul-0.pem" \
+                    "--from-file=${tls_dir}/dc1-cli-consul-0-key.pem" \
+                    --dry-run -o yaml |\
+                    kubectl -n "{{ . }}" replace -f -
+                  kubectl create secret generic "$(tls_client_secret_name)" \
+                    "--from-file=${tls_dir}/dc1-client-consul-0.pem" \
+                    "--from-file=${tls_dir}/dc1-client-consul-0-key.pem" \
+                    --dry-run -o yaml |\
+                    kubectl -n "{{ . }}" replace -f -
+{{- end }}
+{{- range .SidecarWorkloads }}
+
+                  echo "[INFO] Restarting {{ .Kind }} {{ .Namespace }}/{{ .Name }} for its Consul agent sidecar."
+                  kubectl -n "{{ .Namespace }}" rollout restart "{{ .Kind }}/{{ .Name }}"
+{{- end }}
+              envFrom:
+                - configMapRef:
+                    name: {{ .Name }}
+              volumeMounts:
+                - mountPath: /tls/generated
+                  name: tls-generated
+          volumes:
+            - name: tls-current
+              secret:
+                secretName: {{ .Data.TLSServerSecretName }}
+            - name: tls-generated
+              emptyDir: {}
+            - name: tls-ca
+              secret:
+{{- if .Data.TLSCASourceSecretName }}
+                secretName: {{ .Data.TLSCASourceSecretName }}
+{{- else }}
+                secretName: {{ .Data.TLSCASecretName }}
+{{- end }}
+`
+
+var tlsRotationSATemplate = `apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: {{ .Name }}-tls-rotation
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+`
+
+var tlsRotationRoleTemplate = `apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: {{ .Name }}-tls-rotation
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+rules:
+  - apiGroups:
+      - ""
+    resources:
+      - secrets
+    verbs:
+      - get
+      - update
+    resourceNames:
+      - {{ .Data.TLSServerSecretName }}
+      - {{ .Data.TLSCLISecretName }}
+      - {{ .Data.TLSClientSecretName }}
+  - apiGroups:
+      - apps
+    resources:
+      - statefulsets
+      - daemonsets
+      - deployments
+    verbs:
+      - get
+      - patch
+      - watch
+    resourceNames:
+      - {{ .Name }}-server
+{{- if .Data.ClientDaemonSetEnabled }}
+      - {{ .Name }}-client
+{{- end }}
+{{- range .SidecarWorkloads }}
+{{- if eq .Namespace $.Namespace }}
+      - {{ .Name }}
+{{- end }}
+{{- end }}
+`
+
+var tlsRotationRoleBindingTemplate = `apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: {{ .Name }}-tls-rotation
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: Role
+  name: {{ .Name }}-tls-rotation
+subjects:
+  - kind: ServiceAccount
+    name: {{ .Name }}-tls-rotation
+`
+
+var tlsRotationTargetRoleTemplate = `apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: {{ .Name }}-{{ .Namespace }}-tls-rotation
+  namespace: "{{ .TargetNamespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+rules:
+  - apiGroups:
+      - ""
+    resources:
+      - secrets
+    verbs:
+      - get
+      - update
+    resourceNames:
+      - {{ .Data.TLSCLISecretName }}
+      - {{ .Data.TLSClientSecretName }}
+  - apiGroups:
+      - apps
+    resources:
+      - statefulsets
+      - daemonsets
+      - deployments
+    verbs:
+      - get
+      - patch
+    resourceNames:
+{{- range .SidecarWorkloads }}
+{{- if eq .Namespace $.TargetNamespace }}
+      - {{ .Name }}
+{{- end }}
+{{- end }}
+`
+
+var tlsRotationTargetRoleBindingTemplate = `apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: {{ .Name }}-{{ .Namespace }}-tls-rotation
+  namespace: "{{ .TargetNamespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: Role
+  name: {{ .Name }}-{{ .Namespace }}-tls-rotation
+subjects:
+  - kind: ServiceAccount
+    name: {{ .Name }}-tls-rotation
+    namespace: "{{ .Namespace }}"
+`
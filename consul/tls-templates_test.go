@@ -0,0 +1,142 @@
+package consul
+
+import (
+	"strings"
+	"testing"
+)
+
+// sidecarWorkload returns a workload annotated for sidecar injection with the
+// given namespace and annotation data.
+func sidecarWorkload(kind, name, ns, data string) string {
+	return `apiVersion: apps/v1
+kind: ` + kind + `
+metadata:
+  name: ` + name + `
+  namespace: ` + ns + `
+  annotations:
+    config.bzub.dev/consul-agent-sidecar-injector: |-
+      metadata:
+        name: my-consul
+        namespace: example
+      data:
+        ` + data + `
+spec:
+  template:
+    spec:
+      containers:
+        - name: ` + name + `
+          image: ` + name + `
+`
+}
+
+func TestTLSRotationRestarts(t *testing.T) {
+	data := map[string]string{
+		"tls_generator_job_enabled":      "true",
+		"tls_rotation_cron_job_enabled":  "true",
+		"client_daemonset_enabled":       "true",
+		"client_host_port_enabled":       "true",
+		"agent_sidecar_injector_enabled": "true",
+	}
+	out := runFilter(t, data,
+		sidecarWorkload("Deployment", "my-app", "example", `cpu_request: 50m`),
+		sidecarWorkload("StatefulSet", "my-db", "example", `cpu_request: 50m`),
+		sidecarWorkload("Deployment", "my-local-app", "example", `node_local_agent: "true"
+        containers: my-local-app`),
+		sidecarWorkload("Deployment", "my-other-app", "other", `cpu_request: 50m`),
+	)
+
+	cronJob := findResource(t, out, "CronJob", "my-consul-tls-rotation")
+	command := lookup(t, cronJob, "spec", "jobTemplate", "spec", "template", "spec",
+		"containers", "[name=update-tls-secrets]", "command")
+	if command == nil {
+		t.Fatal("update-tls-secrets has no command")
+	}
+	script := command.Content()[len(command.Content())-1].Value
+	role := findResource(t, out, "Role", "my-consul-tls-rotation").MustString()
+
+	for _, want := range []string{
+		"kubectl rollout restart statefulset/my-consul-server",
+		"kubectl rollout restart daemonset/my-consul-client",
+		`kubectl -n "example" rollout restart "Deployment/my-app"`,
+		`kubectl -n "example" rollout restart "StatefulSet/my-db"`,
+		`kubectl -n "other" rollout restart "Deployment/my-other-app"`,
+		`kubectl -n "other" replace -f -`,
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("rotation script missing %v", want)
+		}
+	}
+	if strings.Contains(script, "my-local-app") {
+		t.Error("rotation script restarts the node-local agent workload my-local-app")
+	}
+	if strings.Contains(script, `-n "example" replace`) {
+		t.Error("rotation script copies Secrets into the Consul namespace")
+	}
+	for _, name := range []string{"my-consul-server", "my-consul-client", "my-app", "my-db"} {
+		if !strings.Contains(role, "- "+name+"\n") {
+			t.Errorf("Role does not allow restarting %v", name)
+		}
+	}
+	if strings.Contains(role, "my-other-app") {
+		t.Error("Consul namespace Role names a workload in another namespace")
+	}
+
+	// The CronJob's ServiceAccount may update the other namespace.
+	otherRole, binding := "", false
+	for _, r := range out {
+		rMeta, err := r.GetMeta()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rMeta.Namespace != "other" {
+			continue
+		}
+		switch {
+		case rMeta.Kind == "Role" && rMeta.Name == "my-consul-example-tls-rotation":
+			otherRole = r.MustString()
+		case rMeta.Kind == "RoleBinding" && rMeta.Name == "my-consul-example-tls-rotation":
+			binding = true
+			if got := value(t, r, "subjects", "[name=my-consul-tls-rotation]", "namespace"); got != "example" {
+				t.Errorf("RoleBinding subject namespace %q, want example", got)
+			}
+		}
+	}
+	if !binding {
+		t.Error("no RoleBinding in the other namespace")
+	}
+	for _, name := range []string{"my-other-app", "my-consul-example-tls-cli", "my-consul-example-tls-client"} {
+		if !strings.Contains(otherRole, "- "+name+"\n") {
+			t.Errorf("other namespace Role does not name %v:\n%v", name, otherRole)
+		}
+	}
+	if strings.Contains(otherRole, "- my-app\n") {
+		t.Error("other namespace Role names a workload in the Consul namespace")
+	}
+}
+
+func TestTLSRotationCASource(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     map[string]string
+		caSecret string
+	}{
+		{"generated", map[string]string{}, "my-consul-example-tls-ca"},
+		{"external", map[string]string{"tls_external_ca_secret_name": "my-ca"}, "my-ca"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.data["tls_generator_job_enabled"] = "true"
+			tt.data["tls_rotation_cron_job_enabled"] = "true"
+			out := runFilter(t, tt.data)
+
+			podSpec := lookup(t, findResource(t, out, "CronJob", "my-consul-tls-rotation"),
+				"spec", "jobTemplate", "spec", "template", "spec")
+			if got := value(t, podSpec, "volumes", "[name=tls-ca]", "secret", "secretName"); got != tt.caSecret {
+				t.Errorf("CA read from %v, want %v", got, tt.caSecret)
+			}
+			if got := value(t, podSpec, "initContainers", "[name=renew-tls]", "volumeMounts", "[name=tls-ca]", "mountPath"); got != "/tls/ca" {
+				t.Errorf("renew-tls mounts the CA at %q, want /tls/ca", got)
+			}
+		})
+	}
+}
@@ -1,7 +1,7 @@
 package prometheus
 
 import (
-	"strings"
+	"fmt"
 
 	"github.com/bzub/config-functions/cfunc"
 	"sigs.k8s.io/kustomize/kyaml/yaml"
@@ -9,6 +9,11 @@ import (
 
 const ScrapeConfigsAnnotation = "config.bzub.dev/prometheus-scrape_configs"
 
+// ScrapeSecretsAnnotation lists Secrets to mount into the Prometheus server,
+// such as the certificates and tokens referenced by a scrape config. Its value
+// is a list of ScrapeSecretVolumes.
+const ScrapeSecretsAnnotation = "config.bzub.dev/prometheus-scrape_secrets"
+
 const DefaultAppNameAnnotationValue = "prometheus-server"
 
 const functionCMTemplate = `apiVersion: v1
@@ -39,6 +44,24 @@ type Options struct {
 	//
 	// https://prometheus.io/docs/prometheus/latest/configuration/configuration/#scrape_config
 	ScrapeConfigs []string
+
+	// ScrapeSecretVolumes are Secret volumes mounted into the Prometheus
+	// server. These are collected from input Resource annotations.
+	ScrapeSecretVolumes []ScrapeSecretVolume
+}
+
+// ScrapeSecretVolume is a projected volume of Secrets mounted into the
+// Prometheus server, declared with ScrapeSecretsAnnotation. The Secrets must be
+// in the namespace of the Prometheus server.
+type ScrapeSecretVolume struct {
+	// Name is the name of the volume.
+	Name string `yaml:"name"`
+
+	// MountPath is the directory the Secrets are mounted at.
+	MountPath string `yaml:"mountPath"`
+
+	// Secrets are the names of the Secrets projected into the volume.
+	Secrets []string `yaml:"secrets"`
 }
 
 // Filter generates Resources.
@@ -84,9 +107,15 @@ func (f *ConfigFunction) syncData(in []*yaml.RNode) error {
 		return err
 	}
 
+	scrapeSecretVolumes, err := f.getScrapeSecretVolumes(in)
+	if err != nil {
+		return err
+	}
+
 	// Set defaults.
 	f.Data = Options{
-		ScrapeConfigs: scrapeConfigs,
+		ScrapeConfigs:       scrapeConfigs,
+		ScrapeSecretVolumes: scrapeSecretVolumes,
 	}
 
 	// Populate function data from config.
@@ -128,18 +157,51 @@ func (f *ConfigFunction) getScrapeConfigs(in []*yaml.RNode) ([]string, error) {
 	return scrapeConfigs, nil
 }
 
-// indents a block of text with an indent string
-func Indent(text, indent string) string {
-	if text[len(text)-1:] == "\n" {
-		result := ""
-		for _, j := range strings.Split(text[:len(text)-1], "\n") {
-			result += indent + j + "\n"
-		}
-		return result
+func (f *ConfigFunction) getScrapeSecretVolumes(in []*yaml.RNode) ([]ScrapeSecretVolume, error) {
+	fnMeta, err := f.RW.FunctionConfig.GetMeta()
+	if err != nil {
+		return nil, err
 	}
-	result := ""
-	for _, j := range strings.Split(strings.TrimRight(text, "\n"), "\n") {
-		result += indent + j + "\n"
+
+	volumes := []ScrapeSecretVolume{}
+	names := map[string]bool{}
+	for _, r := range in {
+		rMeta, err := r.GetMeta()
+		if err != nil {
+			return nil, err
+		}
+		if rMeta.Namespace != fnMeta.Namespace {
+			continue
+		}
+
+		secrets, err := r.Pipe(yaml.GetAnnotation(ScrapeSecretsAnnotation))
+		if err != nil {
+			return nil, err
+		}
+		if secrets == nil {
+			continue
+		}
+
+		rVolumes := []ScrapeSecretVolume{}
+		if err := yaml.Unmarshal([]byte(secrets.Document().Value), &rVolumes); err != nil {
+			return nil, fmt.Errorf("invalid %v annotation on %v %v: %v", ScrapeSecretsAnnotation, rMeta.Kind, rMeta.Name, err)
+		}
+		for _, v := range rVolumes {
+			switch {
+			case v.Name == "" || v.MountPath == "" || len(v.Secrets) == 0:
+				return nil, fmt.Errorf("%v annotation on %v %v requires name, mountPath and secrets.", ScrapeSecretsAnnotation, rMeta.Kind, rMeta.Name)
+			case names[v.Name]:
+				return nil, fmt.Errorf("scrape Secret volume %v is defined more than once.", v.Name)
+			}
+			names[v.Name] = true
+			volumes = append(volumes, v)
+		}
 	}
-	return result[:len(result)-1]
+
+	return volumes, nil
+}
+
+// indents a block of text with an indent string
+func Indent(text, indent string) string {
+	return cfunc.Indent(text, indent)
 }
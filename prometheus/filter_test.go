@@ -0,0 +1,119 @@
+package prometheus
+
+import (
+	"strings"
+	"testing"
+
+	"sigs.k8s.io/kustomize/kyaml/kio"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const scrapedService = `apiVersion: v1
+kind: Service
+metadata:
+  name: my-consul-server
+  namespace: example
+  annotations:
+    config.bzub.dev/prometheus-scrape_secrets: |-
+      - name: consul-tls
+        mountPath: /etc/prometheus/consul/tls
+        secrets:
+          - my-consul-tls-ca
+          - my-consul-tls-cli
+`
+
+func runFilter(items ...string) ([]*yaml.RNode, error) {
+	in := []*yaml.RNode{}
+	for _, item := range items {
+		in = append(in, yaml.MustParse(item))
+	}
+
+	f := &ConfigFunction{}
+	f.RW = &kio.ByteReadWriter{FunctionConfig: yaml.MustParse(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: my-prometheus
+  namespace: example
+`)}
+	return f.Filter(in)
+}
+
+func TestFilterScrapeSecrets(t *testing.T) {
+	out, err := runFilter(scrapedService)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var podSpec *yaml.RNode
+	for _, r := range out {
+		rMeta, err := r.GetMeta()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rMeta.Kind == "StatefulSet" && rMeta.Name == "my-prometheus-server" {
+			podSpec, err = r.Pipe(yaml.Lookup("spec", "template", "spec"))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if podSpec == nil {
+		t.Fatal("StatefulSet my-prometheus-server not found")
+	}
+
+	mountPath, err := podSpec.Pipe(yaml.Lookup("containers", "[name=prometheus]", "volumeMounts", "[name=consul-tls]", "mountPath"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mountPath == nil || mountPath.YNode().Value != "/etc/prometheus/consul/tls" {
+		t.Errorf("consul-tls not mounted at /etc/prometheus/consul/tls")
+	}
+
+	sources, err := podSpec.Pipe(yaml.Lookup("volumes", "[name=consul-tls]", "projected", "sources"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sources == nil {
+		t.Fatal("consul-tls volume not found")
+	}
+	got := []string{}
+	for _, source := range sources.YNode().Content {
+		name, err := yaml.NewRNode(source).Pipe(yaml.Lookup("secret", "name"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name != nil {
+			got = append(got, name.YNode().Value)
+		}
+	}
+	if strings.Join(got, ",") != "my-consul-tls-ca,my-consul-tls-cli" {
+		t.Errorf("consul-tls projects Secrets %v", got)
+	}
+}
+
+func TestFilterScrapeSecretsInvalid(t *testing.T) {
+	tests := map[string]string{
+		"missing secrets": `apiVersion: v1
+kind: Service
+metadata:
+  name: my-service
+  namespace: example
+  annotations:
+    config.bzub.dev/prometheus-scrape_secrets: |-
+      - name: my-service-tls
+        mountPath: /etc/prometheus/my-service
+`,
+		"duplicate name": strings.Replace(scrapedService, "my-consul-server", "my-other-service", 1),
+	}
+	for name, item := range tests {
+		t.Run(name, func(t *testing.T) {
+			items := []string{item}
+			if name == "duplicate name" {
+				items = append(items, scrapedService)
+			}
+			if _, err := runFilter(items...); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
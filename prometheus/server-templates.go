@@ -74,6 +74,11 @@ spec:
               mountPath: /prometheus/data
             - name: config
               mountPath: /prometheus/config
+{{- range .Data.ScrapeSecretVolumes }}
+            - name: {{ .Name }}
+              mountPath: {{ .MountPath }}
+              readOnly: true
+{{- end }}
           livenessProbe:
             httpGet:
               port: web
@@ -91,6 +96,15 @@ spec:
             sources:
               - configMap:
                   name: {{ .Name }}-server
+{{- range .Data.ScrapeSecretVolumes }}
+        - name: {{ .Name }}
+          projected:
+            sources:
+{{- range .Secrets }}
+              - secret:
+                  name: {{ . }}
+{{- end }}
+{{- end }}
       securityContext:
         fsGroup: 2000
         runAsNonRoot: true
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/bzub/config-functions/vault/operator"
+)
+
+const usage = `Usage: vault-operator <command> [flags]
+
+Commands:
+  init    Initialize a Vault server and store the init response in a Secret.
+  unseal  Unseal Vault servers with unseal keys from a Secret.
+`
+
+// tlsFlags holds flags used to connect to Vault servers.
+type tlsFlags struct {
+	caCert, clientCert, clientKey string
+}
+
+func (t *tlsFlags) register(fs *flag.FlagSet) {
+	fs.StringVar(&t.caCert, "ca-cert", "", "CA certificate used to verify Vault servers.")
+	fs.StringVar(&t.clientCert, "client-cert", "", "Client certificate presented to Vault servers.")
+	fs.StringVar(&t.clientKey, "client-key", "", "Key of the client certificate.")
+}
+
+func main() {
+	log.SetFlags(0)
+
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "init":
+		err = runInit(os.Args[2:])
+	case "unseal":
+		err = runUnseal(os.Args[2:])
+	default:
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+func runInit(args []string) error {
+	fs := flag.NewFlagSet("init", flag.ExitOnError)
+	tf := &tlsFlags{}
+	tf.register(fs)
+	address := fs.String("address", "", "Address of the Vault server to initialize.")
+	opts := operator.InitOptions{}
+	fs.StringVar(&opts.SecretName, "secret-name", "", "Name of the Secret to store the init response in.")
+	fs.IntVar(&opts.KeyShares, "key-shares", 1, "Number of key shares.")
+	fs.IntVar(&opts.KeyThreshold, "key-threshold", 1, "Number of key shares required to unseal.")
+	fs.BoolVar(&opts.Recovery, "recovery", false, "Create recovery keys for a Vault server using auto-unseal.")
+	pgpKeys := fs.String("pgp-keys", "", "Comma separated files with a base64 encoded PGP public key per key share.")
+	rootTokenPGPKey := fs.String("root-token-pgp-key", "", "File with a base64 encoded PGP public key for the root token.")
+	fs.BoolVar(&opts.DiscardRootToken, "discard-root-token", false, "Do not store the root token.")
+	fs.Parse(args)
+
+	if *address == "" || opts.SecretName == "" {
+		return fmt.Errorf("-address and -secret-name are required.")
+	}
+
+	for _, file := range strings.Split(*pgpKeys, ",") {
+		if file = strings.TrimSpace(file); file == "" {
+			continue
+		}
+		key, err := readPGPKey(file)
+		if err != nil {
+			return err
+		}
+		opts.PGPKeys = append(opts.PGPKeys, key)
+	}
+	if *rootTokenPGPKey != "" {
+		key, err := readPGPKey(*rootTokenPGPKey)
+		if err != nil {
+			return err
+		}
+		opts.RootTokenPGPKey = key
+	}
+
+	httpClient, err := operator.NewHTTPClient(tf.caCert, tf.clientCert, tf.clientKey)
+	if err != nil {
+		return err
+	}
+	secrets, err := operator.InClusterSecretsClient()
+	if err != nil {
+		return err
+	}
+
+	v := &operator.Client{Address: *address, HTTPClient: httpClient}
+	return operator.Initialize(v, secrets, opts)
+}
+
+// readPGPKey returns the base64 encoded PGP public key in file.
+func readPGPKey(file string) (string, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	key := strings.Join(strings.Fields(string(b)), "")
+	if key == "" {
+		return "", fmt.Errorf("no PGP public key found in %v.", file)
+	}
+	return key, nil
+}
+
+func runUnseal(args []string) error {
+	fs := flag.NewFlagSet("unseal", flag.ExitOnError)
+	tf := &tlsFlags{}
+	tf.register(fs)
+	addresses := fs.String("address", "", "Comma separated addresses of the Vault servers to unseal.")
+	interval := fs.Duration("interval", 0, "Check the servers on this interval instead of exiting after one pass.")
+	opts := operator.UnsealOptions{}
+	fs.StringVar(&opts.SecretName, "secret-name", "", "Name of the Secret holding the unseal keys.")
+	fs.IntVar(&opts.KeyThreshold, "key-threshold", 1, "Number of key shares required to unseal.")
+	fs.StringVar(&opts.RaftLeader, "raft-leader", "", "Address of the Raft leader to join uninitialized servers to.")
+	fs.Parse(args)
+
+	if *addresses == "" || opts.SecretName == "" {
+		return fmt.Errorf("-address and -secret-name are required.")
+	}
+
+	httpClient, err := operator.NewHTTPClient(tf.caCert, tf.clientCert, tf.clientKey)
+	if err != nil {
+		return err
+	}
+	secrets, err := operator.InClusterSecretsClient()
+	if err != nil {
+		return err
+	}
+	if opts.RaftLeader != "" && tf.caCert != "" {
+		caPEM, err := ioutil.ReadFile(tf.caCert)
+		if err != nil {
+			return err
+		}
+		opts.RaftLeaderCACert = string(caPEM)
+	}
+
+	servers := []*operator.Client{}
+	for _, address := range strings.Split(*addresses, ",") {
+		if address = strings.TrimSpace(address); address != "" {
+			servers = append(servers, &operator.Client{Address: address, HTTPClient: httpClient})
+		}
+	}
+
+	if *interval == 0 {
+		return operator.Unseal(servers, secrets, opts)
+	}
+	for {
+		if err := operator.Unseal(servers, secrets, opts); err != nil {
+			log.Printf("[ERROR] %v", err)
+		}
+		time.Sleep(*interval)
+	}
+}
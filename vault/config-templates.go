@@ -0,0 +1,357 @@
+package vault
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const configAnnotation = "config.bzub.dev/vault-config"
+
+// vaultConfig holds information used to generate Vault configuration
+// Resources.
+type vaultConfig struct {
+	// Auth lists auth methods to enable, one `<path> <type>` per line.
+	Auth string
+
+	// Secrets lists secrets engines to enable, one `<path> <type>` per
+	// line.
+	Secrets string
+
+	// Policies maps policy names to their HCL.
+	Policies map[string]string
+
+	// Writes lists API paths to write, one `<index> <path>` per line. The
+	// data for each write is in WriteData under the same index.
+	Writes string
+
+	// WriteData holds the JSON data of each write.
+	WriteData []string
+
+	// Hash identifies the configuration. It is part of the Job and
+	// ConfigMap names so changes to the configuration result in a new Job,
+	// which never reads the configuration of another Job.
+	Hash string
+
+	// FunctionConfig contains information used to configure the Job.
+	*ConfigFunction
+}
+
+// vaultWrite is the value of a `write.<name>` key in an annotated ConfigMap.
+type vaultWrite struct {
+	Path string                 `yaml:"path"`
+	Data map[string]interface{} `yaml:"data"`
+}
+
+// vaultConfiguration collects Vault configuration from annotated ConfigMaps
+// in the input.
+func (f *ConfigFunction) vaultConfiguration(in []*yaml.RNode) (*vaultConfig, error) {
+	auth := map[string]string{}
+	secrets := map[string]string{}
+	policies := map[string]string{}
+	writes := []vaultWrite{}
+	for _, r := range in {
+		aValue, err := r.Pipe(yaml.GetAnnotation(configAnnotation))
+		if err != nil {
+			return nil, err
+		}
+		if aValue == nil {
+			continue
+		}
+
+		rMeta, err := r.GetMeta()
+		if err != nil {
+			return nil, err
+		}
+		if rMeta.Kind != "ConfigMap" {
+			return nil, fmt.Errorf("%v annotation is only supported on ConfigMaps, found %v %v.", configAnnotation, rMeta.Kind, rMeta.Name)
+		}
+
+		config, err := yaml.Parse(aValue.Document().Value)
+		if err != nil {
+			return nil, err
+		}
+
+		// Determine if the config targets this Vault instance.
+		cName, err := config.Pipe(yaml.Lookup("metadata", "name"))
+		switch {
+		case err != nil:
+			return nil, err
+		case cName == nil:
+			return nil, fmt.Errorf("metadata.name missing in config.")
+		case cName.Document().Value != f.Name:
+			continue
+		}
+		cNS, err := config.Pipe(yaml.Lookup("metadata", "namespace"))
+		switch {
+		case err != nil:
+			return nil, err
+		case cNS == nil:
+			return nil, fmt.Errorf("metadata.namespace missing in config.")
+		case cNS.Document().Value != f.Namespace:
+			continue
+		}
+
+		data, err := r.Pipe(yaml.Lookup("data"))
+		if err != nil {
+			return nil, err
+		}
+		if data == nil {
+			continue
+		}
+
+		// Collect keys in a stable order.
+		keys := []string{}
+		values := map[string]string{}
+		err = data.VisitFields(func(node *yaml.MapNode) error {
+			key := node.Key.YNode().Value
+			keys = append(keys, key)
+			values[key] = node.Value.YNode().Value
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			value := values[key]
+			parts := strings.SplitN(key, ".", 2)
+			if len(parts) != 2 || parts[1] == "" {
+				return nil, fmt.Errorf("invalid key %q in ConfigMap %v, expected auth.<path>, secrets.<path>, policy.<name> or write.<name>.", key, rMeta.Name)
+			}
+			name := parts[1]
+
+			switch parts[0] {
+			case "auth":
+				if _, ok := auth[name]; ok {
+					return nil, fmt.Errorf("vault auth method %q is defined more than once.", name)
+				}
+				auth[name] = strings.TrimSpace(value)
+			case "secrets":
+				if _, ok := secrets[name]; ok {
+					return nil, fmt.Errorf("vault secrets engine %q is defined more than once.", name)
+				}
+				secrets[name] = strings.TrimSpace(value)
+			case "policy":
+				if _, ok := policies[name]; ok {
+					return nil, fmt.Errorf("vault policy %q is defined more than once.", name)
+				}
+				policies[name] = value
+			case "write":
+				w := vaultWrite{}
+				if err := yaml.Unmarshal([]byte(value), &w); err != nil {
+					return nil, fmt.Errorf("invalid %v in ConfigMap %v: %v", key, rMeta.Name, err)
+				}
+				if w.Path == "" {
+					return nil, fmt.Errorf("%v in ConfigMap %v is missing path.", key, rMeta.Name)
+				}
+				writes = append(writes, w)
+			default:
+				return nil, fmt.Errorf("invalid key %q in ConfigMap %v, expected auth.<path>, secrets.<path>, policy.<name> or write.<name>.", key, rMeta.Name)
+			}
+		}
+	}
+
+	cfg := &vaultConfig{
+		Auth:           mountList(auth),
+		Secrets:        mountList(secrets),
+		Policies:       policies,
+		ConfigFunction: f,
+	}
+	writeLines := []string{}
+	for i, w := range writes {
+		data := w.Data
+		if data == nil {
+			data = map[string]interface{}{}
+		}
+		dataJSON, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		cfg.WriteData = append(cfg.WriteData, string(dataJSON))
+		writeLines = append(writeLines, fmt.Sprintf("%v %v", i, w.Path))
+	}
+	cfg.Writes = strings.Join(writeLines, "\n")
+
+	policiesJSON, err := json.Marshal(policies)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%v%v%v%v%v%v",
+		cfg.Auth, cfg.Secrets, string(policiesJSON), cfg.Writes, cfg.WriteData,
+		f.Data.ConfigRevokeRootTokenEnabled)))
+	cfg.Hash = fmt.Sprintf("%x", sum)[:10]
+
+	return cfg, nil
+}
+
+// mountList renders mounts as `<path> <type>` lines sorted by path.
+func mountList(mounts map[string]string) string {
+	paths := []string{}
+	for p := range mounts {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	lines := []string{}
+	for _, p := range paths {
+		lines = append(lines, p+" "+mounts[p])
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// removeStaleConfigResources filters out configuration Jobs and ConfigMaps
+// other than the ones for the current configuration. An empty hash removes
+// them all. Resources must carry this instance's label, so another Vault
+// instance whose name starts with `<name>-config` is left alone.
+func (f *ConfigFunction) removeStaleConfigResources(in []*yaml.RNode, hash string) ([]*yaml.RNode, error) {
+	prefix := f.Name + "-config"
+	current := ""
+	if hash != "" {
+		current = prefix + "-" + hash
+	}
+	instance := f.Labels["app.kubernetes.io/instance"]
+
+	out := []*yaml.RNode{}
+	for _, r := range in {
+		rMeta, err := r.GetMeta()
+		if err != nil {
+			return nil, err
+		}
+
+		// ConfigMaps used to share the fixed `<name>-config` name, which is
+		// removed as well.
+		if (rMeta.Kind == "Job" || rMeta.Kind == "ConfigMap") &&
+			rMeta.Namespace == f.Namespace &&
+			rMeta.Labels["app.kubernetes.io/instance"] == instance &&
+			(rMeta.Name == prefix || strings.HasPrefix(rMeta.Name, prefix+"-")) &&
+			rMeta.Name != current {
+			continue
+		}
+		out = append(out, r)
+	}
+
+	return out, nil
+}
+
+func configTemplates() map[string]string {
+	return map[string]string{
+		"config-cm":  configCMTemplate,
+		"config-job": configJobTemplate,
+	}
+}
+
+var configCMTemplate = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .Name }}-config-{{ .Hash }}
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+data:
+  auth.txt: {{ quote .Auth }}
+  secrets.txt: {{ quote .Secrets }}
+  writes.txt: {{ quote .Writes }}
+{{- range $name, $policy := .Policies }}
+  policy.{{ $name }}.hcl: {{ quote $policy }}
+{{- end }}
+{{- range $i, $data := .WriteData }}
+  write.{{ $i }}.json: {{ quote $data }}
+{{- end }}
+`
+
+var configJobTemplate = `apiVersion: batch/v1
+kind: Job
+metadata:
+  name: {{ .Name }}-config-{{ .Hash }}
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+spec:
+  template:
+    spec:
+      restartPolicy: OnFailure
+      containers:
+        - name: vault-config
+          image: docker.io/library/vault:1.4.0
+          command:
+            - /bin/sh
+            - -ec
+            - |-
+              config_dir="/vault/config"
+
+              VAULT_TOKEN="$(\
+                sed -n 's/.*"root_token": *"\([^"]*\)".*/\1/p' \
+                  /vault/init/init.json \
+              )"
+              export VAULT_TOKEN
+
+              auth_list="$(vault auth list -format=json)"
+              while read -r path type; do
+                [ -n "${path}" ] || continue
+                if echo "${auth_list}" | grep -q "\"${path}/\""; then
+                  continue
+                fi
+                echo "[INFO] Enabling ${type} auth method at ${path}."
+                vault auth enable -path="${path}" "${type}"
+              done < "${config_dir}/auth.txt"
+
+              secrets_list="$(vault secrets list -format=json)"
+              while read -r path type; do
+                [ -n "${path}" ] || continue
+                if echo "${secrets_list}" | grep -q "\"${path}/\""; then
+                  continue
+                fi
+                echo "[INFO] Enabling ${type} secrets engine at ${path}."
+                vault secrets enable -path="${path}" "${type}"
+              done < "${config_dir}/secrets.txt"
+
+              for policy in "${config_dir}"/policy.*.hcl; do
+                [ -e "${policy}" ] || continue
+                name="$(basename "${policy}" .hcl)"
+                name="${name#policy.}"
+                echo "[INFO] Writing policy ${name}."
+                vault policy write "${name}" "${policy}"
+              done
+
+              while read -r index path; do
+                [ -n "${index}" ] || continue
+                echo "[INFO] Writing ${path}."
+                vault write "${path}" "@${config_dir}/write.${index}.json" >/dev/null
+              done < "${config_dir}/writes.txt"
+{{- if .Data.ConfigRevokeRootTokenEnabled }}
+
+              echo "[INFO] Revoking the root token."
+              vault token revoke -self
+{{- end }}
+          env:
+            - name: VAULT_ADDR
+              value: https://{{ .Name }}-server.{{ .Namespace }}.svc:8200
+            - name: VAULT_CACERT
+              value: /vault/tls/ca.pem
+          volumeMounts:
+            - name: vault-config
+              mountPath: /vault/config
+            - name: vault-init
+              mountPath: /vault/init
+            - name: vault-tls
+              mountPath: /vault/tls
+      volumes:
+        - name: vault-config
+          configMap:
+            name: {{ .Name }}-config-{{ .Hash }}
+        - name: vault-init
+          secret:
+            secretName: {{ .Data.UnsealSecretName }}
+        - name: vault-tls
+          secret:
+            secretName: {{ .Name }}-server-tls
+`
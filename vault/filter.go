@@ -1,8 +1,14 @@
 package vault
 
 import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
 	"github.com/bzub/config-functions/cfssl"
 	"github.com/bzub/config-functions/cfunc"
+	"github.com/bzub/config-functions/consul"
 	"sigs.k8s.io/kustomize/kyaml/kio"
 	"sigs.k8s.io/kustomize/kyaml/yaml"
 )
@@ -20,8 +26,34 @@ metadata:
 data:
   init_job_enabled: "{{ .Data.InitJobEnabled }}"
   unseal_job_enabled: "{{ .Data.UnsealJobEnabled }}"
+  unsealer_deployment_enabled: "{{ .Data.UnsealerDeploymentEnabled }}"
+  unsealer_interval_seconds: "{{ .Data.UnsealerIntervalSeconds }}"
+  config_job_enabled: "{{ .Data.ConfigJobEnabled }}"
+  config_revoke_root_token_enabled: "{{ .Data.ConfigRevokeRootTokenEnabled }}"
+  agent_sidecar_injector_enabled: "{{ .Data.AgentSidecarInjectorEnabled }}"
   tls_generator_job_enabled: "{{ .Data.TLSGeneratorJobEnabled }}"
   unseal_secret_name: "{{ .Data.UnsealSecretName }}"
+  operator_image: "{{ .Data.OperatorImage }}"
+  tls_extra_dns_names: "{{ range $i, $n := .Data.TLSExtraDNSNames }}{{ if $i }},{{ end }}{{ $n }}{{ end }}"
+  tls_extra_ip_addresses: "{{ range $i, $n := .Data.TLSExtraIPAddresses }}{{ if $i }},{{ end }}{{ $n }}{{ end }}"
+  consul_storage_instance: "{{ .Data.ConsulStorageInstance }}"
+  consul_storage_path: "{{ .Data.ConsulStoragePath }}"
+  consul_storage_token_secret_name: "{{ .Data.ConsulStorageTokenSecretName }}"
+  raft_storage_enabled: "{{ .Data.RaftStorageEnabled }}"
+  raft_storage_size: "{{ .Data.RaftStorageSize }}"
+  raft_storage_class: "{{ .Data.RaftStorageClass }}"
+  key_shares: "{{ .Data.KeyShares }}"
+  key_threshold: "{{ .Data.KeyThreshold }}"
+  pgp_keys_configmap: "{{ .Data.PGPKeysConfigMap }}"
+  pgp_keys: "{{ range $i, $k := .Data.PGPKeys }}{{ if $i }},{{ end }}{{ $k }}{{ end }}"
+  root_token_pgp_key: "{{ .Data.RootTokenPGPKey }}"
+  root_token_storage_disabled: "{{ .Data.RootTokenStorageDisabled }}"
+  seal_transit_instance: "{{ .Data.SealTransitInstance }}"
+  seal_transit_key_name: "{{ .Data.SealTransitKeyName }}"
+  seal_transit_mount_path: "{{ .Data.SealTransitMountPath }}"
+  seal_transit_token_job_enabled: "{{ .Data.SealTransitTokenJobEnabled }}"
+  seal_transit_token_secret_name: "{{ .Data.SealTransitTokenSecretName }}"
+  seal_hcl: {{ quote .Data.SealHCL }}
 `
 
 // ConfigFunction implements kio.Filter and holds information used in Resource
@@ -36,6 +68,21 @@ type ConfigFunction struct {
 	// StatefulSet. It is updated when the StatefulSet's `spec.replicas`
 	// changes.
 	Hostnames []string
+
+	// ServerServiceName is the governing Service of the StatefulSet, under
+	// which servers have Pod DNS names. Raft storage uses the headless
+	// `-server-internal` Service. Other instances keep the `-server`
+	// Service, since the governing Service of an existing StatefulSet can
+	// not be changed.
+	ServerServiceName string
+
+	// ConsulStorage is the Consul config function used as the storage
+	// backend, if ConsulStorageInstance is set.
+	ConsulStorage *consul.ConfigFunction
+
+	// SealTransit is the Vault config function used for auto-unseal, if
+	// SealTransitInstance is set.
+	SealTransit *ConfigFunction
 }
 
 // Options holds settings used in the config function.
@@ -48,13 +95,181 @@ type Options struct {
 	// on a Vault cluster.
 	UnsealJobEnabled bool `yaml:"unseal_job_enabled"`
 
+	// UnsealerDeploymentEnabled creates a Deployment which continuously
+	// checks the seal status of every Vault server, and unseals servers
+	// which are sealed, for example after a restart. Its Role only allows
+	// reading the unseal Secret.
+	UnsealerDeploymentEnabled bool `yaml:"unsealer_deployment_enabled"`
+
+	// UnsealerIntervalSeconds is the time the unsealer waits between seal
+	// status checks.
+	UnsealerIntervalSeconds int `yaml:"unsealer_interval_seconds"`
+
+	// ConfigJobEnabled creates a Job which configures Vault with the root
+	// token from the unseal Secret. Auth methods, secrets engines, policies
+	// and API writes are read from ConfigMaps carrying the
+	// `config.bzub.dev/vault-config` annotation that targets this Vault
+	// instance.
+	ConfigJobEnabled bool `yaml:"config_job_enabled"`
+
+	// ConfigRevokeRootTokenEnabled revokes the root token once the
+	// configuration Job is done. Later configuration changes require a new
+	// root token in the unseal Secret.
+	ConfigRevokeRootTokenEnabled bool `yaml:"config_revoke_root_token_enabled"`
+
+	// AgentSidecarInjectorEnabled adds Vault Agent containers to workloads
+	// with a `config.bzub.dev/vault-agent-sidecar-injector` annotation
+	// which targets this Vault instance. The agent authenticates with the
+	// kubernetes auth method and renders secrets into a shared volume.
+	AgentSidecarInjectorEnabled bool `yaml:"agent_sidecar_injector_enabled"`
+
 	// TLSGeneratorJobEnabled creates Jobs which generate TLS assets for
-	// communication with Vault.
+	// communication with Vault, including a client certificate used by the
+	// init and unseal Jobs.
 	TLSGeneratorJobEnabled bool `yaml:"tls_generator_job_enabled"`
 
+	// TLSExtraDNSNames is a comma separated list of additional DNS names,
+	// such as external hostnames, added to every server certificate.
+	TLSExtraDNSNames []string `yaml:"tls_extra_dns_names"`
+
+	// TLSExtraIPAddresses is a comma separated list of additional IP
+	// addresses added to every server certificate.
+	TLSExtraIPAddresses []string `yaml:"tls_extra_ip_addresses"`
+
 	// UnsealSecretName is the name of the Secret used to hold unseal key
 	// shares.
 	UnsealSecretName string `yaml:"unseal_secret_name"`
+
+	// PGPKeysConfigMap is the name of a ConfigMap holding base64 encoded
+	// PGP public keys, such as the output of `gpg --export <key> | base64`.
+	// Its keys are referenced by PGPKeys and RootTokenPGPKey.
+	PGPKeysConfigMap string `yaml:"pgp_keys_configmap"`
+
+	// PGPKeys is a comma separated list of keys in PGPKeysConfigMap, one
+	// per key share. If set, the init Job encrypts each key share with the
+	// matching public key and only stores the encrypted shares. Encrypted
+	// shares can not be used by the unseal Job or the unsealer.
+	PGPKeys []string `yaml:"pgp_keys"`
+
+	// RootTokenPGPKey is a key in PGPKeysConfigMap. If set, the init Job
+	// stores the root token encrypted with this public key. An encrypted
+	// root token can not be used by the configuration Job.
+	RootTokenPGPKey string `yaml:"root_token_pgp_key"`
+
+	// RootTokenStorageDisabled keeps the init Job from storing the root
+	// token at all.
+	RootTokenStorageDisabled bool `yaml:"root_token_storage_disabled"`
+
+	// OperatorImage is the container image with the `vault-operator`
+	// command, which the init and unseal Jobs and the unsealer Deployment
+	// use to call the Vault HTTP API. Images built from this repo with
+	// `--build-arg config_function=vault` include it from v0.0.2 on.
+	OperatorImage string `yaml:"operator_image"`
+
+	// KeyShares is the number of unseal key shares created by the init
+	// Job. Each share is stored under its own key, `unseal_key_<index>`,
+	// in the unseal Secret. With auto-unseal, recovery key shares are
+	// created instead and stored as `recovery_key_<index>`.
+	KeyShares int `yaml:"key_shares"`
+
+	// KeyThreshold is the number of unseal key shares required to unseal
+	// Vault. The unseal Job submits this many shares to every server.
+	KeyThreshold int `yaml:"key_threshold"`
+
+	// ConsulStorageInstance is the name of a Consul function config in the
+	// same namespace. When set, Vault uses that Consul cluster as its
+	// storage backend via an injected Consul agent sidecar.
+	ConsulStorageInstance string `yaml:"consul_storage_instance"`
+
+	// ConsulStoragePath is the Consul KV path under which Vault data is
+	// stored.
+	ConsulStoragePath string `yaml:"consul_storage_path"`
+
+	// ConsulStorageTokenSecretName is the name of the Secret holding
+	// Vault's Consul ACL token. When the Consul instance has ACLs enabled,
+	// it generates the token with a policy limited to ConsulStoragePath
+	// and the `vault` service.
+	//
+	// https://www.vaultproject.io/docs/configuration/storage/consul#acls
+	ConsulStorageTokenSecretName string `yaml:"consul_storage_token_secret_name"`
+
+	// RaftStorageEnabled uses Vault's integrated Raft storage, allowing
+	// the StatefulSet to run multiple replicas in HA mode. Every server
+	// from Hostnames is tried as a Raft leader, and the unseal Job joins
+	// followers to the first server.
+	RaftStorageEnabled bool `yaml:"raft_storage_enabled"`
+
+	// RaftStorageSize is the size of the PersistentVolumeClaim each server
+	// stores Raft data in.
+	RaftStorageSize string `yaml:"raft_storage_size"`
+
+	// RaftStorageClass is the StorageClass of the Raft data
+	// PersistentVolumeClaims. The cluster's default StorageClass is used if
+	// it is empty.
+	RaftStorageClass string `yaml:"raft_storage_class"`
+
+	// SealTransitInstance is the name of another Vault function config in
+	// the same namespace. When set, Vault auto-unseals using that Vault
+	// instance's transit secrets engine, and the unseal Job is disabled.
+	SealTransitInstance string `yaml:"seal_transit_instance"`
+
+	// SealTransitKeyName is the name of the transit key used for
+	// auto-unseal.
+	SealTransitKeyName string `yaml:"seal_transit_key_name"`
+
+	// SealTransitMountPath is the mount path of the transit secrets engine
+	// used for auto-unseal.
+	SealTransitMountPath string `yaml:"seal_transit_mount_path"`
+
+	// SealTransitTokenJobEnabled creates a Job which enables the transit
+	// secrets engine and key on the SealTransitInstance with its root
+	// token, and stores a token for auto-unseal in a Secret.
+	SealTransitTokenJobEnabled bool `yaml:"seal_transit_token_job_enabled"`
+
+	// SealTransitTokenSecretName is the name of the Secret holding the
+	// token used for auto-unseal, under the `token` key.
+	SealTransitTokenSecretName string `yaml:"seal_transit_token_secret_name"`
+
+	// SealHCL is a seal stanza, such as `seal "pkcs11"` or `seal
+	// "awskms"`, used for auto-unseal. The unseal Job is disabled when it
+	// is set.
+	SealHCL string `yaml:"seal_hcl"`
+
+	// SealConfig is the indented SealHCL for the server ConfigMap.
+	SealConfig string `yaml:"-"`
+}
+
+// AgentSidecarOptions holds per-workload settings for Vault Agent. They are
+// read from the `data` field of a workload's
+// `config.bzub.dev/vault-agent-sidecar-injector` annotation value.
+type AgentSidecarOptions struct {
+	// Role is the kubernetes auth method role the agent logs in with.
+	//
+	// https://www.vaultproject.io/docs/auth/kubernetes
+	Role string `yaml:"role"`
+
+	// AuthPath is the mount path of the kubernetes auth method.
+	AuthPath string `yaml:"auth_path"`
+
+	// Templates maps file names to Consul Template contents. They are
+	// given as `template.<file name>` keys, and rendered by the agent into
+	// MountPath.
+	//
+	// https://www.vaultproject.io/docs/agent/template
+	Templates map[string]string `yaml:"-"`
+
+	// MountPath is where rendered secrets are mounted in the workload's
+	// containers.
+	MountPath string `yaml:"mount_path"`
+
+	// Containers is a comma separated list of the workload's containers
+	// which mount the rendered secrets. All containers mount them by
+	// default.
+	Containers []string `yaml:"containers"`
+
+	// InitOnly only renders secrets once with an init container, and does
+	// not keep them up to date with a sidecar container.
+	InitOnly bool `yaml:"init_only"`
 }
 
 // Filter generates Resources.
@@ -85,6 +300,16 @@ func (f *ConfigFunction) Filter(in []*yaml.RNode) ([]*yaml.RNode, error) {
 	}
 	generatedRs = append(generatedRs, serverRs...)
 
+	if f.Data.RaftStorageEnabled {
+		// Generate the headless Service Raft peers address each other
+		// through.
+		internalRs, err := cfunc.ParseTemplates(serverInternalSvcTemplates(), f)
+		if err != nil {
+			return nil, err
+		}
+		generatedRs = append(generatedRs, internalRs...)
+	}
+
 	if f.Data.InitJobEnabled {
 		// Generate init Job Resources from templates.
 		initRs, err := cfunc.ParseTemplates(initJobTemplates(), f)
@@ -103,6 +328,63 @@ func (f *ConfigFunction) Filter(in []*yaml.RNode) ([]*yaml.RNode, error) {
 		generatedRs = append(generatedRs, unsealRs...)
 	}
 
+	if f.Data.UnsealerDeploymentEnabled {
+		// Generate unsealer Deployment Resources from templates.
+		unsealerRs, err := cfunc.ParseTemplates(unsealerTemplates(), f)
+		if err != nil {
+			return nil, err
+		}
+		generatedRs = append(generatedRs, unsealerRs...)
+	}
+
+	configHash := ""
+	if f.Data.ConfigJobEnabled {
+		// Generate configuration Resources from annotated ConfigMaps.
+		vCfg, err := f.vaultConfiguration(in)
+		if err != nil {
+			return nil, err
+		}
+		configRs, err := cfunc.ParseTemplates(configTemplates(), vCfg)
+		if err != nil {
+			return nil, err
+		}
+		generatedRs = append(generatedRs, configRs...)
+		configHash = vCfg.Hash
+	}
+
+	// Remove configuration Jobs and ConfigMaps for previous configuration.
+	in, err = f.removeStaleConfigResources(in, configHash)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Data.AgentSidecarInjectorEnabled {
+		// Generate Vault Agent patch Resources for workloads that call
+		// for them from input.
+		sidecarRs, err := f.sidecarPatches(in)
+		if err != nil {
+			return nil, err
+		}
+		generatedRs = append(generatedRs, sidecarRs...)
+	}
+
+	if f.SealTransit != nil || f.Data.SealHCL != "" {
+		// Remove unseal Job Resources from a previous run.
+		in, err = f.removeUnsealResources(in)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if f.SealTransit != nil && f.Data.SealTransitTokenJobEnabled {
+		// Generate auto-unseal token Job Resources from templates.
+		transitRs, err := cfunc.ParseTemplates(sealTransitTokenJobTemplates(), f)
+		if err != nil {
+			return nil, err
+		}
+		generatedRs = append(generatedRs, transitRs...)
+	}
+
 	if f.Data.TLSGeneratorJobEnabled {
 		// Create a cfssl function config from a ConfigMap template.
 		cfsslFnCfg, err := cfunc.ParseTemplate("cfssl-cm", cfsslCMTemplate, f)
@@ -129,7 +411,7 @@ func (f *ConfigFunction) Filter(in []*yaml.RNode) ([]*yaml.RNode, error) {
 
 // syncData populates a struct with information needed for Resource templates.
 func (f *ConfigFunction) syncData(in []*yaml.RNode) error {
-	if err := f.SyncMetadata(DefaultAppNameAnnotationValue); err != nil {
+	if err := f.syncOptions(); err != nil {
 		return err
 	}
 
@@ -143,9 +425,114 @@ func (f *ConfigFunction) syncData(in []*yaml.RNode) error {
 		return err
 	}
 
+	switch {
+	case f.Data.KeyShares < 1:
+		return fmt.Errorf("key_shares must be at least 1.")
+	case f.Data.KeyThreshold < 1 || f.Data.KeyThreshold > f.Data.KeyShares:
+		return fmt.Errorf("key_threshold must be between 1 and key_shares.")
+	case f.Data.KeyShares > 1 && f.Data.KeyThreshold == 1:
+		return fmt.Errorf("key_threshold must be greater than 1 when key_shares is greater than 1.")
+	case f.Data.UnsealerIntervalSeconds < 1:
+		return fmt.Errorf("unsealer_interval_seconds must be at least 1.")
+	}
+
+	if f.Data.ConsulStorageInstance != "" && f.Data.RaftStorageEnabled {
+		return fmt.Errorf("consul_storage_instance and raft_storage_enabled are mutually exclusive.")
+	}
+	if f.Data.RaftStorageEnabled && f.Data.RaftStorageSize == "" {
+		return fmt.Errorf("raft_storage_enabled requires raft_storage_size.")
+	}
+
+	f.ServerServiceName = fnMeta.Name + "-server"
+	if f.Data.RaftStorageEnabled {
+		f.ServerServiceName = fnMeta.Name + "-server-internal"
+	}
+
+	if f.Data.ConsulStorageInstance != "" {
+		f.ConsulStorage, err = consulStorage(in, f.Data.ConsulStorageInstance, fnMeta.Namespace)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case f.Data.SealTransitInstance != "" && f.Data.SealHCL != "":
+		return fmt.Errorf("seal_transit_instance and seal_hcl are mutually exclusive.")
+	case f.Data.SealTransitInstance == fnMeta.Name:
+		return fmt.Errorf("seal_transit_instance must refer to another Vault instance.")
+	}
+
+	if f.Data.SealTransitInstance != "" {
+		f.SealTransit, err = sealTransit(in, f.Data.SealTransitInstance, fnMeta.Namespace)
+		if err != nil {
+			return err
+		}
+	}
+
+	if f.SealTransit != nil || f.Data.SealHCL != "" {
+		// Vault unseals itself with auto-unseal.
+		f.Data.UnsealJobEnabled = false
+		f.Data.UnsealerDeploymentEnabled = false
+	}
+
+	switch {
+	case (len(f.Data.PGPKeys) > 0 || f.Data.RootTokenPGPKey != "") && f.Data.PGPKeysConfigMap == "":
+		return fmt.Errorf("pgp_keys and root_token_pgp_key require pgp_keys_configmap.")
+	case len(f.Data.PGPKeys) > 0 && len(f.Data.PGPKeys) != f.Data.KeyShares:
+		return fmt.Errorf("pgp_keys must list one key per key share, found %v for key_shares %v.", len(f.Data.PGPKeys), f.Data.KeyShares)
+	case len(f.Data.PGPKeys) > 0 && (f.Data.UnsealJobEnabled || f.Data.UnsealerDeploymentEnabled):
+		return fmt.Errorf("pgp_keys can not be combined with unseal_job_enabled or unsealer_deployment_enabled.")
+	case f.Data.RootTokenPGPKey != "" && f.Data.RootTokenStorageDisabled:
+		return fmt.Errorf("root_token_pgp_key and root_token_storage_disabled are mutually exclusive.")
+	case f.rootTokenUnavailable() && f.Data.ConfigJobEnabled:
+		return fmt.Errorf("config_job_enabled requires the root token, which root_token_pgp_key and root_token_storage_disabled keep from being stored.")
+	case f.SealTransit != nil && f.SealTransit.rootTokenUnavailable() && f.Data.SealTransitTokenJobEnabled:
+		return fmt.Errorf("seal_transit_token_job_enabled requires the root token of %v, which is not stored.", f.SealTransit.Name)
+	case f.SealTransit != nil && f.SealTransit.rootTokenRevoked() && f.Data.SealTransitTokenJobEnabled:
+		return fmt.Errorf("seal_transit_token_job_enabled requires the root token of %v, which config_revoke_root_token_enabled revokes.", f.SealTransit.Name)
+	}
+
+	return nil
+}
+
+// rootTokenUnavailable reports whether the init Job keeps the plain root token
+// out of the unseal Secret.
+func (f *ConfigFunction) rootTokenUnavailable() bool {
+	return f.Data.RootTokenPGPKey != "" || f.Data.RootTokenStorageDisabled
+}
+
+// rootTokenRevoked reports whether the config Job revokes the root token once
+// it is done.
+func (f *ConfigFunction) rootTokenRevoked() bool {
+	return f.Data.ConfigJobEnabled && f.Data.ConfigRevokeRootTokenEnabled
+}
+
+// syncOptions populates metadata and Data from the function config.
+func (f *ConfigFunction) syncOptions() error {
+	if err := f.SyncMetadata(DefaultAppNameAnnotationValue); err != nil {
+		return err
+	}
+
+	fnMeta, err := f.RW.FunctionConfig.GetMeta()
+	if err != nil {
+		return err
+	}
+
 	// Set defaults.
 	f.Data = Options{
-		UnsealSecretName: fnMeta.Name + "-" + fnMeta.Namespace + "-unseal",
+		UnsealSecretName:             fnMeta.Name + "-" + fnMeta.Namespace + "-unseal",
+		ConsulStoragePath:            "vault/",
+		ConsulStorageTokenSecretName: fnMeta.Name + "-" + fnMeta.Namespace + "-consul-token",
+		RaftStorageSize:              "10Gi",
+		OperatorImage:                "gcr.io/config-functions/vault:v0.0.2",
+		KeyShares:                    1,
+		KeyThreshold:                 1,
+
+		UnsealerIntervalSeconds: 10,
+
+		SealTransitKeyName:         fnMeta.Name + "-" + fnMeta.Namespace,
+		SealTransitMountPath:       "transit/",
+		SealTransitTokenSecretName: fnMeta.Name + "-" + fnMeta.Namespace + "-transit-token",
 	}
 
 	// Populate function data from config.
@@ -153,12 +540,48 @@ func (f *ConfigFunction) syncData(in []*yaml.RNode) error {
 		return err
 	}
 
+	if f.Data.SealHCL != "" {
+		f.Data.SealConfig = cfunc.Indent(f.Data.SealHCL, "    ")
+	}
+
 	return nil
 }
 
+// consulStorage returns the Consul config function with the given name and
+// namespace from the input, populated with the settings in its function
+// config. The Consul function injects the agent sidecar into the Vault
+// server, so its agent sidecar injector must be enabled.
+func consulStorage(in []*yaml.RNode, name, ns string) (*consul.ConfigFunction, error) {
+	for _, r := range in {
+		rMeta, err := r.GetMeta()
+		if err != nil {
+			return nil, err
+		}
+
+		if rMeta.Kind != "ConfigMap" ||
+			rMeta.Name != name ||
+			rMeta.Namespace != ns {
+			continue
+		}
+
+		consulFunc := &consul.ConfigFunction{}
+		if err := yaml.Unmarshal([]byte(r.MustString()), consulFunc); err != nil {
+			return nil, err
+		}
+		if !consulFunc.Data.AgentSidecarInjectorEnabled {
+			return nil, fmt.Errorf("consul_storage_instance requires agent_sidecar_injector_enabled in Consul function config %v/%v.", ns, name)
+		}
+
+		return consulFunc, nil
+	}
+
+	return nil, fmt.Errorf("consul_storage_instance requires Consul function config %v/%v in the input.", ns, name)
+}
+
 // UnmarshalYAML implements yaml.Unmarshaler. It ensures all values from
 // a ConfigMap's KV data can be converted into relevant Go types.
 func (d *Options) UnmarshalYAML(node *yaml.Node) error {
+	var err error
 	var key, value string
 	for i := range node.Content {
 		if key == "" {
@@ -177,6 +600,109 @@ func (d *Options) UnmarshalYAML(node *yaml.Node) error {
 			d.TLSGeneratorJobEnabled = true
 		case key == "unseal_secret_name":
 			d.UnsealSecretName = value
+		case key == "operator_image":
+			d.OperatorImage = value
+		case key == "pgp_keys_configmap":
+			d.PGPKeysConfigMap = value
+		case key == "pgp_keys":
+			d.PGPKeys = parseList(value)
+		case key == "root_token_pgp_key":
+			d.RootTokenPGPKey = value
+		case key == "root_token_storage_disabled" && value == "true":
+			d.RootTokenStorageDisabled = true
+		case key == "tls_extra_dns_names":
+			d.TLSExtraDNSNames = parseList(value)
+		case key == "tls_extra_ip_addresses":
+			d.TLSExtraIPAddresses = parseList(value)
+			for _, ip := range d.TLSExtraIPAddresses {
+				if net.ParseIP(ip) == nil {
+					return fmt.Errorf("invalid tls_extra_ip_addresses: %q is not an IP address", ip)
+				}
+			}
+		case key == "consul_storage_instance":
+			d.ConsulStorageInstance = value
+		case key == "consul_storage_path":
+			d.ConsulStoragePath = value
+		case key == "consul_storage_token_secret_name":
+			d.ConsulStorageTokenSecretName = value
+		case key == "raft_storage_enabled" && value == "true":
+			d.RaftStorageEnabled = true
+		case key == "raft_storage_size":
+			d.RaftStorageSize = value
+		case key == "raft_storage_class":
+			d.RaftStorageClass = value
+		case key == "unsealer_deployment_enabled" && value == "true":
+			d.UnsealerDeploymentEnabled = true
+		case key == "unsealer_interval_seconds":
+			d.UnsealerIntervalSeconds, err = strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid unsealer_interval_seconds: %v", err)
+			}
+		case key == "config_job_enabled" && value == "true":
+			d.ConfigJobEnabled = true
+		case key == "config_revoke_root_token_enabled" && value == "true":
+			d.ConfigRevokeRootTokenEnabled = true
+		case key == "agent_sidecar_injector_enabled" && value == "true":
+			d.AgentSidecarInjectorEnabled = true
+		case key == "seal_transit_instance":
+			d.SealTransitInstance = value
+		case key == "seal_transit_key_name":
+			d.SealTransitKeyName = value
+		case key == "seal_transit_mount_path":
+			d.SealTransitMountPath = value
+		case key == "seal_transit_token_job_enabled" && value == "true":
+			d.SealTransitTokenJobEnabled = true
+		case key == "seal_transit_token_secret_name":
+			d.SealTransitTokenSecretName = value
+		case key == "seal_hcl":
+			d.SealHCL = value
+		case key == "key_shares":
+			d.KeyShares, err = strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid key_shares: %v", err)
+			}
+		case key == "key_threshold":
+			d.KeyThreshold, err = strconv.Atoi(value)
+			if err != nil {
+				return fmt.Errorf("invalid key_threshold: %v", err)
+			}
+		}
+
+		key = ""
+	}
+
+	return nil
+}
+
+// UnmarshalYAML implements yaml.Unmarshaler. It ensures all values from an
+// annotation's KV data can be converted into relevant Go types.
+func (d *AgentSidecarOptions) UnmarshalYAML(node *yaml.Node) error {
+	var key, value string
+	for i := range node.Content {
+		if key == "" {
+			key = node.Content[i].Value
+			continue
+		}
+		value = node.Content[i].Value
+
+		// Convert KV string values into associated AgentSidecarOptions
+		// types.
+		switch {
+		case key == "role":
+			d.Role = value
+		case key == "auth_path":
+			d.AuthPath = value
+		case strings.HasPrefix(key, "template."):
+			if d.Templates == nil {
+				d.Templates = map[string]string{}
+			}
+			d.Templates[strings.TrimPrefix(key, "template.")] = value
+		case key == "mount_path":
+			d.MountPath = value
+		case key == "containers":
+			d.Containers = parseList(value)
+		case key == "init_only" && value == "true":
+			d.InitOnly = true
 		}
 
 		key = ""
@@ -0,0 +1,500 @@
+package vault
+
+import (
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/bzub/config-functions/consul"
+	"sigs.k8s.io/kustomize/kyaml/kio"
+	"sigs.k8s.io/kustomize/kyaml/kio/filters"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// runFilter runs the function for the instance with the given name and
+// function config data on in, and merges the generated patches like the
+// function's main does.
+func runFilter(t *testing.T, name string, data map[string]string, in []*yaml.RNode) []*yaml.RNode {
+	t.Helper()
+
+	fnConfig := yaml.MustParse(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: ` + name + `
+  namespace: example
+data: {}
+`)
+	for key, value := range data {
+		if err := fnConfig.PipeE(yaml.Lookup("data"), yaml.SetField(key, yaml.NewScalarRNode(value))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	f := &ConfigFunction{}
+	f.RW = &kio.ByteReadWriter{FunctionConfig: fnConfig}
+	out, err := f.Filter(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = filters.MergeFilter{}.Filter(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+// findResource returns the Resource with the given kind and name in the
+// example namespace, failing the test if it is missing.
+func findResource(t *testing.T, rs []*yaml.RNode, kind, name string) *yaml.RNode {
+	t.Helper()
+	for _, r := range rs {
+		rMeta, err := r.GetMeta()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rMeta.Kind == kind && rMeta.Name == name && rMeta.Namespace == "example" {
+			return r
+		}
+	}
+	t.Fatalf("%v %v not found", kind, name)
+	return nil
+}
+
+// lookup returns the node at path in r, or nil.
+func lookup(t *testing.T, r *yaml.RNode, path ...string) *yaml.RNode {
+	t.Helper()
+	node, err := r.Pipe(yaml.Lookup(path...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return node
+}
+
+// value returns the scalar value at path in r, or "" if it is missing.
+func value(t *testing.T, r *yaml.RNode, path ...string) string {
+	t.Helper()
+	node := lookup(t, r, path...)
+	if node == nil {
+		return ""
+	}
+	return node.YNode().Value
+}
+
+// scalars returns the values of all scalar nodes below node.
+func scalars(node *yaml.Node) []string {
+	if node.Kind == yaml.ScalarNode {
+		return []string{node.Value}
+	}
+	values := []string{}
+	for _, n := range node.Content {
+		values = append(values, scalars(n)...)
+	}
+	return values
+}
+
+func TestFilterMultipleInstances(t *testing.T) {
+	data := map[string]string{
+		"init_job_enabled":            "true",
+		"unseal_job_enabled":          "true",
+		"unsealer_deployment_enabled": "true",
+		"tls_generator_job_enabled":   "true",
+	}
+
+	// Both instances are generated into the same package.
+	out := runFilter(t, "my-vault", data, nil)
+	out = runFilter(t, "my-other-vault", data, out)
+
+	instances := map[string]string{
+		"my-vault":       "my-other-vault",
+		"my-other-vault": "my-vault",
+	}
+	workloads, operators := map[string]int{}, map[string]int{}
+	for _, r := range out {
+		rMeta, err := r.GetMeta()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch rMeta.Kind {
+		case "Job", "Deployment":
+		default:
+			continue
+		}
+
+		instance := rMeta.Labels["app.kubernetes.io/instance"]
+		other, ok := instances[instance]
+		if !ok {
+			t.Fatalf("%v %v has unexpected instance label %q", rMeta.Kind, rMeta.Name, instance)
+		}
+		workloads[instance]++
+
+		if !strings.HasPrefix(rMeta.Name, instance+"-") {
+			t.Errorf("%v %v is not named after instance %v", rMeta.Kind, rMeta.Name, instance)
+		}
+		for _, v := range scalars(r.YNode()) {
+			if strings.Contains(v, other) {
+				t.Errorf("%v %v of instance %v references %q", rMeta.Kind, rMeta.Name, instance, v)
+			}
+		}
+
+		podSpec, err := r.Pipe(yaml.Lookup("spec", "template", "spec"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		sa, err := podSpec.Pipe(yaml.Lookup("serviceAccountName"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sa == nil || !strings.HasPrefix(sa.YNode().Value, instance+"-") {
+			t.Errorf("%v %v uses a ServiceAccount of another instance", rMeta.Kind, rMeta.Name)
+		}
+
+		switch strings.TrimPrefix(rMeta.Name, instance) {
+		case "-init", "-unseal", "-unsealer":
+		default:
+			// Only the operator workloads reference the servers.
+			continue
+		}
+		operators[instance]++
+
+		tlsSecret, err := podSpec.Pipe(yaml.Lookup("volumes", "[name=vault-tls]", "secret", "secretName"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tlsSecret == nil || tlsSecret.YNode().Value != instance+"-server-tls" {
+			t.Errorf("%v %v does not mount Secret %v-server-tls", rMeta.Kind, rMeta.Name, instance)
+		}
+
+		args := strings.Join(scalars(podSpec.Field("containers").Value.YNode()), "\n")
+		if !strings.Contains(args, "-secret-name="+instance+"-example-unseal") {
+			t.Errorf("%v %v does not use the unseal Secret of %v", rMeta.Kind, rMeta.Name, instance)
+		}
+		if !strings.Contains(args, "."+instance+"-server:8200") {
+			t.Errorf("%v %v does not address the servers of %v", rMeta.Kind, rMeta.Name, instance)
+		}
+
+		if rMeta.Kind == "Deployment" {
+			for _, path := range [][]string{
+				{"spec", "selector", "matchLabels"},
+				{"spec", "template", "metadata", "labels"},
+			} {
+				labels, err := r.Pipe(yaml.Lookup(path...))
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := labels.Pipe(yaml.Lookup("app.kubernetes.io/instance"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got == nil || got.YNode().Value != instance {
+					t.Errorf("%v %v %v does not select instance %v", rMeta.Kind, rMeta.Name, strings.Join(path, "."), instance)
+				}
+			}
+		}
+	}
+
+	for instance := range instances {
+		// The TLS generator Job, init Job, unseal Job and unsealer
+		// Deployment.
+		if workloads[instance] != 4 || operators[instance] != 3 {
+			t.Errorf("found %v Jobs and Deployments with %v operators for %v, want 4 with 3 operators", workloads[instance], operators[instance], instance)
+		}
+	}
+}
+
+func TestFilterMultipleInstancesConfig(t *testing.T) {
+	vaultConfig := func(name, target, secrets string) *yaml.RNode {
+		return yaml.MustParse(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: ` + name + `
+  namespace: example
+  annotations:
+    config.bzub.dev/vault-config: |-
+      metadata:
+        name: ` + target + `
+        namespace: example
+data:
+  secrets.kv: ` + secrets + `
+`)
+	}
+	// configResources returns the names of the config Jobs and ConfigMaps
+	// of instance in rs.
+	configResources := func(rs []*yaml.RNode, instance string) []string {
+		names := []string{}
+		for _, r := range rs {
+			rMeta, err := r.GetMeta()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (rMeta.Kind == "Job" || rMeta.Kind == "ConfigMap") &&
+				strings.HasPrefix(rMeta.Name, instance+"-config-") &&
+				rMeta.Labels["app.kubernetes.io/instance"] == instance {
+				names = append(names, rMeta.Kind+" "+rMeta.Name)
+			}
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	data := map[string]string{"config_job_enabled": "true"}
+	in := []*yaml.RNode{
+		vaultConfig("app-config", "vault", "kv-v2"),
+		vaultConfig("other-config", "vault-config", "kv"),
+	}
+
+	// The name of the vault-config instance starts with the config
+	// Resource prefix of the vault instance.
+	out := runFilter(t, "vault", data, in)
+	out = runFilter(t, "vault-config", data, out)
+	previous := configResources(out, "vault")
+	other := configResources(out, "vault-config")
+	if len(previous) != 2 || len(other) != 2 {
+		t.Fatalf("found config Resources %v and %v, want a Job and a ConfigMap each", previous, other)
+	}
+
+	// A configuration change replaces only the Resources of the vault
+	// instance.
+	for i, r := range out {
+		rMeta, err := r.GetMeta()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rMeta.Name == "app-config" {
+			out[i] = vaultConfig("app-config", "vault", "kv")
+		}
+	}
+	out = runFilter(t, "vault", data, out)
+	current := configResources(out, "vault")
+	if len(current) != 2 || current[0] == previous[0] || current[1] == previous[1] {
+		t.Errorf("found config Resources %v, want new ones replacing %v", current, previous)
+	}
+	if got := configResources(out, "vault-config"); strings.Join(got, ",") != strings.Join(other, ",") {
+		t.Errorf("config Resources of vault-config changed from %v to %v", other, got)
+	}
+
+	cmName, jobName := strings.TrimPrefix(current[0], "ConfigMap "), strings.TrimPrefix(current[1], "Job ")
+	if cmName != jobName {
+		t.Errorf("config ConfigMap %v and Job %v do not share a hash", cmName, jobName)
+	}
+	job := findResource(t, out, "Job", jobName)
+	if got := value(t, job, "spec", "template", "spec", "volumes", "[name=vault-config]", "configMap", "name"); got != cmName {
+		t.Errorf("config Job mounts ConfigMap %v, want %v", got, cmName)
+	}
+
+	// Disabling the config Job removes the Resources of the vault instance.
+	out = runFilter(t, "vault", map[string]string{}, out)
+	if got := configResources(out, "vault"); len(got) != 0 {
+		t.Errorf("found config Resources %v with config_job_enabled false", got)
+	}
+	if got := configResources(out, "vault-config"); len(got) != 2 {
+		t.Errorf("config Resources of vault-config removed, found %v", got)
+	}
+}
+
+func TestFilterConsulStorageToken(t *testing.T) {
+	consulConfig := yaml.MustParse(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: my-consul
+  namespace: example
+data:
+  acl_bootstrap_job_enabled: "true"
+  agent_sidecar_injector_enabled: "true"
+`)
+	data := map[string]string{"consul_storage_instance": "my-consul"}
+	out := runFilter(t, "my-vault", data, []*yaml.RNode{consulConfig})
+
+	container := lookup(t, findResource(t, out, "StatefulSet", "my-vault-server"),
+		"spec", "template", "spec", "containers", "[name=vault-server]")
+	if got := value(t, container, "env", "[name=CONSUL_HTTP_TOKEN]", "valueFrom", "secretKeyRef", "name"); got != "my-vault-example-consul-token" {
+		t.Errorf("CONSUL_HTTP_TOKEN is read from %v, want my-vault-example-consul-token", got)
+	}
+
+	// The Consul function injects the agent and generates the token.
+	f := &consul.ConfigFunction{}
+	f.RW = &kio.ByteReadWriter{FunctionConfig: consulConfig}
+	out, err := f.Filter(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err = filters.MergeFilter{}.Filter(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	podSpec := lookup(t, findResource(t, out, "StatefulSet", "my-vault-server"), "spec", "template", "spec")
+	if got := value(t, podSpec, "containers", "[name=consul-agent]", "env", "[name=CONSUL_HTTP_TOKEN]", "valueFrom", "secretKeyRef", "name"); got != "my-vault-example-consul-token" {
+		t.Errorf("consul-agent token is read from %v, want my-vault-example-consul-token", got)
+	}
+	var policy string
+	for _, r := range out {
+		rMeta, err := r.GetMeta()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rMeta.Kind == "Job" && strings.HasPrefix(rMeta.Name, "my-consul-acl-token-my-vault-server-") {
+			policy = value(t, r, "spec", "template", "spec", "initContainers", "[name=consul-acl-token]", "env", "[name=ACL_TOKEN_RULES]", "value")
+		}
+	}
+	for _, want := range []string{`key_prefix "vault/"`, `service "vault"`, `session_prefix ""`, `node_prefix "my-vault-server-"`} {
+		if !strings.Contains(policy, want) {
+			t.Errorf("Vault's Consul policy missing %v:\n%v", want, policy)
+		}
+	}
+	if strings.Contains(podSpec.MustString(), "my-consul-example-acl") {
+		t.Error("Vault server uses the ACL bootstrap token")
+	}
+}
+
+func TestFilterServerServiceName(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    map[string]string
+		service string
+	}{
+		{"consul storage", map[string]string{"init_job_enabled": "true"}, "my-vault-server"},
+		{"raft storage", map[string]string{"init_job_enabled": "true", "raft_storage_enabled": "true"}, "my-vault-server-internal"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := runFilter(t, "my-vault", tt.data, nil)
+
+			sts := findResource(t, out, "StatefulSet", "my-vault-server")
+			if got := value(t, sts, "spec", "serviceName"); got != tt.service {
+				t.Errorf("StatefulSet serviceName is %v, want %v", got, tt.service)
+			}
+
+			internal := false
+			for _, r := range out {
+				rMeta, err := r.GetMeta()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if rMeta.Kind == "Service" && rMeta.Name == "my-vault-server-internal" {
+					internal = true
+				}
+			}
+			if want := tt.service == "my-vault-server-internal"; internal != want {
+				t.Errorf("internal Service generated %v, want %v", internal, want)
+			}
+
+			args := strings.Join(scalars(lookup(t, findResource(t, out, "Job", "my-vault-init"),
+				"spec", "template", "spec", "containers").YNode()), "\n")
+			if want := "https://my-vault-server-0." + tt.service + ":8200"; !strings.Contains(args, want) {
+				t.Errorf("init Job does not address %v:\n%v", want, args)
+			}
+		})
+	}
+}
+
+func TestFilterSealTransitRootToken(t *testing.T) {
+	tests := []struct {
+		name    string
+		transit string
+		wantErr string
+	}{
+		{
+			name:    "root token stored",
+			transit: `  config_job_enabled: "true"`,
+		},
+		{
+			name:    "root token storage disabled",
+			transit: `  root_token_storage_disabled: "true"`,
+			wantErr: "seal_transit_token_job_enabled requires the root token of my-unsealer, which is not stored.",
+		},
+		{
+			name: "root token revoked",
+			transit: `  config_job_enabled: "true"
+  config_revoke_root_token_enabled: "true"`,
+			wantErr: "seal_transit_token_job_enabled requires the root token of my-unsealer, which config_revoke_root_token_enabled revokes.",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transitConfig := yaml.MustParse(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: my-unsealer
+  namespace: example
+data:
+` + tt.transit + `
+`)
+			fnConfig := yaml.MustParse(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: my-vault
+  namespace: example
+data:
+  seal_transit_instance: my-unsealer
+  seal_transit_token_job_enabled: "true"
+`)
+			f := &ConfigFunction{}
+			f.RW = &kio.ByteReadWriter{FunctionConfig: fnConfig}
+			_, err := f.Filter([]*yaml.RNode{transitConfig})
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatal(err)
+			case tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr):
+				t.Errorf("got error %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// agentWorkload returns a Deployment annotated for Vault Agent injection.
+func agentWorkload(ns string) *yaml.RNode {
+	return yaml.MustParse(`apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  namespace: ` + ns + `
+  annotations:
+    config.bzub.dev/vault-agent-sidecar-injector: |-
+      metadata:
+        name: my-vault
+        namespace: example
+      data:
+        role: app
+        template.db.env: |
+          {{ with secret "kv/data/app/db" }}DB_PASSWORD="{{ .Data.data.password }}"{{ end }}
+          é	tab
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          image: app
+`)
+}
+
+func TestFilterAgentSidecar(t *testing.T) {
+	data := map[string]string{"agent_sidecar_injector_enabled": "true"}
+	out := runFilter(t, "my-vault", data, []*yaml.RNode{agentWorkload("example")})
+
+	want := "{{ with secret \"kv/data/app/db\" }}DB_PASSWORD=\"{{ .Data.data.password }}\"{{ end }}\né\ttab"
+	if got := value(t, findResource(t, out, "ConfigMap", "app-vault-agent"), "data", "db.env.ctmpl"); got != want {
+		t.Errorf("template = %q, want %q", got, want)
+	}
+	podSpec := lookup(t, findResource(t, out, "Deployment", "app"), "spec", "template", "spec")
+	if got := value(t, podSpec, "volumes", "[name=vault-agent-tls]", "secret", "secretName"); got != "my-vault-server-tls" {
+		t.Errorf("agent CA read from %v, want my-vault-server-tls", got)
+	}
+}
+
+func TestFilterAgentSidecarOtherNamespace(t *testing.T) {
+	fnConfig := yaml.MustParse(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: my-vault
+  namespace: example
+data:
+  agent_sidecar_injector_enabled: "true"
+`)
+	f := &ConfigFunction{}
+	f.RW = &kio.ByteReadWriter{FunctionConfig: fnConfig}
+	_, err := f.Filter([]*yaml.RNode{agentWorkload("other")})
+	want := "Deployment app must be in the example namespace to use the config.bzub.dev/vault-agent-sidecar-injector annotation."
+	if err == nil || err.Error() != want {
+		t.Errorf("got error %v, want %v", err, want)
+	}
+}
@@ -23,25 +23,50 @@ spec:
       serviceAccountName: {{ .Name }}-init
       restartPolicy: OnFailure
       containers:
-        - name: create-unseal-secret
-          image: k8s.gcr.io/hyperkube:v1.17.4
+        - name: vault-init
+          image: {{ .Data.OperatorImage }}
           command:
-            - /bin/sh
-            - -ec
-            - |-
-              secret_name="$(unseal_secret_name)"
-              exec_pod="{{ .Name }}-server-0"
-
-              init_json="$(\
-                kubectl exec "${exec_pod}" -- \
-                  vault operator init -format="json" -n 1 -t 1\
-              )"
-
-              kubectl create secret generic \
-                "--from-literal=init.json=${init_json}" "${secret_name}"
-          envFrom:
-            - configMapRef:
-                name: {{ .Name }}
+            - vault-operator
+            - init
+            - -address=https://{{ .Name }}-server-0.{{ .ServerServiceName }}:8200
+            - -ca-cert=/vault/tls/ca.pem
+{{- if .Data.TLSGeneratorJobEnabled }}
+            - -client-cert=/vault/tls/cli-client.pem
+            - -client-key=/vault/tls/cli-client-key.pem
+{{- end }}
+            - -key-shares={{ .Data.KeyShares }}
+            - -key-threshold={{ .Data.KeyThreshold }}
+{{- if or .SealTransit .Data.SealHCL }}
+            - -recovery
+{{- end }}
+            - -secret-name={{ .Data.UnsealSecretName }}
+{{- if .Data.PGPKeys }}
+            - -pgp-keys={{ range $i, $k := .Data.PGPKeys }}{{ if $i }},{{ end }}/vault/pgp/{{ $k }}{{ end }}
+{{- end }}
+{{- if .Data.RootTokenPGPKey }}
+            - -root-token-pgp-key=/vault/pgp/{{ .Data.RootTokenPGPKey }}
+{{- end }}
+{{- if .Data.RootTokenStorageDisabled }}
+            - -discard-root-token
+{{- end }}
+          volumeMounts:
+            - name: vault-tls
+              mountPath: /vault/tls
+              readOnly: true
+{{- if .Data.PGPKeysConfigMap }}
+            - name: vault-pgp-keys
+              mountPath: /vault/pgp
+              readOnly: true
+{{- end }}
+      volumes:
+        - name: vault-tls
+          secret:
+            secretName: {{ .Name }}-server-tls
+{{- if .Data.PGPKeysConfigMap }}
+        - name: vault-pgp-keys
+          configMap:
+            name: {{ .Data.PGPKeysConfigMap }}
+{{- end }}
 `
 
 var initSATemplate = `apiVersion: v1
@@ -72,19 +97,11 @@ rules:
   - apiGroups:
       - ""
     resources:
-      - pods/exec
-    verbs:
-      - create
-    resourceNames:
-      - {{ .Name }}-server-0
-  - apiGroups:
-      - ""
-    resources:
-      - pods
+      - secrets
     verbs:
       - get
     resourceNames:
-      - {{ .Name }}-server-0
+      - {{ .Data.UnsealSecretName }}
 `
 
 var initRoleBindingTemplate = `apiVersion: rbac.authorization.k8s.io/v1
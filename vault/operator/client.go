@@ -0,0 +1,193 @@
+// Package operator initializes and unseals Vault servers through the Vault
+// HTTP API. It is used by the Jobs the Vault config function generates, so
+// they do not need to exec into Vault server Pods.
+package operator
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Client calls the HTTP API of a single Vault server.
+type Client struct {
+	// Address is the URL of the Vault server, e.g.
+	// `https://my-vault-server-0.my-vault-server:8200`.
+	Address string
+
+	// HTTPClient is used to send requests.
+	HTTPClient *http.Client
+}
+
+// InitRequest holds the parameters of `PUT /v1/sys/init`.
+type InitRequest struct {
+	SecretShares      int      `json:"secret_shares,omitempty"`
+	SecretThreshold   int      `json:"secret_threshold,omitempty"`
+	PGPKeys           []string `json:"pgp_keys,omitempty"`
+	RecoveryShares    int      `json:"recovery_shares,omitempty"`
+	RecoveryThreshold int      `json:"recovery_threshold,omitempty"`
+	RecoveryPGPKeys   []string `json:"recovery_pgp_keys,omitempty"`
+	RootTokenPGPKey   string   `json:"root_token_pgp_key,omitempty"`
+}
+
+// InitResponse holds the result of `PUT /v1/sys/init`.
+type InitResponse struct {
+	Keys               []string `json:"keys,omitempty"`
+	KeysBase64         []string `json:"keys_base64,omitempty"`
+	RecoveryKeys       []string `json:"recovery_keys,omitempty"`
+	RecoveryKeysBase64 []string `json:"recovery_keys_base64,omitempty"`
+	RootToken          string   `json:"root_token,omitempty"`
+}
+
+// SealStatus holds the result of `GET /v1/sys/seal-status`.
+type SealStatus struct {
+	Initialized bool `json:"initialized"`
+	Sealed      bool `json:"sealed"`
+	Threshold   int  `json:"t"`
+	Shares      int  `json:"n"`
+	Progress    int  `json:"progress"`
+}
+
+// NewHTTPClient returns an HTTP client which verifies servers against the CA
+// certificate in caCert. If clientCert and clientKey are set, the client
+// certificate is presented to servers.
+func NewHTTPClient(caCert, clientCert, clientKey string) (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+
+	if caCert != "" {
+		pem, err := ioutil.ReadFile(caCert)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %v.", caCert)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if clientCert != "" || clientKey != "" {
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return &http.Client{
+		Timeout:   30 * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig},
+	}, nil
+}
+
+// InitStatus reports whether the Vault server is initialized.
+func (c *Client) InitStatus() (bool, error) {
+	status := struct {
+		Initialized bool `json:"initialized"`
+	}{}
+	if err := c.do(http.MethodGet, "/v1/sys/init", nil, &status); err != nil {
+		return false, err
+	}
+	return status.Initialized, nil
+}
+
+// Init initializes the Vault server.
+func (c *Client) Init(req *InitRequest) (*InitResponse, error) {
+	resp := &InitResponse{}
+	if err := c.do(http.MethodPut, "/v1/sys/init", req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// SealStatus returns the seal status of the Vault server.
+func (c *Client) SealStatus() (*SealStatus, error) {
+	status := &SealStatus{}
+	if err := c.do(http.MethodGet, "/v1/sys/seal-status", nil, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// Unseal submits a single unseal key share.
+func (c *Client) Unseal(key string) (*SealStatus, error) {
+	req := struct {
+		Key string `json:"key"`
+	}{Key: key}
+	status := &SealStatus{}
+	if err := c.do(http.MethodPut, "/v1/sys/unseal", req, status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// RaftJoin joins the Vault server to the Raft cluster of the leader at
+// leaderAddr, which is verified against the PEM encoded leaderCACert.
+func (c *Client) RaftJoin(leaderAddr, leaderCACert string) error {
+	req := struct {
+		LeaderAPIAddr string `json:"leader_api_addr"`
+		LeaderCACert  string `json:"leader_ca_cert,omitempty"`
+	}{
+		LeaderAPIAddr: leaderAddr,
+		LeaderCACert:  leaderCACert,
+	}
+	resp := struct {
+		Joined bool `json:"joined"`
+	}{}
+	if err := c.do(http.MethodPut, "/v1/sys/storage/raft/join", req, &resp); err != nil {
+		return err
+	}
+	if !resp.Joined {
+		return fmt.Errorf("%v did not join the Raft cluster of %v.", c.Address, leaderAddr)
+	}
+	return nil
+}
+
+func (c *Client) do(method, path string, in, out interface{}) error {
+	var body io.Reader
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequest(method, strings.TrimSuffix(c.Address, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%v %v%v: %v: %s", method, c.Address, path, resp.Status, bytes.TrimSpace(respBody))
+	}
+
+	if out == nil || len(respBody) == 0 {
+		return nil
+	}
+	return json.Unmarshal(respBody, out)
+}
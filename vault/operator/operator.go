@@ -0,0 +1,268 @@
+package operator
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// createRetryDelays are the delays between attempts to store the init
+// response. The response can not be requested again, so storing it is retried
+// for about a minute before giving up.
+var createRetryDelays = []time.Duration{
+	time.Second,
+	2 * time.Second,
+	4 * time.Second,
+	8 * time.Second,
+	16 * time.Second,
+	32 * time.Second,
+}
+
+// InitOptions holds settings used by Initialize.
+type InitOptions struct {
+	// SecretName is the name of the Secret the init response is stored in.
+	SecretName string
+
+	// KeyShares is the number of key shares to split the key into.
+	KeyShares int
+
+	// KeyThreshold is the number of key shares required to unseal.
+	KeyThreshold int
+
+	// Recovery creates recovery keys instead of unseal keys, for Vault
+	// servers using auto-unseal.
+	Recovery bool
+
+	// PGPKeys holds a base64 encoded PGP public key per key share. If set,
+	// Vault encrypts each key share with the matching key.
+	PGPKeys []string
+
+	// RootTokenPGPKey is a base64 encoded PGP public key. If set, Vault
+	// encrypts the root token with it.
+	RootTokenPGPKey string
+
+	// DiscardRootToken keeps the root token out of the Secret.
+	DiscardRootToken bool
+}
+
+// Initialize initializes a Vault server, unless it already is, and stores the
+// init response in a Secret as `init.json`. Each key share is stored under its
+// own `unseal_key_<index>` or `recovery_key_<index>` key. Key shares and the
+// root token are stored as returned by Vault, so they are only encrypted if
+// PGP keys are given.
+//
+// If the server is already initialized, the Secret must exist, since the
+// init response can not be recovered from Vault.
+func Initialize(v *Client, s *SecretsClient, opts InitOptions) error {
+	initialized, err := v.InitStatus()
+	if err != nil {
+		return err
+	}
+	if initialized {
+		log.Printf("[INFO] %v is already initialized.", v.Address)
+		data, err := s.Get(opts.SecretName)
+		if err != nil {
+			return fmt.Errorf("%v is already initialized, but Secret %v can not be read: %v", v.Address, opts.SecretName, err)
+		}
+		if _, ok := data["init.json"]; !ok {
+			return fmt.Errorf("%v is already initialized, but Secret %v has no init.json.", v.Address, opts.SecretName)
+		}
+		return nil
+	}
+
+	if len(opts.PGPKeys) > 0 && len(opts.PGPKeys) != opts.KeyShares {
+		return fmt.Errorf("%v PGP keys given for %v key shares.", len(opts.PGPKeys), opts.KeyShares)
+	}
+
+	req := &InitRequest{RootTokenPGPKey: opts.RootTokenPGPKey}
+	if opts.Recovery {
+		req.RecoveryShares = opts.KeyShares
+		req.RecoveryThreshold = opts.KeyThreshold
+		req.RecoveryPGPKeys = opts.PGPKeys
+	} else {
+		req.SecretShares = opts.KeyShares
+		req.SecretThreshold = opts.KeyThreshold
+		req.PGPKeys = opts.PGPKeys
+	}
+
+	log.Printf("[INFO] Initializing %v.", v.Address)
+	resp, err := v.Init(req)
+	if err != nil {
+		return err
+	}
+
+	if opts.DiscardRootToken {
+		log.Printf("[INFO] Discarding the root token.")
+		resp.RootToken = ""
+	}
+
+	initJSON, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	data := map[string][]byte{"init.json": initJSON}
+
+	prefix, keys := "unseal_key", resp.KeysBase64
+	if opts.Recovery {
+		prefix, keys = "recovery_key", resp.RecoveryKeysBase64
+	}
+	for i, key := range keys {
+		data[fmt.Sprintf("%v_%v", prefix, i)] = []byte(key)
+	}
+
+	log.Printf("[INFO] Storing the init response in Secret %v.", opts.SecretName)
+	return createInitSecret(s, opts.SecretName, data)
+}
+
+// createInitSecret creates the Secret holding the init response, retrying
+// failed attempts. A conflict after a failed attempt is accepted if the
+// existing Secret holds the same init response, since the failed attempt may
+// have created it.
+func createInitSecret(s *SecretsClient, name string, data map[string][]byte) error {
+	for i := 0; ; i++ {
+		err := s.Create(name, data)
+		if err == nil {
+			return nil
+		}
+
+		if statusErr, ok := err.(*StatusError); ok && statusErr.StatusCode == http.StatusConflict {
+			if i > 0 {
+				existing, getErr := s.Get(name)
+				if getErr == nil && bytes.Equal(existing["init.json"], data["init.json"]) {
+					return nil
+				}
+			}
+			return fmt.Errorf("Secret %v already exists, the key shares and root token are lost: %v", name, err)
+		}
+
+		if i == len(createRetryDelays) {
+			return fmt.Errorf("unable to store the init response in Secret %v, the key shares and root token are lost: %v", name, err)
+		}
+		log.Printf("[WARN] Unable to create Secret %v, retrying in %v: %v", name, createRetryDelays[i], err)
+		time.Sleep(createRetryDelays[i])
+	}
+}
+
+// UnsealOptions holds settings used by Unseal.
+type UnsealOptions struct {
+	// SecretName is the name of the Secret holding the unseal keys.
+	SecretName string
+
+	// KeyThreshold is the number of key shares required to unseal.
+	KeyThreshold int
+
+	// RaftLeader is the address of the Raft leader. If set, uninitialized
+	// servers at other addresses are joined to it before being unsealed.
+	RaftLeader string
+
+	// RaftLeaderCACert is the PEM encoded CA certificate used by joining
+	// servers to verify RaftLeader.
+	RaftLeaderCACert string
+}
+
+// Unseal unseals each sealed Vault server with key shares from a Secret.
+// Every server is tried, and errors are returned together. Secrets created
+// by `vault operator init` without the `unseal_key_<index>` keys are read
+// from their `init.json`.
+func Unseal(servers []*Client, s *SecretsClient, opts UnsealOptions) error {
+	data, err := s.Get(opts.SecretName)
+	if err != nil {
+		return err
+	}
+
+	keys, err := unsealKeys(data, opts)
+	if err != nil {
+		return err
+	}
+
+	errs := []string{}
+	for _, v := range servers {
+		if err := unsealServer(v, keys, opts); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", strings.Join(errs, "\n"))
+	}
+
+	return nil
+}
+
+// cliInitResponse holds the key shares of `vault operator init
+// -format=json`, which earlier releases stored as `init.json` without
+// separate `unseal_key_<index>` keys.
+type cliInitResponse struct {
+	UnsealKeysBase64 []string `json:"unseal_keys_b64"`
+}
+
+// unsealKeys returns the key shares up to the threshold from the
+// `unseal_key_<index>` keys of a Secret. Secrets without them fall back to
+// the key shares in `init.json`, in either the API or the CLI format.
+func unsealKeys(data map[string][]byte, opts UnsealOptions) ([]string, error) {
+	initJSON, hasInitJSON := data["init.json"]
+	if _, ok := data["unseal_key_0"]; !ok && hasInitJSON {
+		resp := &InitResponse{}
+		if err := json.Unmarshal(initJSON, resp); err != nil {
+			return nil, fmt.Errorf("invalid init.json in Secret %v: %v", opts.SecretName, err)
+		}
+		keys := resp.KeysBase64
+		if len(keys) == 0 {
+			cliResp := &cliInitResponse{}
+			if err := json.Unmarshal(initJSON, cliResp); err != nil {
+				return nil, fmt.Errorf("invalid init.json in Secret %v: %v", opts.SecretName, err)
+			}
+			keys = cliResp.UnsealKeysBase64
+		}
+		if len(keys) < opts.KeyThreshold {
+			return nil, fmt.Errorf("init.json in Secret %v holds %v unseal key shares, %v are required.", opts.SecretName, len(keys), opts.KeyThreshold)
+		}
+		return keys[:opts.KeyThreshold], nil
+	}
+
+	keys := []string{}
+	for i := 0; i < opts.KeyThreshold; i++ {
+		name := fmt.Sprintf("unseal_key_%v", i)
+		key, ok := data[name]
+		if !ok {
+			return nil, fmt.Errorf("%v missing in Secret %v.", name, opts.SecretName)
+		}
+		keys = append(keys, string(key))
+	}
+	return keys, nil
+}
+
+func unsealServer(v *Client, keys []string, opts UnsealOptions) error {
+	status, err := v.SealStatus()
+	if err != nil {
+		return err
+	}
+	if !status.Sealed {
+		return nil
+	}
+
+	// Join followers to the Raft cluster of the leader.
+	if opts.RaftLeader != "" && v.Address != opts.RaftLeader && !status.Initialized {
+		log.Printf("[INFO] Joining %v to the Raft cluster.", v.Address)
+		if err := v.RaftJoin(opts.RaftLeader, opts.RaftLeaderCACert); err != nil {
+			return err
+		}
+	}
+
+	// Submit key shares up to the threshold.
+	log.Printf("[INFO] Unsealing %v.", v.Address)
+	for _, key := range keys {
+		status, err = v.Unseal(key)
+		if err != nil {
+			return err
+		}
+		if !status.Sealed {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%v is still sealed after submitting %v key shares.", v.Address, len(keys))
+}
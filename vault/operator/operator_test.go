@@ -0,0 +1,447 @@
+package operator
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeVault is a stand-in for the HTTP API of a single Vault server.
+type fakeVault struct {
+	mu sync.Mutex
+
+	initialized bool
+	sealed      bool
+
+	// unsealAfter is the number of key shares which unseal the server.
+	// Zero keeps the server sealed.
+	unsealAfter int
+
+	initRequest *InitRequest
+	initResp    *InitResponse
+	unsealKeys  []string
+	joinedTo    string
+	joinCACert  string
+}
+
+func (v *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	switch {
+	case r.URL.Path == "/v1/sys/init" && r.Method == http.MethodGet:
+		writeJSON(w, map[string]bool{"initialized": v.initialized})
+	case r.URL.Path == "/v1/sys/init" && r.Method == http.MethodPut:
+		v.initRequest = &InitRequest{}
+		if err := json.NewDecoder(r.Body).Decode(v.initRequest); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		v.initialized = true
+		writeJSON(w, v.initResp)
+	case r.URL.Path == "/v1/sys/seal-status":
+		writeJSON(w, &SealStatus{Initialized: v.initialized, Sealed: v.sealed})
+	case r.URL.Path == "/v1/sys/unseal":
+		req := struct {
+			Key string `json:"key"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		v.unsealKeys = append(v.unsealKeys, req.Key)
+		if v.unsealAfter > 0 && len(v.unsealKeys) >= v.unsealAfter {
+			v.sealed = false
+		}
+		writeJSON(w, &SealStatus{Initialized: v.initialized, Sealed: v.sealed, Progress: len(v.unsealKeys)})
+	case r.URL.Path == "/v1/sys/storage/raft/join":
+		req := struct {
+			LeaderAPIAddr string `json:"leader_api_addr"`
+			LeaderCACert  string `json:"leader_ca_cert"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		v.joinedTo, v.joinCACert = req.LeaderAPIAddr, req.LeaderCACert
+		v.initialized = true
+		writeJSON(w, map[string]bool{"joined": true})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// fakeSecrets is a stand-in for the Secrets API of a Kubernetes namespace.
+type fakeSecrets struct {
+	mu sync.Mutex
+
+	secrets map[string]map[string][]byte
+
+	// createFailures is the number of create requests which fail.
+	createFailures int
+
+	// storeFailedCreates stores the Secret of failed create requests, like
+	// a request which times out after the Secret was created.
+	storeFailedCreates bool
+
+	creates int
+}
+
+func (k *fakeSecrets) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	const prefix = "/api/v1/namespaces/example/secrets"
+	if !strings.HasPrefix(r.URL.Path, prefix) {
+		http.NotFound(w, r)
+		return
+	}
+	name := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, prefix), "/")
+
+	switch r.Method {
+	case http.MethodGet:
+		data, ok := k.secrets[name]
+		if !ok {
+			http.Error(w, `{"reason":"NotFound"}`, http.StatusNotFound)
+			return
+		}
+		writeJSON(w, &secret{Data: data})
+	case http.MethodPost:
+		k.creates++
+		s := &secret{}
+		if err := json.NewDecoder(r.Body).Decode(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, ok := k.secrets[s.Metadata.Name]; ok {
+			http.Error(w, `{"reason":"AlreadyExists"}`, http.StatusConflict)
+			return
+		}
+		if k.createFailures > 0 {
+			k.createFailures--
+			if k.storeFailedCreates {
+				k.secrets[s.Metadata.Name] = s.Data
+			}
+			http.Error(w, `{"reason":"InternalError"}`, http.StatusInternalServerError)
+			return
+		}
+		k.secrets[s.Metadata.Name] = s.Data
+		writeJSON(w, s)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func newVault(t *testing.T, v *fakeVault) *Client {
+	srv := httptest.NewServer(v)
+	t.Cleanup(srv.Close)
+	return &Client{Address: srv.URL, HTTPClient: srv.Client()}
+}
+
+func newSecrets(t *testing.T, k *fakeSecrets) *SecretsClient {
+	if k.secrets == nil {
+		k.secrets = map[string]map[string][]byte{}
+	}
+	srv := httptest.NewServer(k)
+	t.Cleanup(srv.Close)
+	return &SecretsClient{Address: srv.URL, Namespace: "example", HTTPClient: srv.Client()}
+}
+
+func noRetryDelays(t *testing.T) {
+	delays := createRetryDelays
+	createRetryDelays = []time.Duration{time.Millisecond, time.Millisecond, time.Millisecond}
+	t.Cleanup(func() { createRetryDelays = delays })
+}
+
+func TestInitialize(t *testing.T) {
+	v := &fakeVault{initResp: &InitResponse{
+		KeysBase64: []string{"a", "b", "c"},
+		RootToken:  "root",
+	}}
+	k := &fakeSecrets{}
+	opts := InitOptions{SecretName: "my-vault-example-unseal", KeyShares: 3, KeyThreshold: 2}
+
+	if err := Initialize(newVault(t, v), newSecrets(t, k), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if v.initRequest.SecretShares != 3 || v.initRequest.SecretThreshold != 2 || v.initRequest.RecoveryShares != 0 {
+		t.Errorf("unexpected init request %+v", v.initRequest)
+	}
+	data := k.secrets[opts.SecretName]
+	for key, want := range map[string]string{"unseal_key_0": "a", "unseal_key_1": "b", "unseal_key_2": "c"} {
+		if got := string(data[key]); got != want {
+			t.Errorf("%v = %q, want %q", key, got, want)
+		}
+	}
+	resp := &InitResponse{}
+	if err := json.Unmarshal(data["init.json"], resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.RootToken != "root" {
+		t.Errorf("root token %q not stored in init.json", resp.RootToken)
+	}
+}
+
+func TestInitializeAlreadyInitialized(t *testing.T) {
+	opts := InitOptions{SecretName: "my-vault-example-unseal", KeyShares: 1, KeyThreshold: 1}
+
+	t.Run("secret exists", func(t *testing.T) {
+		v := &fakeVault{initialized: true}
+		k := &fakeSecrets{secrets: map[string]map[string][]byte{
+			opts.SecretName: {"init.json": []byte("{}")},
+		}}
+		if err := Initialize(newVault(t, v), newSecrets(t, k), opts); err != nil {
+			t.Fatal(err)
+		}
+		if v.initRequest != nil || k.creates != 0 {
+			t.Errorf("already initialized server was initialized again")
+		}
+	})
+
+	t.Run("secret missing", func(t *testing.T) {
+		v := &fakeVault{initialized: true}
+		k := &fakeSecrets{}
+		err := Initialize(newVault(t, v), newSecrets(t, k), opts)
+		if err == nil || !strings.Contains(err.Error(), "already initialized") {
+			t.Fatalf("expected an error for the missing Secret, got %v", err)
+		}
+	})
+}
+
+func TestInitializePGPKeyMismatch(t *testing.T) {
+	v := &fakeVault{}
+	k := &fakeSecrets{}
+	opts := InitOptions{
+		SecretName:   "my-vault-example-unseal",
+		KeyShares:    3,
+		KeyThreshold: 2,
+		PGPKeys:      []string{"key0", "key1"},
+	}
+
+	if err := Initialize(newVault(t, v), newSecrets(t, k), opts); err == nil {
+		t.Fatal("expected an error for 2 PGP keys with 3 key shares")
+	}
+	if v.initRequest != nil {
+		t.Errorf("server was initialized despite the PGP key mismatch")
+	}
+}
+
+func TestInitializeRecovery(t *testing.T) {
+	v := &fakeVault{initResp: &InitResponse{
+		RecoveryKeysBase64: []string{"r0", "r1"},
+		RootToken:          "root",
+	}}
+	k := &fakeSecrets{}
+	opts := InitOptions{
+		SecretName:   "my-vault-example-unseal",
+		KeyShares:    2,
+		KeyThreshold: 2,
+		Recovery:     true,
+		PGPKeys:      []string{"key0", "key1"},
+	}
+
+	if err := Initialize(newVault(t, v), newSecrets(t, k), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	req := v.initRequest
+	if req.RecoveryShares != 2 || req.RecoveryThreshold != 2 || req.SecretShares != 0 {
+		t.Errorf("unexpected init request %+v", req)
+	}
+	if len(req.RecoveryPGPKeys) != 2 || len(req.PGPKeys) != 0 {
+		t.Errorf("PGP keys not sent as recovery_pgp_keys: %+v", req)
+	}
+	data := k.secrets[opts.SecretName]
+	if string(data["recovery_key_0"]) != "r0" || string(data["recovery_key_1"]) != "r1" {
+		t.Errorf("recovery keys not stored: %v", data)
+	}
+	if _, ok := data["unseal_key_0"]; ok {
+		t.Errorf("unseal_key_0 stored for recovery keys")
+	}
+}
+
+func TestInitializeDiscardRootToken(t *testing.T) {
+	v := &fakeVault{initResp: &InitResponse{
+		KeysBase64: []string{"a"},
+		RootToken:  "root",
+	}}
+	k := &fakeSecrets{}
+	opts := InitOptions{
+		SecretName:       "my-vault-example-unseal",
+		KeyShares:        1,
+		KeyThreshold:     1,
+		DiscardRootToken: true,
+	}
+
+	if err := Initialize(newVault(t, v), newSecrets(t, k), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	initJSON := string(k.secrets[opts.SecretName]["init.json"])
+	if strings.Contains(initJSON, "root") {
+		t.Errorf("root token stored in init.json: %v", initJSON)
+	}
+}
+
+func TestInitializeCreateRetry(t *testing.T) {
+	noRetryDelays(t)
+	opts := InitOptions{SecretName: "my-vault-example-unseal", KeyShares: 1, KeyThreshold: 1}
+
+	tests := []struct {
+		name    string
+		secrets *fakeSecrets
+		wantErr bool
+	}{
+		{"transient failures", &fakeSecrets{createFailures: 2}, false},
+		{"failed create stored the secret", &fakeSecrets{createFailures: 1, storeFailedCreates: true}, false},
+		{"persistent failures", &fakeSecrets{createFailures: 10}, true},
+		{"existing secret", &fakeSecrets{secrets: map[string]map[string][]byte{
+			opts.SecretName: {"init.json": []byte("{}")},
+		}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := &fakeVault{initResp: &InitResponse{KeysBase64: []string{"a"}}}
+			err := Initialize(newVault(t, v), newSecrets(t, tt.secrets), opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(tt.secrets.secrets[opts.SecretName]["unseal_key_0"]) != "a" {
+				t.Errorf("init response not stored")
+			}
+		})
+	}
+}
+
+func TestUnseal(t *testing.T) {
+	opts := UnsealOptions{SecretName: "my-vault-example-unseal", KeyThreshold: 2}
+	k := &fakeSecrets{secrets: map[string]map[string][]byte{
+		opts.SecretName: {"unseal_key_0": []byte("a"), "unseal_key_1": []byte("b"), "unseal_key_2": []byte("c")},
+	}}
+	sealed := &fakeVault{initialized: true, sealed: true, unsealAfter: 2}
+	unsealed := &fakeVault{initialized: true}
+
+	servers := []*Client{newVault(t, sealed), newVault(t, unsealed)}
+	if err := Unseal(servers, newSecrets(t, k), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if sealed.sealed || strings.Join(sealed.unsealKeys, ",") != "a,b" {
+		t.Errorf("expected unseal with keys a,b, got sealed %v with keys %v", sealed.sealed, sealed.unsealKeys)
+	}
+	if len(unsealed.unsealKeys) != 0 {
+		t.Errorf("keys submitted to an unsealed server")
+	}
+}
+
+func TestUnsealMissingKey(t *testing.T) {
+	opts := UnsealOptions{SecretName: "my-vault-example-unseal", KeyThreshold: 2}
+	k := &fakeSecrets{secrets: map[string]map[string][]byte{
+		opts.SecretName: {"unseal_key_0": []byte("a")},
+	}}
+	v := &fakeVault{initialized: true, sealed: true, unsealAfter: 2}
+
+	err := Unseal([]*Client{newVault(t, v)}, newSecrets(t, k), opts)
+	if err == nil || !strings.Contains(err.Error(), "unseal_key_1") {
+		t.Fatalf("expected an error for the missing unseal_key_1, got %v", err)
+	}
+	if len(v.unsealKeys) != 0 {
+		t.Errorf("keys submitted despite the missing key share")
+	}
+}
+
+func TestUnsealInitJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		initJSON string
+		wantErr  string
+	}{
+		{"cli format", `{"unseal_keys_b64":["a","b","c"],"unseal_keys_hex":["0a","0b","0c"],"root_token":"s.root"}`, ""},
+		{"api format", `{"keys":["0a","0b","0c"],"keys_base64":["a","b","c"],"root_token":"s.root"}`, ""},
+		{"too few keys", `{"unseal_keys_b64":["a"]}`, "init.json in Secret my-vault-example-unseal holds 1 unseal key shares, 2 are required."},
+		{"invalid", `not json`, "invalid init.json in Secret my-vault-example-unseal"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := UnsealOptions{SecretName: "my-vault-example-unseal", KeyThreshold: 2}
+			k := &fakeSecrets{secrets: map[string]map[string][]byte{
+				opts.SecretName: {"init.json": []byte(tt.initJSON)},
+			}}
+			v := &fakeVault{initialized: true, sealed: true, unsealAfter: 2}
+
+			err := Unseal([]*Client{newVault(t, v)}, newSecrets(t, k), opts)
+			if tt.wantErr != "" {
+				if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want %v", err, tt.wantErr)
+				}
+				if len(v.unsealKeys) != 0 {
+					t.Errorf("keys submitted despite the error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v.sealed || strings.Join(v.unsealKeys, ",") != "a,b" {
+				t.Errorf("expected unseal with keys a,b, got sealed %v with keys %v", v.sealed, v.unsealKeys)
+			}
+		})
+	}
+}
+
+func TestUnsealRaftJoin(t *testing.T) {
+	k := &fakeSecrets{secrets: map[string]map[string][]byte{
+		"my-vault-example-unseal": {"unseal_key_0": []byte("a")},
+	}}
+	leader := &fakeVault{initialized: true, sealed: true, unsealAfter: 1}
+	follower := &fakeVault{sealed: true, unsealAfter: 1}
+	leaderClient, followerClient := newVault(t, leader), newVault(t, follower)
+
+	opts := UnsealOptions{
+		SecretName:       "my-vault-example-unseal",
+		KeyThreshold:     1,
+		RaftLeader:       leaderClient.Address,
+		RaftLeaderCACert: "ca",
+	}
+	if err := Unseal([]*Client{leaderClient, followerClient}, newSecrets(t, k), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if leader.joinedTo != "" {
+		t.Errorf("leader joined %v", leader.joinedTo)
+	}
+	if follower.joinedTo != leaderClient.Address || follower.joinCACert != "ca" {
+		t.Errorf("follower joined %q with CA %q, want %q", follower.joinedTo, follower.joinCACert, leaderClient.Address)
+	}
+	if leader.sealed || follower.sealed {
+		t.Errorf("servers still sealed, leader %v, follower %v", leader.sealed, follower.sealed)
+	}
+}
+
+func TestUnsealStillSealed(t *testing.T) {
+	opts := UnsealOptions{SecretName: "my-vault-example-unseal", KeyThreshold: 2}
+	k := &fakeSecrets{secrets: map[string]map[string][]byte{
+		opts.SecretName: {"unseal_key_0": []byte("a"), "unseal_key_1": []byte("b")},
+	}}
+	stuck := &fakeVault{initialized: true, sealed: true}
+	ok := &fakeVault{initialized: true, sealed: true, unsealAfter: 2}
+	stuckClient := newVault(t, stuck)
+
+	err := Unseal([]*Client{stuckClient, newVault(t, ok)}, newSecrets(t, k), opts)
+	if err == nil || !strings.Contains(err.Error(), stuckClient.Address+" is still sealed") {
+		t.Fatalf("expected a still sealed error, got %v", err)
+	}
+	if ok.sealed {
+		t.Errorf("other servers not unsealed after an error")
+	}
+}
@@ -0,0 +1,173 @@
+package operator
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// SecretsClient reads and creates Secrets in a namespace through the
+// Kubernetes API.
+type SecretsClient struct {
+	// Address is the URL of the Kubernetes API server.
+	Address string
+
+	// Namespace is the namespace of the Secrets.
+	Namespace string
+
+	// Token is sent as a bearer token, if set.
+	Token string
+
+	// HTTPClient is used to send requests.
+	HTTPClient *http.Client
+}
+
+// InClusterSecretsClient returns a SecretsClient for the namespace of the
+// Pod it runs in, authenticated as the Pod's ServiceAccount.
+func InClusterSecretsClient() (*SecretsClient, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT must be set.")
+	}
+
+	token, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return nil, err
+	}
+	ns, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "namespace"))
+	if err != nil {
+		return nil, err
+	}
+	caPEM, err := ioutil.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return nil, fmt.Errorf("no certificates found in the ServiceAccount ca.crt.")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+
+	return &SecretsClient{
+		Address:   "https://" + net.JoinHostPort(host, port),
+		Namespace: strings.TrimSpace(string(ns)),
+		Token:     strings.TrimSpace(string(token)),
+		HTTPClient: &http.Client{
+			Timeout:   30 * time.Second,
+			Transport: transport,
+		},
+	}, nil
+}
+
+// StatusError is returned for unsuccessful responses of the Kubernetes API.
+type StatusError struct {
+	Method, URL, Status string
+	StatusCode          int
+	Body                []byte
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%v %v: %v: %s", e.Method, e.URL, e.Status, e.Body)
+}
+
+// secret is the subset of a Kubernetes Secret used by SecretsClient. Values
+// of Data are base64 encoded in JSON, which encoding/json handles for []byte.
+type secret struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   secretMeta        `json:"metadata"`
+	Data       map[string][]byte `json:"data"`
+}
+
+type secretMeta struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+}
+
+// Get returns the data of the Secret with the given name.
+func (c *SecretsClient) Get(name string) (map[string][]byte, error) {
+	s := &secret{}
+	if err := c.do(http.MethodGet, "/"+name, nil, s); err != nil {
+		return nil, err
+	}
+	return s.Data, nil
+}
+
+// Create creates a Secret with the given name and data. It fails if the
+// Secret already exists.
+func (c *SecretsClient) Create(name string, data map[string][]byte) error {
+	s := &secret{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata:   secretMeta{Name: name, Namespace: c.Namespace},
+		Data:       data,
+	}
+	return c.do(http.MethodPost, "", s, nil)
+}
+
+func (c *SecretsClient) do(method, path string, in, out interface{}) error {
+	url := fmt.Sprintf("%v/api/v1/namespaces/%v/secrets%v", strings.TrimSuffix(c.Address, "/"), c.Namespace, path)
+
+	var body []byte
+	if in != nil {
+		b, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = b
+	}
+
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &StatusError{
+			Method:     method,
+			URL:        url,
+			Status:     resp.Status,
+			StatusCode: resp.StatusCode,
+			Body:       bytes.TrimSpace(respBody),
+		}
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(respBody, out)
+}
@@ -0,0 +1,212 @@
+package vault
+
+import (
+	"fmt"
+
+	"sigs.k8s.io/kustomize/kyaml/kio"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+// sealTransit returns the Vault config function with the given name and
+// namespace from the input, populated with its settings.
+func sealTransit(in []*yaml.RNode, name, ns string) (*ConfigFunction, error) {
+	for _, r := range in {
+		rMeta, err := r.GetMeta()
+		if err != nil {
+			return nil, err
+		}
+
+		if rMeta.Kind != "ConfigMap" ||
+			rMeta.Name != name ||
+			rMeta.Namespace != ns {
+			continue
+		}
+
+		// Only options are used, so Vault instances referring to each
+		// other are not looked up recursively.
+		vaultFunc := &ConfigFunction{}
+		vaultFunc.RW = &kio.ByteReadWriter{FunctionConfig: r}
+		if err := vaultFunc.syncOptions(); err != nil {
+			return nil, err
+		}
+
+		return vaultFunc, nil
+	}
+
+	return nil, fmt.Errorf("seal_transit_instance requires Vault function config %v/%v in the input.", ns, name)
+}
+
+// removeUnsealResources filters out unseal Job and unsealer Resources from a
+// previous run, which are not used with auto-unseal.
+func (f *ConfigFunction) removeUnsealResources(in []*yaml.RNode) ([]*yaml.RNode, error) {
+	unsealRs := map[string][]string{
+		"Job":            {f.Name + "-unseal"},
+		"Deployment":     {f.Name + "-unsealer"},
+		"ServiceAccount": {f.Name + "-unseal", f.Name + "-unsealer"},
+		"Role":           {f.Name + "-unseal", f.Name + "-unsealer"},
+		"RoleBinding":    {f.Name + "-unseal", f.Name + "-unsealer"},
+	}
+
+	out := []*yaml.RNode{}
+	for _, r := range in {
+		rMeta, err := r.GetMeta()
+		if err != nil {
+			return nil, err
+		}
+
+		remove := false
+		if rMeta.Namespace == f.Namespace {
+			for _, name := range unsealRs[rMeta.Kind] {
+				if rMeta.Name == name {
+					remove = true
+				}
+			}
+		}
+		if !remove {
+			out = append(out, r)
+		}
+	}
+
+	return out, nil
+}
+
+func sealTransitTokenJobTemplates() map[string]string {
+	return map[string]string{
+		"transit-token-job":         sealTransitTokenJobTemplate,
+		"transit-token-sa":          sealTransitTokenSATemplate,
+		"transit-token-role":        sealTransitTokenRoleTemplate,
+		"transit-token-rolebinding": sealTransitTokenRoleBindingTemplate,
+	}
+}
+
+var sealTransitTokenJobTemplate = `apiVersion: batch/v1
+kind: Job
+metadata:
+  name: {{ .Name }}-transit-token
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+spec:
+  template:
+    spec:
+      serviceAccountName: {{ .Name }}-transit-token
+      restartPolicy: OnFailure
+      initContainers:
+        - name: create-transit-token
+          image: docker.io/library/vault:1.4.0
+          command:
+            - /bin/sh
+            - -ec
+            - |-
+              mount_path="{{ .Data.SealTransitMountPath }}"
+              key_name="{{ .Data.SealTransitKeyName }}"
+              policy_name="{{ .Name }}-{{ .Namespace }}-auto-unseal"
+
+              VAULT_TOKEN="$(\
+                sed -n 's/.*"root_token": *"\([^"]*\)".*/\1/p' \
+                  /vault/transit/init/init.json \
+              )"
+              export VAULT_TOKEN
+
+              if ! vault secrets list -format=json | grep -q "\"${mount_path}\""; then
+                echo "[INFO] Enabling the transit secrets engine at ${mount_path}."
+                vault secrets enable -path="${mount_path}" transit
+              fi
+
+              echo "[INFO] Creating transit key ${key_name}."
+              vault write -f "${mount_path}keys/${key_name}"
+
+              echo "[INFO] Creating auto-unseal policy ${policy_name}."
+              vault policy write "${policy_name}" - <<EOF
+              path "${mount_path}encrypt/${key_name}" {
+                capabilities = ["update"]
+              }
+              path "${mount_path}decrypt/${key_name}" {
+                capabilities = ["update"]
+              }
+              EOF
+
+              echo "[INFO] Creating auto-unseal token."
+              vault token create -orphan -period=24h \
+                -policy="${policy_name}" -field=token \
+                > /vault/transit/generated/token
+          env:
+            - name: VAULT_ADDR
+              value: https://{{ .SealTransit.Name }}-server.{{ .SealTransit.Namespace }}.svc:8200
+            - name: VAULT_CACERT
+              value: /vault/transit/tls/ca.pem
+          volumeMounts:
+            - name: transit-init
+              mountPath: /vault/transit/init
+            - name: transit-tls
+              mountPath: /vault/transit/tls
+            - name: transit-token
+              mountPath: /vault/transit/generated
+      containers:
+        - name: create-transit-token-secret
+          image: k8s.gcr.io/hyperkube:v1.17.4
+          command:
+            - /bin/sh
+            - -ec
+            - |-
+              kubectl create secret generic \
+                "--from-file=/vault/transit/generated/token" \
+                "{{ .Data.SealTransitTokenSecretName }}"
+          volumeMounts:
+            - name: transit-token
+              mountPath: /vault/transit/generated
+      volumes:
+        - name: transit-init
+          secret:
+            secretName: {{ .SealTransit.Data.UnsealSecretName }}
+        - name: transit-tls
+          secret:
+            secretName: {{ .SealTransit.Name }}-server-tls
+        - name: transit-token
+          emptyDir: {}
+`
+
+var sealTransitTokenSATemplate = `apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: {{ .Name }}-transit-token
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+`
+
+var sealTransitTokenRoleTemplate = `apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: {{ .Name }}-transit-token
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+rules:
+  - apiGroups:
+      - ""
+    resources:
+      - secrets
+    verbs:
+      - create
+`
+
+var sealTransitTokenRoleBindingTemplate = `apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: {{ .Name }}-transit-token
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: Role
+  name: {{ .Name }}-transit-token
+subjects:
+  - kind: ServiceAccount
+    name: {{ .Name }}-transit-token
+`
@@ -8,6 +8,12 @@ func serverTemplates() map[string]string {
 	}
 }
 
+func serverInternalSvcTemplates() map[string]string {
+	return map[string]string{
+		"server-internal-svc": serverInternalSvcTemplate,
+	}
+}
+
 var serverCmTemplate = `apiVersion: v1
 kind: ConfigMap
 metadata:
@@ -23,11 +29,49 @@ data:
       cluster_address = "[::]:8201"
       tls_cert_file = "/vault/tls/server.pem"
       tls_key_file  = "/vault/tls/server-key.pem"
+      tls_client_ca_file = "/vault/tls/ca.pem"
     }
+{{- if .SealTransit }}
+  00-server-seal.hcl: |-
+    seal "transit" {
+      address = "https://{{ .SealTransit.Name }}-server.{{ .SealTransit.Namespace }}.svc:8200"
+      key_name = "{{ .Data.SealTransitKeyName }}"
+      mount_path = "{{ .Data.SealTransitMountPath }}"
+      tls_ca_cert = "/vault/transit/tls/ca.pem"
+    }
+{{- else if .Data.SealHCL }}
+  00-server-seal.hcl: |-
+{{ .Data.SealConfig }}
+{{- end }}
   00-server-storage-backend.hcl: |-
+{{- if .ConsulStorage }}
+    storage "consul" {
+      address = "127.0.0.1:8500"
+      path = "{{ .Data.ConsulStoragePath }}"
+{{- if .ConsulStorage.Data.TLSGeneratorJobEnabled }}
+      scheme = "https"
+      tls_ca_file = "/consul/tls/consul-agent-ca.pem"
+      tls_cert_file = "/consul/tls/dc1-cli-consul-0.pem"
+      tls_key_file = "/consul/tls/dc1-cli-consul-0-key.pem"
+{{- else }}
+      scheme = "http"
+{{- end }}
+    }
+{{- else if .Data.RaftStorageEnabled }}
+    storage "raft" {
+      path = "/vault/data"
+{{- range .Hostnames }}
+      retry_join {
+        leader_api_addr = "https://{{ . }}.{{ $.ServerServiceName }}:8200"
+        leader_ca_cert_file = "/vault/tls/ca.pem"
+      }
+{{- end }}
+    }
+{{- else }}
     storage "file" {
       path = "/vault/data"
     }
+{{- end }}
 `
 
 var serverStsTemplate = `apiVersion: apps/v1
@@ -38,8 +82,35 @@ metadata:
   labels:
     app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
     app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+{{- if .ConsulStorage }}
+  annotations:
+    config.bzub.dev/consul-agent-sidecar-injector: |-
+      metadata:
+        name: {{ .ConsulStorage.Name }}
+        namespace: {{ .ConsulStorage.Namespace }}
+{{- if .ConsulStorage.Data.ACLBootstrapJobEnabled }}
+      data:
+        agent_token_secret_name: {{ .Data.ConsulStorageTokenSecretName }}
+        acl_token_rules: |-
+          key_prefix "{{ .Data.ConsulStoragePath }}" {
+            policy = "write"
+          }
+          service "vault" {
+            policy = "write"
+          }
+          agent_prefix "" {
+            policy = "read"
+          }
+          session_prefix "" {
+            policy = "write"
+          }
+{{- end }}
+{{- end }}
 spec:
-  serviceName: {{ .Name }}-server
+{{- if .Data.RaftStorageEnabled }}
+  replicas: 1 # {"description":"Vault server replicas.","type":"integer","x-kustomize":{"setter":{"name":"{{ .Name }}-replicas","value":"1"}}}
+{{- end }}
+  serviceName: {{ .ServerServiceName }}
   podManagementPolicy: Parallel
   updateStrategy:
     type: RollingUpdate
@@ -71,7 +142,7 @@ spec:
               mountPath: /vault/tls
       containers:
         - name: vault-server
-          image: docker.io/library/vault:1.3.2
+          image: docker.io/library/vault:1.4.0
           command:
             - /usr/local/bin/docker-entrypoint.sh
             - vault
@@ -85,6 +156,34 @@ spec:
               value: https://127.0.0.1:8200
             - name: VAULT_CACERT
               value: /vault/tls/ca.pem
+{{- if .SealTransit }}
+            - name: VAULT_TOKEN
+              valueFrom:
+                secretKeyRef:
+                  name: {{ .Data.SealTransitTokenSecretName }}
+                  key: token
+{{- end }}
+{{- if .Data.RaftStorageEnabled }}
+            - name: POD_NAME
+              valueFrom:
+                fieldRef:
+                  fieldPath: metadata.name
+            - name: VAULT_RAFT_NODE_ID
+              value: $(POD_NAME)
+            - name: VAULT_API_ADDR
+              value: https://$(POD_NAME).{{ .ServerServiceName }}:8200
+            - name: VAULT_CLUSTER_ADDR
+              value: https://$(POD_NAME).{{ .ServerServiceName }}:8201
+{{- end }}
+{{- if .ConsulStorage }}
+{{- if .ConsulStorage.Data.ACLBootstrapJobEnabled }}
+            - name: CONSUL_HTTP_TOKEN
+              valueFrom:
+                secretKeyRef:
+                  name: {{ .Data.ConsulStorageTokenSecretName }}
+                  key: secret_id.txt
+{{- end }}
+{{- end }}
           lifecycle:
             preStop:
               exec:
@@ -115,7 +214,28 @@ spec:
             - name: vault-server-tls
               mountPath: /vault/tls
               readOnly: true
+{{- if .Data.RaftStorageEnabled }}
+            - name: vault-data
+              mountPath: /vault/data
+{{- end }}
+{{- if .SealTransit }}
+            - name: vault-transit-tls
+              mountPath: /vault/transit/tls
+              readOnly: true
+{{- end }}
+{{- if .ConsulStorage }}
+{{- if .ConsulStorage.Data.TLSGeneratorJobEnabled }}
+            - name: consul-tls-secret
+              mountPath: /consul/tls
+              readOnly: true
+{{- end }}
+{{- end }}
       volumes:
+{{- if .SealTransit }}
+        - name: vault-transit-tls
+          secret:
+            secretName: {{ .SealTransit.Name }}-server-tls
+{{- end }}
         - name: vault-configs
           projected:
             sources:
@@ -127,6 +247,20 @@ spec:
             sources:
               - secret:
                   name: {{ .Name }}-server-tls
+{{- if .Data.RaftStorageEnabled }}
+  volumeClaimTemplates:
+    - metadata:
+        name: vault-data
+      spec:
+        accessModes:
+          - ReadWriteOnce
+{{- if .Data.RaftStorageClass }}
+        storageClassName: {{ .Data.RaftStorageClass }}
+{{- end }}
+        resources:
+          requests:
+            storage: {{ .Data.RaftStorageSize }}
+{{- end }}
 `
 
 var serverSvcTemplate = `apiVersion: v1
@@ -150,3 +284,27 @@ spec:
       port: 8201
       targetPort: 8201
 `
+
+var serverInternalSvcTemplate = `apiVersion: v1
+kind: Service
+metadata:
+  name: {{ .Name }}-server-internal
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+spec:
+  selector:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+  # Raft peers and the operator Jobs address servers by Pod DNS names.
+  clusterIP: None
+  publishNotReadyAddresses: true
+  ports:
+    - name: https
+      port: 8200
+      targetPort: 8200
+    - name: internal
+      port: 8201
+      targetPort: 8201
+`
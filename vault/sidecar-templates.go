@@ -0,0 +1,272 @@
+package vault
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bzub/config-functions/cfunc"
+	"sigs.k8s.io/kustomize/kyaml/yaml"
+)
+
+const vasiAnnotation = "config.bzub.dev/vault-agent-sidecar-injector"
+
+// vasiConfig holds information used to patch workload Resources with Vault
+// Agent containers.
+type vasiConfig struct {
+	// PatchTarget contains Resource metadata from a workload to be
+	// patched.
+	PatchTarget yaml.ResourceMeta
+
+	// Agent contains per-workload options from the injector annotation.
+	Agent AgentSidecarOptions
+
+	// Containers holds the names of the workload's containers which mount
+	// the rendered secrets.
+	Containers []string
+
+	// FunctionConfig contains information used to configure Vault Agent.
+	*ConfigFunction
+}
+
+func (f *ConfigFunction) sidecarPatches(in []*yaml.RNode) ([]*yaml.RNode, error) {
+	patches := []*yaml.RNode{}
+	for _, r := range in {
+		aValue, err := r.Pipe(yaml.GetAnnotation(vasiAnnotation))
+		if err != nil {
+			return nil, err
+		}
+		if aValue == nil {
+			continue
+		}
+
+		config, err := yaml.Parse(aValue.Document().Value)
+		if err != nil {
+			return nil, err
+		}
+
+		// Determine if sidecar injector config name matches this Vault
+		// instance.
+		cName, err := config.Pipe(yaml.Lookup("metadata", "name"))
+		switch {
+		case err != nil:
+			return nil, err
+		case cName == nil:
+			return nil, fmt.Errorf("metadata.name missing in config.")
+		case cName.Document().Value != f.Name:
+			continue
+		}
+
+		// Determine if sidecar injector config namespace matches this
+		// Vault instance.
+		cNS, err := config.Pipe(yaml.Lookup("metadata", "namespace"))
+		switch {
+		case err != nil:
+			return nil, err
+		case cNS == nil:
+			return nil, fmt.Errorf("metadata.namespace missing in config.")
+		case cNS.Document().Value != f.Namespace:
+			continue
+		}
+
+		// Read per-workload agent options.
+		agentOpts := AgentSidecarOptions{
+			AuthPath:  "kubernetes",
+			MountPath: "/vault/secrets",
+		}
+		cData, err := config.Pipe(yaml.Lookup("data"))
+		if err != nil {
+			return nil, err
+		}
+		if cData != nil {
+			err := yaml.Unmarshal([]byte(cData.MustString()), &agentOpts)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		rMeta, err := r.GetMeta()
+		if err != nil {
+			return nil, err
+		}
+		if agentOpts.Role == "" {
+			return nil, fmt.Errorf("role is required by the %v annotation of %v %v.", vasiAnnotation, rMeta.Kind, rMeta.Name)
+		}
+
+		// The agent reads the CA certificate from the server TLS
+		// Secret, which only exists in Vault's namespace.
+		if rMeta.Namespace != f.Namespace {
+			return nil, fmt.Errorf("%v %v must be in the %v namespace to use the %v annotation.", rMeta.Kind, rMeta.Name, f.Namespace, vasiAnnotation)
+		}
+
+		// Collect container names to mount secrets into.
+		names := agentOpts.Containers
+		if len(names) == 0 {
+			containers, err := r.Pipe(yaml.Lookup("spec", "template", "spec", "containers"))
+			if err != nil {
+				return nil, err
+			}
+			if containers == nil {
+				return nil, fmt.Errorf("%v %v has no containers to configure.", rMeta.Kind, rMeta.Name)
+			}
+			err = containers.VisitElements(func(c *yaml.RNode) error {
+				name, err := c.Pipe(yaml.Lookup("name"))
+				if err != nil {
+					return err
+				}
+				if name != nil && name.Document().Value != "vault-agent" {
+					names = append(names, name.Document().Value)
+				}
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		patchCfg := &vasiConfig{
+			PatchTarget:    rMeta,
+			Agent:          agentOpts,
+			Containers:     names,
+			ConfigFunction: f,
+		}
+
+		// Create a Vault Agent patch for this Resource.
+		agentPatch, err := cfunc.ParseTemplate(
+			"vault-agent-patch", vaultAgentPatchTemplate, patchCfg,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		// Create a ConfigMap with this workload's agent configuration.
+		agentCM, err := cfunc.ParseTemplate(
+			"vault-agent-cm", vaultAgentCMTemplate, patchCfg,
+		)
+		if err != nil {
+			return nil, err
+		}
+		patches = append(patches, agentPatch, agentCM)
+	}
+
+	return patches, nil
+}
+
+// parseList splits a comma separated list, ignoring empty entries.
+func parseList(value string) []string {
+	names := []string{}
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+var vaultAgentCMTemplate = `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: {{ .PatchTarget.Name }}-vault-agent
+  namespace: "{{ .PatchTarget.Namespace }}"
+data:
+  agent.hcl: |-
+    pid_file = "/home/vault/pidfile"
+
+    vault {
+      address = "https://{{ .Name }}-server.{{ .Namespace }}.svc:8200"
+      ca_cert = "/vault/tls/ca.pem"
+    }
+
+    auto_auth {
+      method "kubernetes" {
+        mount_path = "auth/{{ .Agent.AuthPath }}"
+        config = {
+          role = "{{ .Agent.Role }}"
+        }
+      }
+
+      sink "file" {
+        config = {
+          path = "/home/vault/.token"
+        }
+      }
+    }
+{{- range $file, $tmpl := .Agent.Templates }}
+
+    template {
+      source = "/vault/agent/{{ $file }}.ctmpl"
+      destination = "{{ $.Agent.MountPath }}/{{ $file }}"
+    }
+{{- end }}
+{{- range $file, $tmpl := .Agent.Templates }}
+  {{ $file }}.ctmpl: {{ quote $tmpl }}
+{{- end }}
+`
+
+var vaultAgentPatchTemplate = `apiVersion: {{ .PatchTarget.APIVersion }}
+kind: {{ .PatchTarget.Kind }}
+metadata:
+  name: {{ .PatchTarget.Name }}
+  namespace: "{{ .PatchTarget.Namespace }}"
+spec:
+  template:
+    spec:
+      initContainers:
+        - name: vault-agent-init
+          image: docker.io/library/vault:1.4.0
+          command:
+            - vault
+            - agent
+            - -config=/vault/agent/agent.hcl
+            - -exit-after-auth
+          volumeMounts:
+            - name: vault-agent-config
+              mountPath: /vault/agent
+            - name: vault-agent-home
+              mountPath: /home/vault
+            - name: vault-agent-tls
+              mountPath: /vault/tls
+            - name: vault-secrets
+              mountPath: {{ .Agent.MountPath }}
+      containers:
+{{- if not .Agent.InitOnly }}
+        - name: vault-agent
+          image: docker.io/library/vault:1.4.0
+          command:
+            - vault
+            - agent
+            - -config=/vault/agent/agent.hcl
+          volumeMounts:
+            - name: vault-agent-config
+              mountPath: /vault/agent
+            - name: vault-agent-home
+              mountPath: /home/vault
+            - name: vault-agent-tls
+              mountPath: /vault/tls
+            - name: vault-secrets
+              mountPath: {{ .Agent.MountPath }}
+{{- end }}
+{{- range .Containers }}
+        - name: {{ . }}
+          volumeMounts:
+            - name: vault-secrets
+              mountPath: {{ $.Agent.MountPath }}
+              readOnly: true
+{{- end }}
+      volumes:
+        - name: vault-agent-config
+          configMap:
+            name: {{ .PatchTarget.Name }}-vault-agent
+        - name: vault-agent-home
+          emptyDir:
+            medium: Memory
+        - name: vault-secrets
+          emptyDir:
+            medium: Memory
+        # Only the CA certificate is taken from the server TLS Secret.
+        - name: vault-agent-tls
+          secret:
+            secretName: {{ .Name }}-server-tls
+            items:
+              - key: ca.pem
+                path: ca.pem
+`
@@ -24,6 +24,14 @@ data:
                 "key encipherment",
                 "server auth"
               ]
+            },
+            "client": {
+              "expiry": "8760h",
+              "usages": [
+                "signing",
+                "key encipherment",
+                "client auth"
+              ]
             }
         }
       },
@@ -59,7 +67,13 @@ data:
         "{{ $.Name }}-server",
         "{{ $.Name }}-server.{{ $.Namespace }}.svc",
         "{{ $hostname }}",
-        "{{ $hostname }}.{{ $.Name }}-server"
+        "{{ $hostname }}.{{ $.ServerServiceName }}"
+{{- range $.Data.TLSExtraDNSNames }},
+        "{{ . }}"
+{{- end }}
+{{- range $.Data.TLSExtraIPAddresses }},
+        "{{ . }}"
+{{- end }}
       ],
       "key": {
         "algo": "rsa",
@@ -74,4 +88,19 @@ data:
       ]
     }
 {{ end }}
+  cli_client_csr.json: |-
+    {
+      "CN": "vault-cli",
+      "key": {
+        "algo": "rsa",
+        "size": 2048
+      },
+      "names": [
+        {
+          "C": "US",
+          "ST": "CA",
+          "L": "San Francisco"
+        }
+      ]
+    }
 `
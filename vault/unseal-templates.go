@@ -24,41 +24,29 @@ spec:
       restartPolicy: OnFailure
       containers:
         - name: vault-unseal
-          image: k8s.gcr.io/hyperkube:v1.17.4
+          image: {{ .Data.OperatorImage }}
           command:
-            - /bin/sh
-            - -ec
-            - |-
-              secrets_dir="/vault/secrets"
-
-              # TODO: Support multiple keys
-              unseal_key_b64="$(\
-                cat /vault/secrets/init.json |\
-                  jq -r '.unseal_keys_b64[0]' \
-              )"
-
-              vault_server_pods="$(\
-                kubectl get pods -o name \
-                -l "app.kubernetes.io/name=vault-server" \
-                -l "app.kubernetes.io/instance={{ .Name }}" \
-              )"
-
-              for pod in ${vault_server_pods}; do
-                kubectl exec "${pod}" -c vault-server -- \
-                  vault operator unseal "${unseal_key_b64}"
-              done
-          envFrom:
-            - configMapRef:
-                name: my-vault
+            - vault-operator
+            - unseal
+            - -ca-cert=/vault/tls/ca.pem
+{{- if .Data.TLSGeneratorJobEnabled }}
+            - -client-cert=/vault/tls/cli-client.pem
+            - -client-key=/vault/tls/cli-client-key.pem
+{{- end }}
+            - -address={{ range $i, $h := .Hostnames }}{{ if $i }},{{ end }}https://{{ $h }}.{{ $.ServerServiceName }}:8200{{ end }}
+            - -key-threshold={{ .Data.KeyThreshold }}
+            - -secret-name={{ .Data.UnsealSecretName }}
+{{- if .Data.RaftStorageEnabled }}
+            - -raft-leader=https://{{ .Name }}-server-0.{{ .ServerServiceName }}:8200
+{{- end }}
           volumeMounts:
-            - name: vault-secrets
-              mountPath: /vault/secrets
+            - name: vault-tls
+              mountPath: /vault/tls
+              readOnly: true
       volumes:
-        - name: vault-secrets
-          projected:
-            sources:
-              - secret:
-                  name: {{ .Data.UnsealSecretName }}
+        - name: vault-tls
+          secret:
+            secretName: {{ .Name }}-server-tls
 `
 
 var unsealSATemplate = `apiVersion: v1
@@ -83,16 +71,11 @@ rules:
   - apiGroups:
       - ""
     resources:
-      - pods
+      - secrets
     verbs:
       - get
-      - list
-  - apiGroups:
-      - ""
-    resources:
-      - pods/exec
-    verbs:
-      - create
+    resourceNames:
+      - {{ .Data.UnsealSecretName }}
 `
 
 var unsealRoleBindingTemplate = `apiVersion: rbac.authorization.k8s.io/v1
@@ -111,3 +94,109 @@ subjects:
   - kind: ServiceAccount
     name: {{ .Name }}-unseal
 `
+
+func unsealerTemplates() map[string]string {
+	return map[string]string{
+		"unsealer-deploy":      unsealerDeploymentTemplate,
+		"unsealer-sa":          unsealerSATemplate,
+		"unsealer-role":        unsealerRoleTemplate,
+		"unsealer-rolebinding": unsealerRoleBindingTemplate,
+	}
+}
+
+var unsealerDeploymentTemplate = `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: {{ .Name }}-unsealer
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+spec:
+  replicas: 1
+  selector:
+    matchLabels:
+      app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+      app.kubernetes.io/component: unsealer
+  template:
+    metadata:
+      # Server Services select the app.kubernetes.io/name label, so it is
+      # left off of unsealer Pods.
+      labels:
+        app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+        app.kubernetes.io/component: unsealer
+    spec:
+      serviceAccountName: {{ .Name }}-unsealer
+      containers:
+        - name: vault-unsealer
+          image: {{ .Data.OperatorImage }}
+          command:
+            - vault-operator
+            - unseal
+            - -interval={{ .Data.UnsealerIntervalSeconds }}s
+            - -ca-cert=/vault/tls/ca.pem
+{{- if .Data.TLSGeneratorJobEnabled }}
+            - -client-cert=/vault/tls/cli-client.pem
+            - -client-key=/vault/tls/cli-client-key.pem
+{{- end }}
+            - -address={{ range $i, $h := .Hostnames }}{{ if $i }},{{ end }}https://{{ $h }}.{{ $.ServerServiceName }}:8200{{ end }}
+            - -key-threshold={{ .Data.KeyThreshold }}
+            - -secret-name={{ .Data.UnsealSecretName }}
+{{- if .Data.RaftStorageEnabled }}
+            - -raft-leader=https://{{ .Name }}-server-0.{{ .ServerServiceName }}:8200
+{{- end }}
+          volumeMounts:
+            - name: vault-tls
+              mountPath: /vault/tls
+              readOnly: true
+      volumes:
+        - name: vault-tls
+          secret:
+            secretName: {{ .Name }}-server-tls
+`
+
+var unsealerSATemplate = `apiVersion: v1
+kind: ServiceAccount
+metadata:
+  name: {{ .Name }}-unsealer
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+`
+
+var unsealerRoleTemplate = `apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: {{ .Name }}-unsealer
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+rules:
+  - apiGroups:
+      - ""
+    resources:
+      - secrets
+    verbs:
+      - get
+    resourceNames:
+      - {{ .Data.UnsealSecretName }}
+`
+
+var unsealerRoleBindingTemplate = `apiVersion: rbac.authorization.k8s.io/v1
+kind: RoleBinding
+metadata:
+  name: {{ .Name }}-unsealer
+  namespace: "{{ .Namespace }}"
+  labels:
+    app.kubernetes.io/name: {{ index .Labels "app.kubernetes.io/name" }}
+    app.kubernetes.io/instance: {{ index .Labels "app.kubernetes.io/instance" }}
+roleRef:
+  apiGroup: rbac.authorization.k8s.io
+  kind: Role
+  name: {{ .Name }}-unsealer
+subjects:
+  - kind: ServiceAccount
+    name: {{ .Name }}-unsealer
+`